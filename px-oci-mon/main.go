@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"regexp"
-	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,6 +20,7 @@ import (
 	"github.com/portworx/sched-ops/k8s"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
@@ -27,10 +32,26 @@ const (
 	pxConfigFile       = "/etc/pwx/config.json"
 	pxImageKey         = "PX_IMAGE"
 	pxImageIDKey       = "PX_IMAGE_ID"
+	installRecordFile  = "/etc/pwx/oci-install.json"
 	instK8sDir         = "/opt/pwx/oci/inst-k8s"
 	instScratchDir     = "/opt/pwx/oci/inst-scratchDir"
-	sha1verBegin       = 7
+	instRetainDir      = "/opt/pwx/oci/inst-retained"
+	instDryRunDir      = "/opt/pwx/oci/inst-dryRun"
+	shutdownGrace      = 25 * time.Second
+	switchJournalFile  = "/opt/pwx/oci/.switch-journal.json"
+	pendingActionFile  = "/etc/pwx/oci-pending.json"
 	sha1verEnd         = 19
+	// maintenanceTick is how often the pending install actions check for the maintenance window
+	maintenanceTick = time.Minute
+	// upgradeLockName is the default ConfigMap of the cluster-wide upgrade lock
+	upgradeLockName = "px-oci-upgrade-lock"
+	// upgradeLockPoll is how often we retry acquiring the upgrade lock
+	upgradeLockPoll = 30 * time.Second
+	// quorumPoll is how often we recheck the PX cluster quorum, before taking PX down
+	quorumPoll = 30 * time.Second
+	// installRetryMin and installRetryMax bound the exponential backoff of the failed install retries
+	installRetryMin = 30 * time.Second
+	installRetryMax = 10 * time.Minute
 	// pxImagePrefix will be combined w/ PXTAG to create the linked docker-image
 	pxImagePrefix = "portworx/px-enterprise"
 	defaultPXTAG  = "1.2.12.1"
@@ -45,19 +66,49 @@ var (
 	ociService         *utils.OciServiceControl
 	ociRestServer      *utils.OciRESTServlet
 	ociPrivateMounts   = map[string]bool{
-		"/etc/pwx:/etc/pwx":                         true,
-		"/opt/pwx:/opt/pwx":                         true,
-		"/etc/systemd/system:/etc/systemd/system":   true,
-		"/proc/1/ns:/host_proc/1/ns":                true,
-		"/var/run/docker.sock:/var/run/docker.sock": true,
-	}
-	kubernetesArgs    = []string{"-x", "kubernetes"}
-	optPreSync        = false
-	optDrainAllPods = false
-	optRestEndpoint   = ""
-	meNode            *v1.Node
+		"/etc/pwx:/etc/pwx":                       true,
+		"/opt/pwx:/opt/pwx":                       true,
+		"/etc/systemd/system:/etc/systemd/system": true,
+		"/proc/1/ns:/host_proc/1/ns":              true,
+	}
+	kubernetesArgs   = []string{"-x", "kubernetes"}
+	optPreSync       = false
+	optDrainAllPods  = false
+	optRestEndpoint  = ""
+	optDryRun        = false
+	optRuntime       = ""
+	optHealthTimeout = 10 * time.Minute
+	optRetain        = 2
+	optRestSecurity  = &utils.RESTSecurityConfig{}
+	optRestartPolicy = ""
+	optMaintenance   = ""
+	optMaxParallel   = 1
+	optUpgradeLock   = ""
+	optLockTTL       = 5 * time.Minute
+	optSkipQuorum    = false
+	optDrainPolicy   = ""
+	optDrainTimeout  = time.Duration(0)
+	optDrainBlocked  = ""
+	optDrainExclude  []string
+	optTrustDigests  []string
+	optVerifyKey     = ""
+	optSignatures    = ""
+	imageVerifier    *utils.ImageVerifier
+	optRegistryCfg   = utils.DefaultRegistryConfig
+	registryCreds    *utils.RegistryCredentials
+	optImageArchive  = ""
+	optPull          = utils.DefaultPullConfig()
+	installLock      sync.Mutex
+	// lifecycleCtx is cancelled when the shutdown is requested (e.g. SIGTERM)
+	lifecycleCtx, lifecycleCancel = context.WithCancel(context.Background())
+	ociParts                      = strings.Fields("bin oci/rootfs oci/config.json")
+	meNode                        *v1.Node
+	// maintenanceWaiting is set while waiting for the maintenance window
+	maintenanceWaiting int32
+	// pxDisabled mirrors lastPxDisabled for the goroutines other than the node-watch (e.g. install retries)
+	pxDisabled int32
 	// PXTAG is externally defined image tag (can use `go build -ldflags "-X main.PXTAG=1.2.3" ... `
-	// to set portworx/px-enterprise:1.2.3)
+	// to set portworx/px-enterprise:1.2.3, or `-X main.PXTAG=sha256:<hex>` to pin the image digest)
 	PXTAG string
 )
 
@@ -69,19 +120,48 @@ func usage(args ...interface{}) {
 	}
 
 	fmt.Printf(`Usage: %[1]s [options]
+       %[1]s export-image [--runtime <runtime>] [--registry-config <f>] <archive> [<image>]
 
 options:
    --endpoint <ip:port>  Start REST service at specific endpoint
+   --tls-cert <file>     Serve REST service over TLS, using given certificate (requires --tls-key)
+   --tls-key <file>      Private key for the REST service TLS certificate
+   --tls-client-ca <f>   Authenticate REST service calls via client certificates signed by given CA
+   --auth-token-file <f> Authenticate REST service calls via bearer token stored in given file
+   --auth-tokenreview    Authenticate REST service calls via Kubernetes TokenReview of bearer tokens
+   --auth-users <u1,..>  Only allow given users (client-certificate CN or TokenReview user)
    --sync                Will issue sync operation before stopping/restarting the PX-OCI service
    --drain-all           Will drain ALL PX-dependent pods before upgrade (dfl. only managed nodes get drained)
+   --drain-timeout <t>   Timeout for evicting the PX-dependent pods (dfl. 5m)
+   --drain-blocked <a>   Action if PodDisruptionBudgets block the drain past timeout: abort, wait, force (dfl. abort)
+   --drain-exclude <ns>  Do not drain pods in given namespaces (comma-separated, may end with '*' wildcard)
+   --drain-policy <p>    Apply drain policy from file, or ConfigMap (configmap:<namespace>/<name>)
+   --trusted-digest <d>  Only install PX images of given manifest digests (comma-separated sha256:<hex>)
+   --verify-key <file>   Verify PX image signature via given public key (PEM-encoded RSA, ECDSA or Ed25519)
+   --signatures <dir>    Read PX image signatures from given directory (dfl. directory of --verify-key)
+   --image-archive <p>   Install PX image from given tarball, or OCI-layout directory, instead of pulling it
+   --registry-mirror <m> Pull PX image from given registry mirrors on failures (comma-separated, Docker only)
+   --pull-retries <N>    Retry the PX image pull N times on transient errors (dfl. 5, Docker only)
+   --pull-timeout <t>    Abort and retry the PX image pull if no progress within given time (dfl. 5m, Docker only)
+   --registry-config <f> Pull PX image w/ registry credentials from given .dockerconfigjson file (dfl. %[2]s)
+   --runtime <runtime>   Use given container runtime (docker, containerd, crio or unix:///path/to/runtime.sock)
+   --health-timeout <t>  Roll back the upgrade if PX not healthy within given time (dfl. 10m, 0 disables)
+   --retain <N>          Retain N previous OCI installs for the rollback (dfl. 2, 0 disables)
+   --restart-policy <p>  Classify config changes via policy file, or ConfigMap (configmap:<namespace>/<name>)
+   --maintenance <w>     Defer drain/switchover/restart until maintenance windows defined via file, or ConfigMap
+   --max-parallel <N>    Allow at most N nodes in drain/switchover/restart at a time (dfl. 1, 0 disables)
+   --upgrade-lock <n/n>  Namespace/name of the upgrade-lock ConfigMap (dfl. <pod namespace>/px-oci-upgrade-lock)
+   --lock-ttl <t>        Expire the upgrade lock of unresponsive nodes after given time (dfl. 5m)
+   --skip-quorum-check   Take PX down even if other PX nodes are offline, or PX quorum would break
    --log <file>          Will use logfile instead of Docker-log
    --debug               Increase logs-verbosity to debug-level
+   --dry-run             Print the install/upgrade actions, without changing the PX-OCI install
    *                     Any additional options will be passed on to px-runc
 
 NOTE that any options not explicitly listed above, will be passed directly to px-runc.
 For details please see http://docs.portworx.com/runc
 
-`, os.Args[0])
+`, os.Args[0], utils.DefaultRegistryConfig)
 	os.Exit(1)
 }
 
@@ -102,57 +182,188 @@ func (c *cachingOutput) String() string {
 
 // -- Output Filters
 
-type installStatus struct {
-	needRestart bool
-	needInstall bool
-	needCordon  bool
+// loadInstallRecord loads the install record, or reconstructs it from the OCI's config.json (e.g. older installs)
+func loadInstallRecord() *utils.InstallState {
+	record, err := utils.LoadInstallState(installRecordFile)
+	if err == nil {
+		logrus.Infof("Loaded install record (image %s, last result %q)",
+			utils.ShortID(record.ImageID), record.LastResult)
+		return record
+	} else if !os.IsNotExist(err) {
+		logrus.WithError(err).Warn("Could not load install record (ignoring)")
+	}
+
+	record = &utils.InstallState{}
+	ociConfigFile := path.Join(baseDir, "config.json")
+	installedID, err := utils.ExtractEnvFromOciConfig(ociConfigFile, pxImageIDKey)
+	if err == nil && len(installedID) > sha1verEnd {
+		logrus.Info("Reconstructed install record from ", ociConfigFile)
+		record.ImageID = installedID
+	} else {
+		logrus.WithError(err).Warnf("Could not retrieve installed OCI image ID (is this initial install?)")
+	}
+	return record
+}
+
+// saveInstallRecord persists the install record, along with the outcome of the last install
+func saveInstallRecord(record *utils.InstallState, err error) {
+	if _, ok := err.(*rollbackError); ok {
+		record.LastResult, record.LastError = utils.InstallResultRolledBack, err.Error()
+	} else if err != nil {
+		record.SetFailed(err)
+		utils.MarkLastError()
+	} else {
+		record.LastResult, record.LastError = utils.InstallResultOK, ""
+	}
+	record.InProgress = ""
+	persistInstallRecord(record)
+}
+
+// persistInstallRecord saves the install record as is (e.g. to track the install progress)
+func persistInstallRecord(record *utils.InstallState) {
+	if err := record.Save(installRecordFile); err != nil {
+		logrus.WithError(err).Error("Could not save install record")
+	}
+}
+
+// checkShutdown returns an error if the shutdown has been requested, so the install aborts before a given step
+func checkShutdown(step string) error {
+	if lifecycleCtx.Err() != nil {
+		return fmt.Errorf("Aborting before %s: shutdown requested", step)
+	}
+	return nil
+}
+
+// logPlan logs the install plan in human-readable form
+func logPlan(plan *utils.InstallPlan) {
+	for _, l := range strings.Split(plan.String(), "\n") {
+		logrus.Info("PLAN: ", l)
+	}
+}
+
+// loadRestartPolicy loads the restart policy (falls back to the default policy on errors), and resolves it against
+// the kubelet's root directory.
+func loadRestartPolicy() *utils.RestartPolicy {
+	pol := utils.DefaultRestartPolicy()
+	if optRestartPolicy != "" {
+		if p, err := utils.LoadRestartPolicy(optRestartPolicy); err != nil {
+			logrus.WithError(err).Error("Could not load restart policy (using default)")
+			recordEvent(v1.EventTypeWarning, utils.EventRestartPolicyInvalid,
+				"Could not load restart policy from %s: %s", optRestartPolicy, err)
+		} else {
+			pol = p
+		}
+	}
+	kubeletDir, err := getKubernetesRootDirFn()
+	if err != nil {
+		logrus.WithError(err).Error("Error scanning kubelet process")
+		kubeletDir = ""
+	}
+	return pol.WithKubeletDir(kubeletDir)
+}
+
+// loadDrainPolicy loads the drain policy (falls back to default if invalid), and applies the command-line overrides
+func loadDrainPolicy() *utils.DrainPolicy {
+	pol := utils.DefaultDrainPolicy()
+	if optDrainPolicy != "" {
+		if p, err := utils.LoadDrainPolicy(optDrainPolicy); err != nil {
+			logrus.WithError(err).Error("Could not load drain policy (using default)")
+			recordEvent(v1.EventTypeWarning, utils.EventDrainPolicyInvalid,
+				"Could not load drain policy from %s: %s", optDrainPolicy, err)
+		} else {
+			pol = p
+		}
+	}
+	if optDrainTimeout > 0 {
+		pol.SetTimeout(optDrainTimeout)
+	}
+	if optDrainBlocked != "" {
+		pol.OnBlocked = optDrainBlocked
+	}
+	pol.ExcludeNamespaces(optDrainExclude...)
+	return pol
+}
+
+// hashRuncConfig computes the hash of the px-runc configuration, ignoring the image ID and the arguments, mounts and
+// environment that do not require the restart according to the policy.
+func hashRuncConfig(pol *utils.RestartPolicy, args, mounts, env []string) string {
+	envNoID := make([]string, 0, len(env))
+	for _, e := range env {
+		if strings.HasPrefix(e, pxImageIDKey+"=") {
+			continue
+		}
+		envNoID = append(envNoID, e)
+	}
+	return utils.HashConfig(pol.Filter(args, mounts, envNoID))
 }
 
-// installPxFromOciImage downloads the Docker image, and (if required) runs the install/upgrade to the alternate location.
-func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *utils.SimpleContainerConfig) (installStatus, error) {
+// installPxFromOciImage downloads the container image, and (if required) runs the install/upgrade to the alternate location.
+// The install/restart decisions are made by comparing the install record against the desired state.  If sandbox is
+// set, the configuration changes are evaluated w/o touching the live OCI install (see outsideMaintenanceWindow()).
+func installPxFromOciImage(rt utils.InstallerRuntime, imageName string, cfg *utils.SimpleContainerConfig,
+	record *utils.InstallState, sandbox bool) (*utils.InstallPlan, *utils.InstallState, error) {
 	logrus.Info("Downloading Portworx image...")
 
-	retSt := installStatus{false, false, false} // assume no install/restart/cordon needed
+	desired := &utils.InstallState{ImageName: imageName}
 
+	downloaded := false
 	downloadCbFn := func() error {
-		logrus.Info("Docker image download detected - assuming upgrade and setting OCI-mon to unhealthy")
+		logrus.Info("Image download detected - assuming upgrade and setting OCI-mon to unhealthy")
 		ociRestServer.SetStateInstalling()
+		downloaded = true
 		return nil
 	}
 
-	err := di.PullImageCb(imageName, downloadCbFn)
-	if err != nil {
+	start := time.Now()
+	var err error
+	var archived *utils.ArchivedImage
+	if optImageArchive != "" {
+		archived, err = importPxImage(rt, imageName, downloadCbFn)
+	} else {
+		err = rt.PullImageCb(imageName, downloadCbFn)
+	}
+	utils.ObserveOperation(utils.OpPull, start, err)
+	if err != nil && checkShutdown("image pull") != nil {
+		return nil, desired, checkShutdown("OCI install")
+	} else if err != nil && optImageArchive != "" {
+		logrus.WithError(err).Error("Could not import ", imageName)
+		recordEvent(v1.EventTypeWarning, utils.EventInstallFailed, "Could not import %s: %s", imageName, err)
+		return nil, desired, err
+	} else if err != nil {
 		logrus.WithError(err).Error("Could not pull ", imageName)
-		usage("Could not pull " + imageName +
-			" - have you specified REGISTRY_USER/REGISTRY_PASS env. variables?")
+		recordEvent(v1.EventTypeWarning, utils.EventInstallFailed, "Could not pull %s: %s", imageName, err)
+		return nil, desired, fmt.Errorf("Could not pull %s: %s - have you mounted the registry credentials to %s "+
+			"(or specified REGISTRY_USER/REGISTRY_PASS env. variables)?", imageName, err, optRegistryCfg)
 	}
 
-	retSt.needInstall = true // assume yes, fix later
-	if pulledID, err := di.GetImageID(imageName); err == nil && len(pulledID) > sha1verEnd {
+	if pulledID, err := rt.GetImageID(imageName); err == nil && len(pulledID) > sha1verEnd {
 		logrus.Info("Pulled PX image ID ", pulledID)
-		cfg.Env = append(cfg.Env, pxImageIDKey+"="+pulledID)
-
-		// compare w/ installed image
-		ociConfigFile := path.Join(baseDir, "config.json")
-		installedID, err := utils.ExtractEnvFromOciConfig(ociConfigFile, pxImageIDKey)
-		if err == nil && len(installedID) > sha1verEnd {
-			if pulledID == installedID {
-				logrus.Infof("Installed image ID %s same as pulled image ID %s",
-					installedID[sha1verBegin:sha1verEnd], pulledID[sha1verBegin:sha1verEnd])
-				retSt.needInstall = false
-				ociRestServer.SetStateInstallFinished()
-			} else {
-				logrus.Infof("Installed image ID %s _DIFFERENT_ than pulled image ID %s",
-					installedID[sha1verBegin:sha1verEnd], pulledID[sha1verBegin:sha1verEnd])
-			}
-		} else {
-			logrus.WithError(err).Warnf("Could not retrieve installed OCI image ID (is this initial install?)")
+		if downloaded && optImageArchive == "" {
+			recordEvent(v1.EventTypeNormal, utils.EventImagePulled, "Pulled image %s (%s)", imageName,
+				utils.ShortID(pulledID))
 		}
+		cfg.Env = append(cfg.Env, pxImageIDKey+"="+pulledID)
+		desired.ImageID = pulledID
 	} else {
 		logrus.WithError(err).Error("Could not retrieve PX image ID")
 	}
+	if err = verifyPxImage(rt, imageName, archived); err != nil {
+		return nil, desired, err
+	}
+
+	// compare w/ installed image
+	plan := record.DiffImage(desired)
+	if !plan.NeedInstall {
+		logrus.Infof("Installed image ID %s same as pulled image ID %s",
+			utils.ShortID(record.ImageID), utils.ShortID(desired.ImageID))
+		ociRestServer.SetStateInstallFinished()
+	}
 
-	if retSt.needInstall {
+	if err = checkShutdown("OCI install"); err != nil {
+		return plan, desired, err
+	} else if plan.NeedInstall && isDryRun("run %s to install %s into %s", ociInstallerName, imageName, instK8sDir) {
+		logrus.Info("DRY-RUN: Skipping install of Portworx OCI files (cordon requirement unknown)")
+	} else if plan.NeedInstall {
 		logrus.Info("Installing/Upgrading Portworx OCI files (restart pending)")
 
 		args := []string{"--upgrade"}
@@ -166,21 +377,26 @@ func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *uti
 			if err != nil {
 				// log incomplete, require cordoning/draining
 				logrus.WithError(err).Warnf("Could not get complete px-oci-installer log")
-				retSt.needCordon = true
+				plan.AddCordonReason("incomplete px-oci-installer log")
 			} else if bytes.Contains(log, []byte(" require reboot ")) {
 				logrus.Warn("Will require Cordoning/Draining the node's containers")
-				retSt.needCordon = true
+				plan.AddCordonReason("PX module update requires reboot")
 			} else {
 				logrus.Info("PX module OK (no cordon/pod-draining required)")
-				retSt.needCordon = false
 			}
 		}
-		err := di.RunOnce(imageName, ociInstallerName, []string{instK8sDir + ":/opt/pwx", "/etc/pwx:/etc/pwx"},
+		start := time.Now()
+		err := rt.RunOnce(imageName, ociInstallerName, []string{instK8sDir + ":/opt/pwx", "/etc/pwx:/etc/pwx"},
 			[]string{"/runc-entry-point.sh"}, args, logProcCb)
-		if err != nil {
+		utils.ObserveOperation(utils.OpInstall, start, err)
+		if err != nil && checkShutdown(ociInstallerName) != nil {
+			return plan, desired, checkShutdown("OCI configuration")
+		} else if err != nil {
 			logrus.WithError(err).Error("Could not install ", imageName)
-			usage("Could not install " + imageName +
-				" - please inspect docker's log, and contact Portworx support.")
+			recordEvent(v1.EventTypeWarning, utils.EventInstallFailed, "Could not run %s for %s: %s",
+				ociInstallerName, imageName, err)
+			return plan, desired, fmt.Errorf("Could not install %s: %s - please inspect container runtime's log, "+
+				"and contact Portworx support", imageName, err)
 		}
 	}
 
@@ -189,8 +405,22 @@ func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *uti
 	// Compose startup-line for PX-RunC
 	args := make([]string, 0, 6+len(cfg.Args)+len(cfg.Env)*2+len(cfg.Mounts)*2)
 	var pxUnitFile string
-	var oldUnitFileModTime time.Time
-	if retSt.needInstall {
+	unitFileExisted := false
+	if optDryRun || (sandbox && !plan.NeedInstall) {
+		// NOTE: in dry-run mode (or, if the install actions may get deferred), we evaluate the config against the
+		// sandboxed copy of the installed OCI config, not to touch the live OCI config and unit-file
+		if !isExist("/opt/pwx/bin/px-runc") {
+			logrus.Warn("px-runc not installed - skipping the configuration check")
+			plan.AddRestartReason("initial config")
+			return plan, desired, nil
+		}
+		ociDir, err := prepareDryRunOci()
+		if err != nil {
+			return plan, desired, err
+		}
+		defer os.RemoveAll(ociDir)
+		args = append(args, "/opt/pwx/bin/px-runc", "install", "-oci", ociDir, "-sysd", "/dev/null")
+	} else if plan.NeedInstall {
 		// NOTE: we dumped the OCI into a separate directory!
 		// now we need a tweaked install-- example /opt/pwx/k8s/bin/px-runc install -oci /opt/pwx/k8s/oci -sysd /dev/null -c zox-dbg-mk126 -m enp0s8 -d enp0s8 -s /dev/sdc
 		args = append(args, path.Join(instK8sDir, "bin/px-runc"), "install", "-oci",
@@ -198,14 +428,20 @@ func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *uti
 		pxUnitFile = ""
 	} else {
 		args = append(args, "/opt/pwx/bin/px-runc", "install")
-
+	}
+	if optDryRun || !plan.NeedInstall {
 		pxUnitFile = fmt.Sprintf(baseServiceFileFmt, baseServiceName)
-		if st, err := os.Stat(pxUnitFile); err != nil {
+		if sum, err := utils.FileChecksum(pxUnitFile); err != nil {
 			logrus.WithError(err).Warn("Could not find service-file (is this initial install?)")
 		} else {
-			oldUnitFileModTime = st.ModTime()
+			unitFileExisted = true
+			if record.UnitFileChecksum == "" {
+				// older install w/o unit-file checksum recorded -- compare against the current unit-file
+				record.UnitFileChecksum = sum
+			}
 		}
 	}
+	baseArgsLen := len(args)
 
 	if strings.HasSuffix(strings.ToLower(os.Args[1]), "install") {
 		// skip INSTALL/UNINSTALL arg...
@@ -213,20 +449,23 @@ func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *uti
 	} else {
 		args = append(args, os.Args[1:]...)
 	}
+	pxArgs := args[baseArgsLen:]
 
 	// Add Mounts
+	mounts := make([]string, 0, len(cfg.Mounts))
 	for _, vol := range cfg.Mounts {
 		// skip local mounts, pass the others
 		if _, has := ociPrivateMounts[vol]; has {
 			logrus.Debugf("Skipping mount %s", vol)
 			continue
-		} else if len(vol) < 4 || strings.HasPrefix(vol, "/var/run/docker.sock:") {
+		} else if len(vol) < 4 || isRuntimeSocketMount(vol) {
 			// Additional checks - skip anything under `len(a:/b)`, also under no circumstances
-			// should we pass docker.sock directly
+			// should we pass docker.sock (or other runtime sockets) directly
 			logrus.Debugf("Also skipping mount %s", vol)
 			continue
 		}
 		args = append(args, "-v", vol)
+		mounts = append(mounts, vol)
 	}
 
 	// Add Environment
@@ -236,11 +475,27 @@ func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *uti
 
 	// TODO: Add Labels?
 
+	pol := loadRestartPolicy()
+	desired.ConfigHash = hashRuncConfig(pol, pxArgs, mounts, cfg.Env)
+
+	// px-runc install updates the live OCI config and unit-file (unless sandboxed) -- track it in the install record
+	liveConfig := !optDryRun && !sandbox && !plan.NeedInstall && record.InProgress == ""
+	if liveConfig {
+		record.InProgress = "configure"
+		persistInstallRecord(record)
+	}
 	var installOutput cachingOutput
-	if err = ociService.RunExternal(&installOutput, args[0], args[1:]...); err != nil {
+	err = ociService.RunExternal(&installOutput, args[0], args[1:]...)
+	if !optDryRun {
+		ociRestServer.SetInstallOutput(installOutput.String())
+	}
+	if err != nil {
 		logrus.WithError(err).Error("Could not install PX-RunC")
-		retSt.needRestart = true
-		return retSt, err
+		plan.AddRestartReason("px-runc install failed")
+		return plan, desired, err
+	}
+	if liveConfig {
+		record.InProgress = ""
 	}
 
 	/*
@@ -249,42 +504,71 @@ func installPxFromOciImage(di *utils.DockerInstaller, imageName string, cfg *uti
 
 	// 1. check status of the unit-file (if valid)
 	if pxUnitFile != "" {
-		if oldUnitFileModTime.IsZero() {
-			logrus.Info("Portworx service restart required due to initial config.")
-			retSt.needRestart = true
+		if !unitFileExisted {
+			plan.AddRestartReason("initial config")
 			// let's also do reload + enable of the service
-			if err = ociService.Reload(); err != nil {
-				logrus.WithError(err).Error("Could not reload service.")
-			}
-			if err = ociService.Enable(); err != nil {
-				logrus.WithError(err).Error("Could not enable service.")
+			if !isDryRun("reload systemd services, and enable %s service", baseServiceName) && !sandbox {
+				if err = ociService.Reload(); err != nil {
+					logrus.WithError(err).Error("Could not reload service.")
+				}
+				if err = ociService.Enable(); err != nil {
+					logrus.WithError(err).Error("Could not enable service.")
+				}
 			}
-		} else if newUnitSt, err := os.Stat(pxUnitFile); err != nil {
-			err2 := fmt.Errorf("Could not stat %s: %s", pxUnitFile, err)
-			retSt.needRestart = true
-			return retSt, err2
-		} else if newUnitSt.ModTime().Sub(oldUnitFileModTime) > 0 {
-			logrus.Info("Portworx service restart required due to updated ", pxUnitFile)
-			retSt.needRestart = true
+		} else if desired.UnitFileChecksum, err = utils.FileChecksum(pxUnitFile); err != nil {
+			err2 := fmt.Errorf("Could not checksum %s: %s", pxUnitFile, err)
+			plan.AddRestartReason("unreadable %s", pxUnitFile)
+			return plan, desired, err2
 		}
-	} else if retSt.needInstall {
-		logrus.Info("Portworx service restart required due to OCI upgrade/install")
-		retSt.needRestart = true
 	}
 
-	// 2. check output of "px-runc install"
-	if isRestartRequired(installOutput.String()) {
-		logrus.Info("Portworx service restart required due to configuration update.")
-		retSt.needRestart = true
+	// 2. compare the installed vs. desired state
+	record.DiffConfig(desired, plan)
+
+	// 3. check output of "px-runc install"
+	if res, err := utils.ParseRuncInstallOutput(installOutput.String()); err != nil {
+		// note: not forcing the restart, config changes are still detected via the install record
+		logrus.WithError(err).Error("Could not parse px-runc install output")
+		recordEvent(v1.EventTypeWarning, utils.EventRuncOutputUnrecognized, "Unrecognized px-runc install output: %s", err)
+	} else {
+		logrus.Infof("px-runc install reported %s", res)
+		restart, deferred := isRestartRequired(res, pol)
+		if restart {
+			plan.AddRestartReason("px-runc reported configuration update")
+		}
+		for _, d := range deferred {
+			plan.AddDeferredReason("%s", d)
+		}
 	}
 
-	// 3. check for missing /etc/pwx/config.json
+	// 4. check for missing /etc/pwx/config.json
 	if _, err := os.Stat(pxConfigFile); err != nil {
 		logrus.WithError(err).Debug("Error stat ", pxConfigFile)
-		logrus.Info("Portworx service restart required due to missing/invalid ", pxConfigFile)
-		retSt.needRestart = true
+		plan.AddRestartReason("missing/invalid %s", pxConfigFile)
+	}
+	return plan, desired, nil
+}
+
+// prepareDryRunOci sets up a sandbox OCI directory, which links the installed rootfs and copies its config.json,
+// so `px-runc install` can evaluate the configuration changes without touching the installed OCI bits.
+func prepareDryRunOci() (string, error) {
+	if isExist(instDryRunDir) {
+		os.RemoveAll(instDryRunDir)
+	}
+	if err := os.MkdirAll(instDryRunDir, 0700); err != nil {
+		return "", fmt.Errorf("Could not create %s: %s", instDryRunDir, err)
+	}
+	if isExist(baseDir, "rootfs") {
+		if err := os.Symlink(path.Join(baseDir, "rootfs"), path.Join(instDryRunDir, "rootfs")); err != nil {
+			return "", fmt.Errorf("Could not link rootfs into %s: %s", instDryRunDir, err)
+		}
+	}
+	if buf, err := ioutil.ReadFile(path.Join(baseDir, "config.json")); err == nil {
+		if err = ioutil.WriteFile(path.Join(instDryRunDir, "config.json"), buf, 0600); err != nil {
+			return "", fmt.Errorf("Could not copy config.json into %s: %s", instDryRunDir, err)
+		}
 	}
-	return retSt, nil
+	return instDryRunDir, nil
 }
 
 func validateMounted(mounts ...string) error {
@@ -316,6 +600,29 @@ func validateMounted(mounts ...string) error {
 	return err
 }
 
+// copyFile copies the file content and permissions
+func copyFile(src, dest string) error {
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, buf, st.Mode().Perm())
+}
+
+// isRuntimeSocketMount returns TRUE if the mount is container runtime's socket (e.g. docker.sock)
+func isRuntimeSocketMount(vol string) bool {
+	for _, sock := range utils.RuntimeSockets {
+		if strings.HasPrefix(vol, sock+":") {
+			return true
+		}
+	}
+	return false
+}
+
 // isExist returns TRUE only if path exists
 func isExist(parts ...string) bool {
 	path := path.Join(parts...)
@@ -325,22 +632,20 @@ func isExist(parts ...string) bool {
 
 // moveFileOrDir moves a file or a directory from one location to another
 func moveFileOrDir(src, dest string) error {
-	// os.Rename(src, dest) -- cannot use in case of moves across mountpoints
-	cmd := exec.Command("/bin/mv", src, dest)
-	var out bytes.Buffer
-	cmd.Stdout, cmd.Stderr = &out, &out
-	err := cmd.Run()
-
+	res, err := utils.MoveFileOrDir(src, dest)
 	if err != nil {
-		logrus.WithError(err).WithField("out", out.String()).Errorf("Could not move %s to %s", src, dest)
-		err = fmt.Errorf("Could not move %s to %s: %s", src, dest, err)
+		logrus.WithError(err).Errorf("Could not move %s to %s", src, dest)
+		return err
+	} else if res.Copied {
+		logrus.Infof("Moved %s to %s across devices (%d files, %d bytes copied)", src, dest, res.Files, res.Bytes)
 	}
-	return err
+	return nil
 }
 
-// switchOciInstall moves the new OCI-rootfs at {optK8sDir}, to the original /opt/pwx
-func switchOciInstall() error {
-	logrus.Infof("Finalizing OCI install -- Moving temp OCI image from %s/ to /opt/pwx/", instK8sDir)
+// switchOciInstall moves the new OCI-rootfs at {srcDir} (install of a given target image), to the original /opt/pwx
+// The moves are journaled at {switchJournalFile}, so the interrupted switchover can be recovered on the next start.
+func switchOciInstall(srcDir string, target *utils.InstallState) error {
+	logrus.Infof("Finalizing OCI install -- Moving temp OCI image from %s/ to /opt/pwx/", srcDir)
 
 	success := false
 
@@ -353,35 +658,45 @@ func switchOciInstall() error {
 		return fmt.Errorf("Could not create %s: %s", instScratchDir, err)
 	}
 
-	ociParts := strings.Fields("bin oci/rootfs oci/config.json")
+	// plan the moves: mv <orig> to <scratch>, and mv <new> to <orig> ...
+	moves := make([]utils.SwitchMove, 0, 2*len(ociParts))
+	for _, p := range ociParts {
+		org, neo, scr := path.Join("/opt/pwx", p), path.Join(srcDir, p), path.Join(instScratchDir, p)
+		if isExist(org) {
+			moves = append(moves, utils.SwitchMove{Src: org, Dest: scr})
+		}
+		moves = append(moves, utils.SwitchMove{Src: neo, Dest: org})
+	}
+	journal, err := utils.NewSwitchJournal(switchJournalFile, srcDir, target.ImageName, target.ImageID, moves)
+	if err != nil {
+		return fmt.Errorf("Could not create switchover journal: %s", err)
+	}
 
 	// schedule rollback (if required) and cleanup
 	defer func() {
 		if !success {
 			logrus.Warnf("ROLLBACK: Rolling back %s/{bin,oci/*} to /opt/pwx/", instScratchDir)
-			for _, p := range ociParts {
-				if isExist(instScratchDir, p) {
-					org, scr := path.Join("/opt/pwx", p), path.Join(instScratchDir, p)
-					if err = os.RemoveAll(org); err != nil {
-						logrus.WithError(err).Warn("Could not remove ", org)
-					}
-					logrus.Warn("ROLLBACK: Removed ", org)
-
-					if err = moveFileOrDir(scr, org); err != nil {
-						logrus.WithError(err).Warnf("Rollback %s FAILED", p)
-					} else {
-						logrus.Warnf("ROLLBACK: Moved %s to %s", scr, org)
-					}
-				}
+			if err := journal.Rollback(moveFileOrDir); err != nil {
+				logrus.WithError(err).Error("Rollback FAILED (will retry on restart)")
+				return
 			}
 			logrus.Warn("ROLLBACK: Rollback completed.")
 		}
-		// fire off general async cleanup
+		if err := journal.Remove(); err != nil {
+			logrus.WithError(err).Warn("Could not remove switchover journal")
+		}
+		// fire off general async cleanup (note, on success we retain the previous install for the rollback)
 		go func() {
-			toRm := []string{instK8sDir, instScratchDir}
+			toRm := []string{srcDir}
+			if !success {
+				toRm = []string{instScratchDir}
+				if srcDir == instK8sDir {
+					toRm = append(toRm, srcDir)
+				}
+			}
 			logrus.Info("ASYNC: Launched deletion of ", toRm)
 			for _, dir := range toRm {
-				if err = os.RemoveAll(dir); err != nil {
+				if err := os.RemoveAll(dir); err != nil {
 					logrus.WithError(err).Warn("Could not remove ", dir)
 				}
 			}
@@ -394,22 +709,17 @@ func switchOciInstall() error {
 		// let's still continue, and attempt upgrade w/ the service "live"
 	}
 
-	logrus.Infof("Moving old /opt/pwx/{bin,oci/*} to %s; moving %s/{bin,oci/*} to /opt/pwx/", instScratchDir, instK8sDir)
-	for _, p := range ociParts {
-		// mv <orig> to <scratch> ...
-		org, neo, scr := path.Join("/opt/pwx", p), path.Join(instK8sDir, p), path.Join(instScratchDir, p)
-		if isExist(org) {
-			if err = moveFileOrDir(org, scr); err != nil {
-				return err
-			}
-			logrus.Infof("> mv %s %s -OK.", org, scr)
+	// retain the old unit-file for the rollback
+	pxUnitFile := fmt.Sprintf(baseServiceFileFmt, baseServiceName)
+	if isExist(pxUnitFile) {
+		if err = copyFile(pxUnitFile, path.Join(instScratchDir, path.Base(pxUnitFile))); err != nil {
+			logrus.WithError(err).Warn("Could not back up ", pxUnitFile)
 		}
+	}
 
-		// mv <new> to <orig> ...
-		if err = moveFileOrDir(neo, org); err != nil {
-			return err
-		}
-		logrus.Infof("> mv %s %s -OK.", neo, org)
+	logrus.Infof("Moving old /opt/pwx/{bin,oci/*} to %s; moving %s/{bin,oci/*} to /opt/pwx/", instScratchDir, srcDir)
+	if err = journal.Apply(moveFileOrDir); err != nil {
+		return err
 	}
 	// re-running the install
 	logrus.Info("OCI bits moved - reinstalling the PX-RunC")
@@ -420,229 +730,786 @@ func switchOciInstall() error {
 	return nil
 }
 
-func finalizePxOciInstall(status installStatus) error {
-	initialInstall := !isExist(fmt.Sprintf(baseServiceFileFmt, baseServiceName))
-
-	if optPreSync {
-		logrus.Info("Running sync() before PX-OCI install/upgrade")
-		syscall.Sync()
+// recoverOciSwitch detects the OCI switchover interrupted by a crash, and either completes it (if all the moves
+// were done) or rolls it back.
+func recoverOciSwitch() error {
+	journal, err := utils.LoadSwitchJournal(switchJournalFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	if status.needInstall {
-		if status.needCordon {
-			err := utils.DrainPxVolumeConsumerPods(meNode, optDrainAllPods)
-			if err != nil {
-				logrus.WithError(err).Error("Error draining PX-dependent pods")
-			} else {
-				logrus.Info("PX-dependent pods successfully drained.")
-				defer func() {
-					if err = utils.UncordonNode(meNode); err != nil {
-						logrus.WithError(err).Error("Error Uncordoning node")
-					} else {
-						logrus.Info("Node successfully uncordoned")
-					}
-				}()
-			}
+	if journal.Complete() {
+		logrus.Warnf("Detected interrupted OCI switchover from %s (all moves done) - completing", journal.Source)
+		if isDryRun("complete the interrupted OCI switchover from %s", journal.Source) {
+			return nil
 		}
-		if err := switchOciInstall(); err != nil {
-			return err
+		if err = ociService.RunExternal(nil, "/opt/pwx/bin/px-runc", "install"); err != nil {
+			return fmt.Errorf("Could not run `px-runc install`: %s", err)
+		}
+		recordSwitchedInstall(journal)
+		recordEvent(v1.EventTypeWarning, utils.EventSwitchRecovered,
+			"Completed OCI switchover from %s interrupted by crash", journal.Source)
+	} else {
+		logrus.Warnf("Detected interrupted OCI switchover from %s (%d of %d moves done) - rolling back",
+			journal.Source, journal.Done, len(journal.Moves))
+		if isDryRun("roll back the interrupted OCI switchover from %s", journal.Source) {
+			return nil
 		}
+		if err = journal.Rollback(moveFileOrDir); err != nil {
+			return fmt.Errorf("Could not roll back interrupted OCI switchover: %s", err)
+		}
+		recordEvent(v1.EventTypeWarning, utils.EventSwitchRecovered,
+			"Rolled back OCI switchover from %s interrupted by crash", journal.Source)
 	}
+	return journal.Remove()
+}
 
-	logrus.Warn("Reloading + Restarting portworx service")
+// recordSwitchedInstall records the image switched in by the completed switchover in the install record, and
+// retains the replaced OCI install (as done by the uninterrupted install or rollback).
+func recordSwitchedInstall(journal *utils.SwitchJournal) {
+	record := loadInstallRecord()
+	if journal.ImageID == "" {
+		logrus.Warn("Switchover journal does not record the image - install record not updated")
+		return
+	} else if journal.ImageID == record.ImageID {
+		return
+	}
 
-	if err := ociService.Reload(); err != nil {
-		logrus.WithError(err).Warn("Error reloading service (cont)")
+	replaced := *record
+	retainPreviousOciInstall(&replaced)
+	record.ImageName, record.ImageID, record.InstalledAt = journal.ImageName, journal.ImageID, time.Now().UTC()
+	if strings.HasPrefix(journal.Source, instRetainDir) {
+		// interrupted rollback to the retained install
+		record.RolledBackImageID = replaced.ImageID
+	} else {
+		record.RolledBackImageID = ""
+	}
+	if record.InProgress == "" {
+		// PX was stopped for the switchover -- make sure the next install restarts it
+		record.InProgress = "finalize"
 	}
+	persistInstallRecord(record)
+	utils.SetImageIDs(record.ImageID, "")
+}
 
-	if initialInstall {
-		logrus.Warn("Initial install detected - enabling the Portworx service")
-		if err := ociService.Enable(); err != nil {
-			logrus.WithError(err).Warn("Error enabling service (cont)")
+// purgePreviousOciInstall asynchronously removes the previous OCI install, retained at {instScratchDir}
+func purgePreviousOciInstall() {
+	go func() {
+		logrus.Info("ASYNC: Launched deletion of ", instScratchDir)
+		if err := os.RemoveAll(instScratchDir); err != nil {
+			logrus.WithError(err).Warn("Could not remove ", instScratchDir)
 		}
+		logrus.Info("ASYNC: Deletion completed.")
+	}()
+}
+
+// retainPreviousOciInstall moves the previous OCI install at {instScratchDir} into the versioned directory at
+// {instRetainDir}, and prunes the older retained installs.
+func retainPreviousOciInstall(prev *utils.InstallState) {
+	if prev.ImageID == "" || optRetain <= 0 {
+		purgePreviousOciInstall()
+		return
 	}
 
-	// Additional services we'd need to enable: portworx-reboot
-	addtlSvcName := "portworx-reboot"
-	if isExist(fmt.Sprintf(baseServiceFileFmt, addtlSvcName)) {
-		svc := utils.NewOciServiceControl(hostProcMount, addtlSvcName)
-		if err := svc.Enable(); err != nil {
-			logrus.WithError(err).Error("Could not enable ", addtlSvcName)
-		}
-	} else {
-		logrus.Debugf("%s.service does not exist - skipping enablement", addtlSvcName)
+	dest := utils.RetainedInstallDir(instRetainDir, prev.ImageID)
+	logrus.Infof("Retaining previous OCI install %s at %s", utils.ShortID(prev.ImageID), dest)
+	if err := os.MkdirAll(instRetainDir, 0700); err != nil {
+		logrus.WithError(err).Warn("Could not create ", instRetainDir)
+		purgePreviousOciInstall()
+		return
+	}
+	os.RemoveAll(dest)
+	if err := moveFileOrDir(instScratchDir, dest); err != nil {
+		logrus.WithError(err).Warnf("Could not move %s to %s", instScratchDir, dest)
+		purgePreviousOciInstall()
+		return
+	}
+	st := *prev
+	st.InProgress, st.Cordoned = "", false
+	if err := st.Save(path.Join(dest, utils.RetainedRecordFile)); err != nil {
+		logrus.WithError(err).Warn("Could not save install record for ", dest)
 	}
 
-	return ociService.Restart()
+	go func() {
+		if err := utils.PruneRetainedInstalls(instRetainDir, optRetain); err != nil {
+			logrus.WithError(err).Warn("Could not prune retained installs")
+		}
+	}()
 }
 
-func doInstall() error {
-	pxImage := os.Getenv(pxImageKey)
-	if pxImage == "" {
-		pxImage = pxImagePrefix + ":" + PXTAG
-	}
+// rollbackToRetainedInstall switches the OCI install to the retained install of a given image ID (or, the newest
+// retained install if image ID is empty), and restarts the service.
+func rollbackToRetainedInstall(imageID string) error {
+	installLock.Lock()
+	defer installLock.Unlock()
 
-	id, err := utils.GetMyContainerID()
+	ri, err := utils.FindRetainedInstall(instRetainDir, imageID)
 	if err != nil {
-		return fmt.Errorf("Could not determine my container ID: %s", err)
+		return err
+	}
+	record := loadInstallRecord()
+	if record.ImageID != "" && record.ImageID == ri.State.ImageID {
+		return fmt.Errorf("Image %s is already installed", utils.ShortID(record.ImageID))
 	}
 
-	di, err := utils.NewDockerInstaller(os.Getenv("REGISTRY_USER"), os.Getenv("REGISTRY_PASS"))
+	release, err := acquireUpgradeSlot()
 	if err != nil {
-		logrus.WithError(err).Error("Could not talk to Docker")
-		usage("Could not talk to Docker" +
-			" - please restart using '-v /var/run/docker.sock:/var/run/docker.sock' option")
+		return err
 	}
+	defer release()
 
-	opts, err := di.ExtractConfig(id)
-	if err != nil {
-		return fmt.Errorf("Could not extract my container's configuration: %s", err)
+	logrus.Warnf("Rolling back OCI install from %s to %s (%s)", utils.ShortID(record.ImageID),
+		utils.ShortID(ri.State.ImageID), ri.State.ImageName)
+	if err = switchOciInstall(ri.Dir, ri.State); err != nil {
+		err = fmt.Errorf("Could not switch to retained install at %s: %s", ri.Dir, err)
+		recordEvent(v1.EventTypeWarning, utils.EventRollbackFailed, "%s", err)
+		return err
 	}
-	if _, has := os.LookupEnv(pxImageKey); !has { // add PX_IMAGE env if missing
-		opts.Env = append(opts.Env, pxImageKey+"="+pxImage)
+	if err = ociService.Reload(); err != nil {
+		logrus.WithError(err).Warn("Error reloading service (cont)")
 	}
-	// Filter out undesired ENV entries
-	envListFilt := make([]string, 0, len(opts.Env))
-	for _, v := range opts.Env {
-		if strings.HasPrefix(v, "PATH=") {
-			logrus.Debugf("Removing %q entry from ENV", v)
-			continue
-		}
-		envListFilt = append(envListFilt, v)
+	if err = restartPxService(); err != nil {
+		recordEvent(v1.EventTypeWarning, utils.EventServiceRestartFailed, "Could not restart %s service: %s",
+			baseServiceName, err)
+		return err
 	}
-	opts.Env = envListFilt
 
-	// TODO: Sanity checks for options
-	logrus.Debugf("OPTIONS:: %#v", opts)
-	instSt, err := installPxFromOciImage(di, pxImage, opts)
-	if err != nil {
-		return fmt.Errorf("Could not install Portworx service: %s", err)
+	// retain the install we just replaced, and record the rollback
+	replaced := *record
+	retainPreviousOciInstall(&replaced)
+	now := time.Now().UTC()
+	record.ImageName, record.ImageID, record.InstalledAt, record.RestartedAt =
+		ri.State.ImageName, ri.State.ImageID, now, now
+	record.RolledBackImageID = replaced.ImageID
+	pxUnitFile := fmt.Sprintf(baseServiceFileFmt, baseServiceName)
+	if record.UnitFileChecksum, err = utils.FileChecksum(pxUnitFile); err != nil {
+		logrus.WithError(err).Warn("Could not checksum ", pxUnitFile)
 	}
+	saveInstallRecord(record, nil)
+	utils.SetImageIDs(record.ImageID, "")
 
-	if instSt.needRestart || instSt.needInstall || instSt.needCordon {
-		if err = finalizePxOciInstall(instSt); err != nil {
-			return fmt.Errorf("Could not finalize OCI install: %s", err)
-		}
-	} else {
-		logrus.Info("Portworx service restart not required.")
-	}
-	ociRestServer.SetStateInstallFinished()
+	msg := fmt.Sprintf("PX rolled back from image %s to %s (%s)", utils.ShortID(replaced.ImageID),
+		utils.ShortID(ri.State.ImageID), ri.State.ImageName)
+	logrus.Warn(msg)
+	recordEvent(v1.EventTypeNormal, utils.EventRollbackCompleted, "%s", msg)
 	return nil
 }
 
-func doUninstall() error {
-	logrus.Info("Stopping Portworx service")
+// rollbackOciInstall restores the previous OCI install and unit-file retained at {instScratchDir}, and restarts
+// the service.
+func rollbackOciInstall() error {
+	logrus.Warnf("ROLLBACK: Restoring previous OCI install from %s/{bin,oci/*} to /opt/pwx/", instScratchDir)
+
 	if err := ociService.Stop(); err != nil {
-		return err
+		logrus.WithError(err).Warn("Error stopping service (cont)")
 	}
 
-	logrus.Info("Disabling Portworx service")
-	if err := ociService.Disable(); err != nil {
+	for _, p := range ociParts {
+		org, scr := path.Join("/opt/pwx", p), path.Join(instScratchDir, p)
+		if !isExist(scr) {
+			continue
+		}
+		if err := os.RemoveAll(org); err != nil {
+			logrus.WithError(err).Warn("Could not remove ", org)
+		}
+		if err := moveFileOrDir(scr, org); err != nil {
+			return fmt.Errorf("Could not restore %s: %s", org, err)
+		}
+		logrus.Warnf("ROLLBACK: Moved %s to %s", scr, org)
+	}
+
+	pxUnitFile := fmt.Sprintf(baseServiceFileFmt, baseServiceName)
+	if bkp := path.Join(instScratchDir, path.Base(pxUnitFile)); isExist(bkp) {
+		if err := moveFileOrDir(bkp, pxUnitFile); err != nil {
+			return fmt.Errorf("Could not restore %s: %s", pxUnitFile, err)
+		}
+		logrus.Warnf("ROLLBACK: Moved %s to %s", bkp, pxUnitFile)
+	}
+
+	if err := ociService.Reload(); err != nil {
+		logrus.WithError(err).Warn("Error reloading service (cont)")
+	}
+	if err := restartPxService(); err != nil {
 		return err
 	}
+	logrus.Warn("ROLLBACK: Rollback completed.")
+	return nil
+}
 
-	logrus.Info("Removing Portworx service bind-mount (if any) and uninstall")
-	err := ociService.Remove()
+// rollbackError reports that the OCI install was rolled back to the previous version
+type rollbackError struct {
+	cause error
+}
 
-	// Uninstall additional services (portworx-reboot)
+func (e *rollbackError) Error() string {
+	return fmt.Sprintf("Rolled back to previous OCI install: %s", e.cause)
+}
+
+// verifyOciUpgrade waits for PX to become healthy after the upgrade, and rolls back to the previous OCI install
+// if it does not.  Otherwise, the previous OCI install is retained for the on-demand rollback.
+func verifyOciUpgrade(prev *utils.InstallState) error {
+	if !isExist(instScratchDir, "bin") {
+		logrus.Info("No previous OCI install retained (initial install?) - skipping health verification")
+		return nil
+	} else if optHealthTimeout <= 0 {
+		retainPreviousOciInstall(prev)
+		return nil
+	}
+
+	logrus.Infof("Waiting up to %s for PX to become healthy", optHealthTimeout)
+	err := ociRestServer.WaitPxHealthy(lifecycleCtx, optHealthTimeout)
 	if err == nil {
-		addtlSvcName := "portworx-reboot"
-		addtlUnitFile := fmt.Sprintf(baseServiceFileFmt, addtlSvcName)
-		if isExist(addtlUnitFile) {
-			svc := utils.NewOciServiceControl(hostProcMount, addtlSvcName)
-			if err := svc.Stop(); err != nil {
-				logrus.WithError(err).Error("Could not stop ", addtlSvcName)
-			}
-			if err := svc.Disable(); err != nil {
-				logrus.WithError(err).Error("Could not disable ", addtlSvcName)
-			}
-			if err := svc.RunExternal(nil, "/bin/rm", "-f", addtlUnitFile); err != nil {
-				logrus.WithError(err).Error("Could not remove ", addtlUnitFile)
-			}
-		} else {
-			logrus.Debugf("%s.service does not exist - skipping removal", addtlSvcName)
-		}
+		logrus.Info("PX healthy after upgrade.")
+		retainPreviousOciInstall(prev)
+		return nil
+	} else if lifecycleCtx.Err() != nil {
+		logrus.Warn("Shutdown requested - skipping the PX health verification")
+		retainPreviousOciInstall(prev)
+		return nil
 	}
 
-	// returning error from OCI-service removal
+	logrus.WithError(err).Error("PX did not become healthy after upgrade - rolling back")
+	if err2 := rollbackOciInstall(); err2 != nil {
+		msg := fmt.Sprintf("Rollback of failed PX upgrade failed: %s (upgrade error: %s)", err2, err)
+		recordEvent(v1.EventTypeWarning, utils.EventRollbackFailed, "%s", msg)
+		return fmt.Errorf("%s", msg)
+	}
+
+	msg := fmt.Sprintf("PX upgrade rolled back to previous version: %s", err)
+	ociRestServer.SetStateRolledBack(msg)
+	recordEvent(v1.EventTypeWarning, utils.EventUpgradeRolledBack, "%s", msg)
+	return &rollbackError{err}
+}
+
+// restartPxService restarts the PX-OCI service, and records the restart metrics
+func restartPxService() error {
+	start := time.Now()
+	err := ociService.Restart()
+	utils.ObserveOperation(utils.OpRestart, start, err)
 	return err
 }
 
-// getKubernetesRootDir scans the external kubelet service for "--root-dir=XX" override, or returns a default kubelet dir
-func getKubernetesRootDir() (string, error) {
-	logrus.Info("Locating kubelet's local state directory")
-	var out cachingOutput
-	args := strings.Fields(`/bin/ps --no-headers -o cmd -C kubelet`)
-	if err := ociService.RunExternal(&out, args[0], args[1:]...); err != nil {
-		err = fmt.Errorf("Could not find kubelet service: %s", err)
-		return "", err
+// recordEvent records the Kubernetes event against this node and px-oci-mon pod (skipped in dry-run mode)
+func recordEvent(eventType, reason, format string, args ...interface{}) {
+	if optDryRun {
+		return
 	}
-	m := xtractKubeletRegex.FindAllStringSubmatch(out.String(), -1)
-	if len(m) > 0 && len(m[0]) > 1 {
-		return m[0][1], nil
+	utils.RecordEvent(meNode, eventType, reason, format, args...)
+	if eventType == v1.EventTypeWarning {
+		ociRestServer.RecordError(fmt.Errorf("%s: "+format, append([]interface{}{reason}, args...)...))
 	}
-	// return default value
-	return "/var/lib/kubelet", nil
 }
 
-// used for unit-tests
-var getKubernetesRootDirFn = getKubernetesRootDir
+// isDryRun prints the action, and returns TRUE if the action should be skipped due to the dry-run mode.
+func isDryRun(format string, args ...interface{}) bool {
+	if optDryRun {
+		fmt.Printf("DRY-RUN: would "+format+"\n", args...)
+	}
+	return optDryRun
+}
+
+// uncordonNode uncordons the node cordoned by the OCI-Monitor, and updates the install record
+func uncordonNode(record *utils.InstallState) {
+	if err := utils.UncordonNode(meNode); err != nil {
+		logrus.WithError(err).Error("Error Uncordoning node")
+		recordEvent(v1.EventTypeWarning, utils.EventUncordonFailed, "Error uncordoning node: %s", err)
+		return
+	}
+	logrus.Info("Node successfully uncordoned")
+	recordEvent(v1.EventTypeNormal, utils.EventUncordoned, "Node successfully uncordoned")
+	record.Cordoned = false
+	persistInstallRecord(record)
+}
+
+func finalizePxOciInstall(rt utils.InstallerRuntime, plan *utils.InstallPlan, record, desired *utils.InstallState) error {
+	initialInstall := !isExist(fmt.Sprintf(baseServiceFileFmt, baseServiceName))
+	drainPolicy := loadDrainPolicy()
+
+	if !initialInstall {
+		// note: initial install does not take PX down, so no need to coordinate w/ other nodes
+		release, err := acquireUpgradeSlot()
+		if err != nil {
+			return err
+		}
+		defer release()
+		postHooks, err := runPreRestartHooks(rt, drainPolicy)
+		defer postHooks()
+		if err != nil {
+			return err
+		}
+	}
+
+	if optPreSync && !isDryRun("sync() the filesystems") {
+		logrus.Info("Running sync() before PX-OCI install/upgrade")
+		syscall.Sync()
+	}
+
+	if plan.NeedInstall {
+		if optDryRun && !plan.NeedCordon {
+			isDryRun("drain PX-dependent pods and cordon node %s (only if px-oci-installer requires reboot)",
+				meNode.GetName())
+		} else if plan.NeedCordon && !isDryRun("drain PX-dependent pods and cordon node %s", meNode.GetName()) {
+			recordEvent(v1.EventTypeNormal, utils.EventDrainStarted,
+				"Draining PX-dependent pods and cordoning node before PX upgrade")
+			start := time.Now()
+			rep, err := utils.DrainPxVolumeConsumerPods(lifecycleCtx, meNode, optDrainAllPods, drainPolicy)
+			utils.ObserveOperation(utils.OpDrain, start, err)
+			if rep != nil {
+				ociRestServer.SetDrainReport(rep)
+			}
+			if _, ok := err.(*utils.DrainBlockedError); ok {
+				logrus.WithError(err).Error("Aborting PX upgrade")
+				recordEvent(v1.EventTypeWarning, utils.EventDrainBlocked, "Aborting PX upgrade: %s", err)
+				return err
+			} else if err != nil {
+				logrus.WithError(err).Error("Error draining PX-dependent pods")
+				recordEvent(v1.EventTypeWarning, utils.EventDrainFailed, "Error draining PX-dependent pods: %s", err)
+			} else {
+				logrus.Info("PX-dependent pods successfully drained.")
+				recordEvent(v1.EventTypeNormal, utils.EventDrainCompleted, "PX-dependent pods successfully drained")
+				record.Cordoned = true
+				persistInstallRecord(record)
+				defer uncordonNode(record)
+			}
+		}
+		if err := checkShutdown("OCI switchover"); err != nil {
+			return err
+		} else if !isDryRun("switch OCI install from %s/ to /opt/pwx/", instK8sDir) {
+			if err := switchOciInstall(instK8sDir, desired); err != nil {
+				return err
+			}
+			recordEvent(v1.EventTypeNormal, utils.EventOciSwitched, "Switched PX-OCI install to new image")
+		}
+	}
+
+	logrus.Warn("Reloading + Restarting portworx service")
+
+	if !isDryRun("reload systemd services") {
+		if err := ociService.Reload(); err != nil {
+			logrus.WithError(err).Warn("Error reloading service (cont)")
+		}
+	}
+
+	if initialInstall && !isDryRun("enable %s service (initial install)", baseServiceName) {
+		logrus.Warn("Initial install detected - enabling the Portworx service")
+		if err := ociService.Enable(); err != nil {
+			logrus.WithError(err).Warn("Error enabling service (cont)")
+		}
+	}
+
+	// Additional services we'd need to enable: portworx-reboot
+	addtlSvcName := "portworx-reboot"
+	if isExist(fmt.Sprintf(baseServiceFileFmt, addtlSvcName)) {
+		if !isDryRun("enable %s service", addtlSvcName) {
+			svc := utils.NewOciServiceControl(hostProcMount, addtlSvcName)
+			if err := svc.Enable(); err != nil {
+				logrus.WithError(err).Error("Could not enable ", addtlSvcName)
+			}
+		}
+	} else {
+		logrus.Debugf("%s.service does not exist - skipping enablement", addtlSvcName)
+	}
+
+	if isDryRun("restart %s service", baseServiceName) {
+		if plan.NeedInstall && optHealthTimeout > 0 {
+			isDryRun("wait up to %s for PX to become healthy (roll back to previous install if not)",
+				optHealthTimeout)
+		}
+		return nil
+	}
+	if err := restartPxService(); err != nil {
+		recordEvent(v1.EventTypeWarning, utils.EventServiceRestartFailed, "Could not restart %s service: %s",
+			baseServiceName, err)
+		return err
+	}
+	recordEvent(v1.EventTypeNormal, utils.EventServiceRestarted, "Restarted %s service", baseServiceName)
+	if plan.NeedInstall {
+		return verifyOciUpgrade(record)
+	}
+	return nil
+}
+
+// verifyPxImage verifies the pulled (or archived) PX image against the pinned digest, trusted digests and signature.
+// NOTE: the failed verification blocks the install.
+func verifyPxImage(rt utils.InstallerRuntime, imageName string, archived *utils.ArchivedImage) error {
+	var digests []string
+	var err error
+	if archived != nil && archived.Digest != "" {
+		digests = []string{strings.SplitN(imageName, "@", 2)[0] + "@" + archived.Digest}
+	} else if archived == nil {
+		if digests, err = rt.GetRepoDigests(imageName); err != nil {
+			logrus.WithError(err).Warn("Could not retrieve repository digests of ", imageName)
+		}
+	}
+	res, err := imageVerifier.Verify(imageName, digests)
+	ociRestServer.SetImageVerification(res)
+	if err != nil {
+		logrus.WithError(err).Error("PX image verification failed - blocking the install")
+		recordEvent(v1.EventTypeWarning, utils.EventImageUntrusted, "Image %s failed verification: %s", imageName, err)
+		return fmt.Errorf("Image verification failed: %s", err)
+	}
+	logrus.Infof("PX image %s verification: %s", imageName, res)
+	return nil
+}
 
-// isRestartRequired returns FALSE if no updates detected, or if only POD-mounts -specific updates are present.
-// It returns TRUE if spec is new, if input not parseable, or non POD-mounts -specific updates present.
-func isRestartRequired(in string) bool {
-	if strings.Index(in, "SPEC UNCHANGED ") > 0 {
-		return false
-	} else if strings.Index(in, "SPEC CREATED ") > 0 {
-		return true
+// pxImageName returns the PX image name from PX_IMAGE env. variable, or PXTAG (tag, or digest)
+func pxImageName() string {
+	if img := os.Getenv(pxImageKey); img != "" {
+		return img
+	} else if utils.IsValidDigest(PXTAG) {
+		return pxImagePrefix + "@" + PXTAG
 	}
+	return pxImagePrefix + ":" + PXTAG
+}
 
-	// find proper location for "/var/lib/kubelet/pods/"
-	kubeletPodsDir, err := getKubernetesRootDirFn()
+// importPxImage imports the PX image from the image archive (see --image-archive), unless already imported.
+// The imported image must match the image ID recorded in the archive.
+func importPxImage(rt utils.InstallerRuntime, imageName string, cb utils.DownloadNotifyCbFunc) (
+	*utils.ArchivedImage, error) {
+	images, err := utils.ReadImageArchive(optImageArchive)
 	if err != nil {
-		logrus.WithError(err).Error("Error scanning kubelet process")
-		return true
-	}
-	kubeletPodsDir += "/pods/"
-
-	search4 := " Updated mounts: add{"
-	addStartIdx := strings.Index(in, search4)
-	if addStartIdx > 0 {
-		addStartIdx += len(search4)
-		if endIdx := strings.Index(in[addStartIdx:], "}"); endIdx > 0 {
-			endIdx += addStartIdx
-			for _, p := range strings.Fields(in[addStartIdx:endIdx]) {
-				logrus.Debugf("add/%s/", p)
-				if !strings.HasPrefix(p, kubeletPodsDir) {
-					return true
-				}
+		return nil, err
+	}
+	img := utils.FindArchivedImage(images, imageName)
+	if img == nil {
+		names := make([]string, 0, len(images))
+		for _, i := range images {
+			names = append(names, i.Name+"@"+utils.ShortID(i.ImageID))
+		}
+		return nil, fmt.Errorf("Image %s not found in archive %s (found %s)", imageName, optImageArchive,
+			strings.Join(names, ", "))
+	}
+
+	if id, _ := rt.GetImageID(imageName); id == img.ImageID {
+		logrus.Infof("Image %s already imported from %s", imageName, optImageArchive)
+		return img, nil
+	} else if cb != nil {
+		if err = cb(); err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("Importing image %s from %s", imageName, optImageArchive)
+	loaded, err := rt.ImportImage(optImageArchive)
+	if err != nil {
+		return nil, fmt.Errorf("Could not import %s: %s", optImageArchive, err)
+	}
+	id, err := rt.GetImageID(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("Image %s not found after importing %s (imported %s): %s", imageName,
+			optImageArchive, strings.Join(loaded, ", "), err)
+	} else if id != img.ImageID {
+		return nil, fmt.Errorf("Imported image %s has ID %s, expected %s from %s", imageName, utils.ShortID(id),
+			utils.ShortID(img.ImageID), optImageArchive)
+	}
+	recordEvent(v1.EventTypeNormal, utils.EventImageImported, "Imported image %s (%s) from %s", imageName,
+		utils.ShortID(id), optImageArchive)
+	return img, nil
+}
+
+// exportImage pulls the PX image, and exports it into the image archive for the air-gapped nodes.
+// Usage: px-oci-mon export-image [--runtime <runtime>] [--registry-config <file>] <archive> [<image>]
+func exportImage(args []string) error {
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--runtime", "--registry-config":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Argument %s requires extra option", args[i])
+			} else if args[i] == "--runtime" {
+				optRuntime = args[i+1]
+			} else {
+				optRegistryCfg = args[i+1]
 			}
-		} else {
-			logrus.Error("INTERNAL ERROR - found mounts add{ with no matching }")
-			return true
+			i++
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		return fmt.Errorf("Usage: %s export-image [--runtime <runtime>] [--registry-config <file>] <archive> [<image>]",
+			os.Args[0])
+	}
+	archive, imageName := positional[0], pxImageName()
+	if len(positional) > 1 {
+		imageName = positional[1]
+	}
+
+	creds := utils.NewRegistryCredentials(optRegistryCfg, os.Getenv("REGISTRY_USER"), os.Getenv("REGISTRY_PASS"))
+	rt, err := utils.NewInstallerRuntime(lifecycleCtx, optRuntime, creds, optPull)
+	if err != nil {
+		return fmt.Errorf("Could not talk to container runtime: %s", err)
+	} else if err = rt.PullImageCb(imageName, nil); err != nil {
+		return fmt.Errorf("Could not pull %s: %s", imageName, err)
+	}
+
+	tmp := archive + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Could not create %s: %s", tmp, err)
+	}
+	defer os.Remove(tmp)
+	logrus.Infof("Exporting image %s into %s", imageName, archive)
+	err = rt.ExportImage(imageName, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Could not export %s: %s", imageName, err)
+	}
+
+	images, err := utils.ReadImageArchive(tmp)
+	if err != nil {
+		return fmt.Errorf("Exported archive is invalid: %s", err)
+	} else if err = os.Rename(tmp, archive); err != nil {
+		return fmt.Errorf("Could not rename %s: %s", tmp, err)
+	}
+	for _, img := range images {
+		fmt.Printf("Exported %s (digest %s, image ID %s) to %s\n", img.Name, img.Digest, img.ImageID, archive)
+	}
+	return nil
+}
+
+func doInstall(force bool) error {
+	installLock.Lock()
+	defer installLock.Unlock()
+
+	pxImage := pxImageName()
+
+	rt, err := utils.NewInstallerRuntime(lifecycleCtx, optRuntime, registryCreds, optPull)
+	if err != nil {
+		logrus.WithError(err).Error("Could not talk to container runtime")
+		err = fmt.Errorf("Could not talk to container runtime: %s - please restart using "+
+			"'-v /var/run/docker.sock:/var/run/docker.sock' option (or "+
+			"'-v /run/containerd/containerd.sock:/run/containerd/containerd.sock' for containerd)", err)
+		recordEvent(v1.EventTypeWarning, utils.EventInstallFailed, "%s", err)
+		return err
+	}
+
+	opts, err := rt.InspectSelf()
+	if err != nil {
+		return fmt.Errorf("Could not extract my container's configuration: %s", err)
+	}
+	if _, has := os.LookupEnv(pxImageKey); !has { // add PX_IMAGE env if missing
+		opts.Env = append(opts.Env, pxImageKey+"="+pxImage)
+	}
+	// Filter out undesired ENV entries
+	envListFilt := make([]string, 0, len(opts.Env))
+	for _, v := range opts.Env {
+		if strings.HasPrefix(v, "PATH=") {
+			logrus.Debugf("Removing %q entry from ENV", v)
+			continue
+		}
+		envListFilt = append(envListFilt, v)
+	}
+	opts.Env = envListFilt
+
+	// TODO: Sanity checks for options
+	logrus.Debugf("OPTIONS:: %#v", opts)
+	record := loadInstallRecord()
+	windows, deferrable := outsideMaintenanceWindow(record, force)
+	plan, desired, err := installPxFromOciImage(rt, pxImage, opts, record, deferrable)
+	if err != nil {
+		if !optDryRun {
+			saveInstallRecord(record, err)
 		}
+		recordEvent(v1.EventTypeWarning, utils.EventInstallFailed, "Could not install Portworx service: %s", err)
+		return fmt.Errorf("Could not install Portworx service: %s", err)
+	}
+	logPlan(plan)
+	ociRestServer.SetInstallPlan(plan)
+	if plan.IsNoop() {
+		recordEvent(v1.EventTypeNormal, utils.EventInstallUpToDate, "PX-OCI install up to date (image %s)",
+			utils.ShortID(desired.ImageID))
 	} else {
-		// reset -- we never found added mounts
-		addStartIdx = 0
-	}
-
-	search4 = " rm{"
-	if rmStartIdx := strings.Index(in[addStartIdx:], search4); rmStartIdx > 0 {
-		rmStartIdx += addStartIdx + len(search4)
-		if endIdx := strings.Index(in[rmStartIdx:], "}"); endIdx > 0 {
-			endIdx += rmStartIdx
-			for _, p := range strings.Fields(in[rmStartIdx:endIdx]) {
-				logrus.Debugf("rm/%s/", p)
-				if !strings.HasPrefix(p, kubeletPodsDir) {
-					return true
-				}
+		recordEvent(v1.EventTypeNormal, utils.EventInstallPlanned, "PX-OCI install actions required: %s",
+			strings.Join(plan.Reasons, "; "))
+	}
+
+	if optDryRun {
+		fmt.Printf("DRY-RUN: install plan for node %s: %s\n", meNode.GetName(), plan)
+		if plan.IsNoop() {
+			fmt.Println("DRY-RUN: no actions required")
+			return nil
+		} else if deferrable {
+			deferToMaintenanceWindow(plan, desired, windows)
+			return nil
+		}
+		return finalizePxOciInstall(rt, plan, record, desired)
+	}
+
+	if !plan.IsNoop() && deferrable {
+		deferToMaintenanceWindow(plan, desired, windows)
+		ociRestServer.SetStateInstallFinished()
+		return nil
+	}
+
+	if !plan.IsNoop() {
+		if err = checkShutdown("install finalization"); err != nil {
+			saveInstallRecord(record, err)
+			return err
+		}
+		record.InProgress = "finalize"
+		persistInstallRecord(record)
+		if err = finalizePxOciInstall(rt, plan, record, desired); err != nil {
+			if _, ok := err.(*rollbackError); ok {
+				// rolled back to previous install -- keep on running, but do not retry this image
+				logrus.Error(err)
+				record.RolledBackImageID = desired.ImageID
+				saveInstallRecord(record, err)
+				clearPendingAction()
+				return nil
+			}
+			saveInstallRecord(record, err)
+			recordEvent(v1.EventTypeWarning, utils.EventInstallFailed, "Could not finalize OCI install: %s", err)
+			return fmt.Errorf("Could not finalize OCI install: %s", err)
+		}
+		recordEvent(v1.EventTypeNormal, utils.EventInstallCompleted, "PX-OCI install of %s (%s) completed",
+			desired.ImageName, utils.ShortID(desired.ImageID))
+		now := time.Now().UTC()
+		if plan.NeedInstall {
+			record.ImageName, record.ImageID, record.InstalledAt = desired.ImageName, desired.ImageID, now
+			record.RolledBackImageID = ""
+		}
+		if plan.NeedRestart {
+			record.RestartedAt = now
+		}
+	} else {
+		logrus.Info("Portworx service restart not required.")
+	}
+	clearPendingAction()
+
+	// install complete -- record the installed configuration
+	utils.SetImageIDs(record.ImageID, desired.ImageID)
+	record.ConfigHash = desired.ConfigHash
+	pxUnitFile := fmt.Sprintf(baseServiceFileFmt, baseServiceName)
+	if record.UnitFileChecksum, err = utils.FileChecksum(pxUnitFile); err != nil {
+		logrus.WithError(err).Warn("Could not checksum ", pxUnitFile)
+	}
+	if record.RolledBackImageID != "" && record.RolledBackImageID == desired.ImageID {
+		// keep on reporting the failed upgrade
+		record.InProgress = ""
+		persistInstallRecord(record)
+		ociRestServer.SetStateRolledBack(fmt.Sprintf("image %s was rolled back",
+			utils.ShortID(record.RolledBackImageID)))
+		return nil
+	}
+	saveInstallRecord(record, nil)
+	ociRestServer.SetStateInstallFinished()
+	return nil
+}
+
+func doUninstall() error {
+	recordEvent(v1.EventTypeNormal, utils.EventUninstallStarted, "Uninstalling PX-OCI service")
+	err := uninstallPxOci()
+	if err != nil {
+		recordEvent(v1.EventTypeWarning, utils.EventUninstallFailed, "Could not uninstall PX-OCI service: %s", err)
+	} else {
+		recordEvent(v1.EventTypeNormal, utils.EventUninstallCompleted, "PX-OCI service uninstalled")
+	}
+	return err
+}
+
+func uninstallPxOci() error {
+	logrus.Info("Stopping Portworx service")
+	if err := ociService.Stop(); err != nil {
+		return err
+	}
+
+	logrus.Info("Disabling Portworx service")
+	if err := ociService.Disable(); err != nil {
+		return err
+	}
+
+	logrus.Info("Removing Portworx service bind-mount (if any) and uninstall")
+	err := ociService.Remove()
+
+	// Uninstall additional services (portworx-reboot)
+	if err == nil {
+		addtlSvcName := "portworx-reboot"
+		addtlUnitFile := fmt.Sprintf(baseServiceFileFmt, addtlSvcName)
+		if isExist(addtlUnitFile) {
+			svc := utils.NewOciServiceControl(hostProcMount, addtlSvcName)
+			if err := svc.Stop(); err != nil {
+				logrus.WithError(err).Error("Could not stop ", addtlSvcName)
+			}
+			if err := svc.Disable(); err != nil {
+				logrus.WithError(err).Error("Could not disable ", addtlSvcName)
+			}
+			if err := svc.RunExternal(nil, "/bin/rm", "-f", addtlUnitFile); err != nil {
+				logrus.WithError(err).Error("Could not remove ", addtlUnitFile)
 			}
 		} else {
-			logrus.Error("INTERNAL ERROR - found mounts rm{ with no matching }")
-			return true
+			logrus.Debugf("%s.service does not exist - skipping removal", addtlSvcName)
 		}
 	}
-	return false
+
+	// returning error from OCI-service removal
+	return err
+}
+
+// getKubernetesRootDir scans the external kubelet service for "--root-dir=XX" override, or returns a default kubelet dir
+func getKubernetesRootDir() (string, error) {
+	logrus.Info("Locating kubelet's local state directory")
+	var out cachingOutput
+	args := strings.Fields(`/bin/ps --no-headers -o cmd -C kubelet`)
+	if err := ociService.RunExternal(&out, args[0], args[1:]...); err != nil {
+		err = fmt.Errorf("Could not find kubelet service: %s", err)
+		return "", err
+	}
+	m := xtractKubeletRegex.FindAllStringSubmatch(out.String(), -1)
+	if len(m) > 0 && len(m[0]) > 1 {
+		return m[0][1], nil
+	}
+	// return default value
+	return "/var/lib/kubelet", nil
+}
+
+// used for unit-tests
+var getKubernetesRootDirFn = getKubernetesRootDir
+
+// isRestartRequired returns FALSE if no updates detected, or if the restart policy classifies all the updates as
+// ignored or deferred to the next restart.  It also returns the list of the updates deferred to the next restart.
+func isRestartRequired(res *utils.RuncInstallResult, pol *utils.RestartPolicy) (bool, []string) {
+	switch res.SpecStatus {
+	case utils.SpecUnchanged:
+		return false, nil
+	case utils.SpecCreated:
+		logrus.Info("Restart required: OCI spec created")
+		return true, nil
+	}
+
+	restart, deferred := false, []string{}
+	classify := func(kind, op, change, key string) {
+		action, rule := pol.Classify(kind, key)
+		logrus.Infof("Config change %s %s %s: %s (rule %q)", op, kind, change, action, rule)
+		switch action {
+		case utils.RestartActionRestart:
+			restart = true
+		case utils.RestartActionNextRestart:
+			deferred = append(deferred, fmt.Sprintf("%s %s %s", op, kind, change))
+		}
+	}
+	for _, c := range []struct {
+		kind, op string
+		changes  []string
+	}{
+		{utils.ChangeArg, "add", res.Args.Added}, {utils.ChangeArg, "rm", res.Args.Removed},
+		{utils.ChangeEnv, "add", res.Env.Added}, {utils.ChangeEnv, "rm", res.Env.Removed},
+		{utils.ChangeMount, "add", res.Mounts.Added}, {utils.ChangeMount, "rm", res.Mounts.Removed},
+	} {
+		if c.kind == utils.ChangeArg {
+			for _, g := range utils.GroupArgs(c.changes) {
+				classify(c.kind, c.op, strings.Join(g, " "), g[0])
+			}
+			continue
+		}
+		for _, v := range c.changes {
+			classify(c.kind, c.op, v, v)
+		}
+	}
+	return restart, deferred
 }
 
 // watchNodeLabels monitors the label changes on the Node
@@ -651,12 +1518,23 @@ func watchNodeLabels(node *v1.Node) error {
 	logrus.Debugf("WATCH labels: %+v", node.GetLabels())
 
 	isPxDisabled := utils.IsPxDisabled(node)
-	defer func() { lastPxDisabled = isPxDisabled }()
+	defer func() {
+		lastPxDisabled = isPxDisabled
+		disabled := int32(0)
+		if isPxDisabled {
+			disabled = 1
+		}
+		atomic.StoreInt32(&pxDisabled, disabled)
+	}()
 	if !isPxDisabled && lastPxDisabled {
 		logrus.Info("Requested PX-enablement via labels")
-		doInstall()
+		recordEvent(v1.EventTypeNormal, utils.EventEnableRequested, "Requested PX-enablement via labels")
+		if err := doInstall(false); err != nil {
+			logrus.Error(err)
+		}
 	} else if isPxDisabled && !lastPxDisabled {
 		logrus.Info("Requested PX-disablement via labels")
+		recordEvent(v1.EventTypeNormal, utils.EventDisableRequested, "Requested PX-disablement via labels")
 		if utils.IsUninstallRequested(node) {
 			doUninstall()
 			utils.DisablePx(node)
@@ -670,12 +1548,29 @@ func watchNodeLabels(node *v1.Node) error {
 			return nil
 		}
 
-		if err := ociService.HandleRequest(req); err != nil {
+		ociRestServer.SetServiceCommand(req)
+		var err error
+		if req == "rollback" {
+			err = rollbackToRetainedInstall("")
+		} else if req == "upgrade-now" {
+			logrus.Info("Requested install/upgrade now via labels (overriding maintenance windows)")
+			err = doInstall(true)
+		} else {
+			err = ociService.HandleRequest(req)
+		}
+		if err != nil {
 			logrus.Error(err)
+			recordEvent(v1.EventTypeWarning, utils.EventServiceRequestFailed, "Service request %s=%s failed: %s",
+				"px/service", req, err)
 			// note: in case of errors, we will _not_ reset the `lastServiceCmd`, so this request will be repeated
 			// on the next watch (note that watch() triggers every few seconds, on every Node{}-update ).
-		} else if req == "restart" {
-			// successful restart - remove "restart" label (will keep others)
+			return nil
+		}
+
+		recordEvent(v1.EventTypeNormal, utils.EventServiceRequest, "Service request %s=%s completed",
+			"px/service", req)
+		if req == "restart" || req == "rollback" || req == "upgrade-now" {
+			// successful restart/rollback/upgrade - remove the label (will keep others)
 			utils.RemoveServiceLabel(node)
 			lastServiceCmd = ""
 		} else {
@@ -700,6 +1595,17 @@ func setLogfile(fname string) error {
 }
 
 func main() {
+	if PXTAG == "" {
+		PXTAG = defaultPXTAG
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-image" {
+		if err := exportImage(os.Args[2:]); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logrus.Infof("Input arguments: %v", os.Args)
 	args := make([]string, 0, len(os.Args))
 	var scheduler *string
@@ -717,10 +1623,150 @@ func main() {
 			optPreSync = true // local option
 		case "--drain-all":
 			optDrainAllPods = true // local option
+		case "--drain-timeout":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			d, err := time.ParseDuration(os.Args[i])
+			if err != nil || d <= 0 {
+				usage("ERROR: Invalid duration ", os.Args[i], " for --drain-timeout")
+			}
+			optDrainTimeout = d // local option
+		case "--drain-blocked":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			if !utils.IsValidDrainBlockedAction(os.Args[i]) {
+				usage("ERROR: Invalid action ", os.Args[i], " for --drain-blocked (expected abort, wait or force)")
+			}
+			optDrainBlocked = os.Args[i] // local option
+		case "--drain-policy":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optDrainPolicy = os.Args[i] // local option
+		case "--drain-exclude":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optDrainExclude = append(optDrainExclude, strings.Split(os.Args[i], ",")...) // local option
+		case "--trusted-digest":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optTrustDigests = append(optTrustDigests, strings.Split(os.Args[i], ",")...) // local option
+		case "--verify-key":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optVerifyKey = os.Args[i] // local option
+		case "--signatures":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optSignatures = os.Args[i] // local option
+		case "--skip-quorum-check":
+			optSkipQuorum = true // local option
+		case "--dry-run":
+			optDryRun = true // local option
+		case "--image-archive":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optImageArchive = os.Args[i] // local option
+		case "--registry-mirror":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optPull.Mirrors = append(optPull.Mirrors, strings.Split(os.Args[i], ",")...) // local option
+		case "--pull-retries":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			n, err := strconv.Atoi(os.Args[i])
+			if err != nil || n < 0 {
+				usage("ERROR: Invalid number ", os.Args[i], " for --pull-retries")
+			}
+			optPull.Retries = n // local option
+		case "--pull-timeout":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			d, err := time.ParseDuration(os.Args[i])
+			if err != nil || d < 0 {
+				usage("ERROR: Invalid duration ", os.Args[i], " for --pull-timeout")
+			}
+			optPull.InactivityTimeout = d // local option
+		case "--registry-config":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRegistryCfg = os.Args[i] // local option
+		case "--runtime":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRuntime = os.Args[i] // local option
+		case "--health-timeout":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			d, err := time.ParseDuration(os.Args[i])
+			if err != nil {
+				usage("ERROR: Invalid duration ", os.Args[i], " for --health-timeout: ", err)
+			}
+			optHealthTimeout = d // local option
+		case "--retain":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			n, err := strconv.Atoi(os.Args[i])
+			if err != nil || n < 0 {
+				usage("ERROR: Invalid number ", os.Args[i], " for --retain")
+			}
+			optRetain = n // local option
+		case "--restart-policy":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRestartPolicy = os.Args[i] // local option
+		case "--maintenance":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optMaintenance = os.Args[i] // local option
+		case "--max-parallel":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			n, err := strconv.Atoi(os.Args[i])
+			if err != nil || n < 0 {
+				usage("ERROR: Invalid number ", os.Args[i], " for --max-parallel")
+			}
+			optMaxParallel = n // local option
+		case "--upgrade-lock":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			if parts := strings.Split(os.Args[i], "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				usage("ERROR: Invalid ConfigMap ", os.Args[i], " for --upgrade-lock (expected <namespace>/<name>)")
+			}
+			optUpgradeLock = os.Args[i] // local option
+		case "--lock-ttl":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			d, err := time.ParseDuration(os.Args[i])
+			if err != nil || d < time.Minute {
+				usage("ERROR: Invalid duration ", os.Args[i], " for --lock-ttl (minimum 1m)")
+			}
+			optLockTTL = d // local option
 		case "--endpoint":
 			ensureExtraArgFn(i, os.Args[i])
 			i++
 			optRestEndpoint = os.Args[i] // local option
+		case "--tls-cert":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRestSecurity.CertFile = os.Args[i] // local option
+		case "--tls-key":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRestSecurity.KeyFile = os.Args[i] // local option
+		case "--tls-client-ca":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRestSecurity.ClientCAFile = os.Args[i] // local option
+		case "--auth-token-file":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRestSecurity.TokenFile = os.Args[i] // local option
+		case "--auth-tokenreview":
+			optRestSecurity.TokenReview = true // local option
+		case "--auth-users":
+			ensureExtraArgFn(i, os.Args[i])
+			i++
+			optRestSecurity.AllowedUsers = strings.Split(os.Args[i], ",") // local option
 		case "--log":
 			ensureExtraArgFn(i, os.Args[i])
 			i++
@@ -758,10 +1804,6 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	if PXTAG == "" {
-		PXTAG = defaultPXTAG
-	}
-
 	// Validate required OCI mounts are all valid and accounted for
 	if len(ociPrivateMounts) > 0 {
 		dirs, i := make([]string, len(ociPrivateMounts)), 0
@@ -784,31 +1826,437 @@ func main() {
 
 	ociService = utils.NewOciServiceControl(hostProcMount, baseServiceName)
 	ociRestServer = utils.NewRESTServlet(ociService, meNode)
+	ociRestServer.SetRollbackHandler(rollbackToRetainedInstall)
+	ociRestServer.SetDrainPolicyLoader(loadDrainPolicy)
+	if err = ociRestServer.SetSecurity(optRestSecurity); err != nil {
+		usage("ERROR: Invalid REST service security configuration: ", err)
+	}
+	if optRestartPolicy != "" {
+		if _, err = utils.LoadRestartPolicy(optRestartPolicy); err != nil {
+			usage("ERROR: Invalid restart policy: ", err)
+		}
+	}
+	if optDrainPolicy != "" {
+		if _, err = utils.LoadDrainPolicy(optDrainPolicy); err != nil {
+			usage("ERROR: Invalid drain policy: ", err)
+		}
+	}
+
+	registryCreds = utils.NewRegistryCredentials(optRegistryCfg, os.Getenv("REGISTRY_USER"), os.Getenv("REGISTRY_PASS"))
+	if imageVerifier, err = utils.NewImageVerifier(optTrustDigests, optVerifyKey, optSignatures); err != nil {
+		usage("ERROR: Invalid image verification: ", err)
+	}
+
+	// note: must recover from the interrupted switchover before doing anything else
+	if err = recoverOciSwitch(); err != nil {
+		logrus.Error(err)
+		os.Exit(-1)
+	}
+
+	if optDryRun {
+		if utils.IsPxDisabled(meNode) {
+			fmt.Printf("DRY-RUN: PX disabled on node %s - no install actions\n", meNode.GetName())
+		} else if err = doInstall(false); err != nil {
+			logrus.Error(err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
 
 	logrus.Info("Activating REST server")
 	ociRestServer.Start(optRestEndpoint)
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		logrus.Warnf("Received %s - shutting down", sig)
+		lifecycleCancel()
+	}()
+	resumeInterrupted()
+
 	lastOp := "Install"
 	if utils.IsPxDisabled(meNode) {
 		lastPxDisabled = false // force state change
 		err = k8s.Instance().WatchNode(meNode, watchNodeLabels)
 		lastOp = "Uninstall"
 	} else {
-		err = doInstall()
+		err = doInstall(false)
+	}
+	if err != nil && lifecycleCtx.Err() == nil {
+		// note: keep on running, the failure is reported via status and events (see doInstall())
+		logrus.WithError(err).Errorf("%s failed", lastOp)
+		if lastOp == "Install" {
+			go retryInstall()
+		}
+	} else if err != nil {
+		logrus.Warn(err)
+	} else if lastOp == "Uninstall" {
+		// note: doInstall() sets the state on its own (install finished, or rolled back)
+		ociRestServer.SetStateInstallFinished()
+	}
+
+	if lifecycleCtx.Err() == nil {
+		logrus.Info("Activating node-watcher")
+		k8s.Instance().WatchNode(meNode, watchNodeLabels)
+		logrus.Info(lastOp, " done - waiting for shutdown")
+	}
+
+	<-lifecycleCtx.Done()
+	shutdown()
+}
+
+// acquireUpgradeLock waits for the cluster-wide upgrade lock, which limits the number of nodes concurrently in the
+// drain/switchover/restart phase.  Returns the function releasing the lock.
+func acquireUpgradeLock() (func(), error) {
+	if optMaxParallel <= 0 || isDryRun("acquire upgrade lock (max %d nodes in parallel)", optMaxParallel) {
+		return func() {}, nil
 	}
+
+	ns, name := os.Getenv("POD_NAMESPACE"), upgradeLockName
+	if ns == "" {
+		ns = "kube-system"
+	}
+	if optUpgradeLock != "" {
+		parts := strings.Split(optUpgradeLock, "/")
+		ns, name = parts[0], parts[1]
+	}
+	lock, err := utils.NewUpgradeLock(ns, name, meNode.GetName(), optMaxParallel, optLockTTL)
 	if err != nil {
-		// note: CRITICAL FAILURE if install | uninstall failed
-		logrus.Error(err)
-		os.Exit(-1)
+		return nil, fmt.Errorf("Could not create upgrade lock: %s", err)
 	}
-	ociRestServer.SetStateInstallFinished()
 
-	logrus.Info("Activating node-watcher")
-	k8s.Instance().WatchNode(meNode, watchNodeLabels)
+	logrus.Infof("Acquiring upgrade lock %s/%s (max %d nodes in parallel)", ns, name, optMaxParallel)
+	err = lock.Acquire(lifecycleCtx, upgradeLockPoll, func(holders []string) {
+		msg := "upgrade lock, held by " + strings.Join(holders, ", ")
+		logrus.Info("Waiting for ", msg)
+		ociRestServer.SetWaitingFor(msg)
+		recordEvent(v1.EventTypeNormal, utils.EventUpgradeLockWaiting, "Waiting for %s", msg)
+	})
+	ociRestServer.SetWaitingFor("")
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := lock.Release(); err != nil {
+			logrus.WithError(err).Error("Could not release upgrade lock (will expire in ", optLockTTL, ")")
+		}
+	}, nil
+}
+
+// acquireUpgradeSlot waits for the PX cluster quorum, and then for the upgrade lock, before taking PX down.  The
+// quorum is rechecked once the lock is held (other nodes may have gone down meanwhile), and the lock is released
+// while waiting for the quorum again.  Returns the function releasing the lock.
+func acquireUpgradeSlot() (func(), error) {
+	for {
+		if err := waitPxQuorum(); err != nil {
+			return nil, err
+		}
+		release, err := acquireUpgradeLock()
+		if err != nil {
+			return nil, err
+		} else if optSkipQuorum || optDryRun {
+			return release, nil
+		}
+		reason := checkPxQuorum()
+		if reason == "" {
+			return release, nil
+		}
+		logrus.Warnf("Releasing upgrade lock: %s", reason)
+		release()
+	}
+}
+
+// recordHookResults records the hook results in status and events
+func recordHookResults(hook string, results []*utils.HookResult) {
+	if len(results) == 0 {
+		return
+	}
+	ociRestServer.SetHookResults(hook, results)
+	failed := 0
+	for _, r := range results {
+		if r.Failed() {
+			failed++
+			recordEvent(v1.EventTypeWarning, utils.EventHookFailed, "%s hook failed in pod %s/%s (exit code %d): %s",
+				hook, r.Namespace, r.Pod, r.ExitCode, r.Error)
+		}
+	}
+	if failed == 0 {
+		recordEvent(v1.EventTypeNormal, utils.EventHooksCompleted, "%s hooks completed in %d pods", hook,
+			len(results))
+	}
+}
+
+// runPreRestartHooks runs the pre-restart hooks in the PX consumer pods, before PX gets drained/restarted.
+// Returns the function running the post-restart hooks, which waits for PX to become healthy first.
+func runPreRestartHooks(rt utils.InstallerRuntime, pol *utils.DrainPolicy) (func(), error) {
+	noop := func() {}
+	if isDryRun("run %s hooks in PX consumer pods", utils.HookPreRestart) {
+		return noop, nil
+	}
+	pods, err := utils.FindPxConsumers(meNode.GetName())
+	if err != nil {
+		err = fmt.Errorf("Could not find PX consumer pods for %s hooks: %s", utils.HookPreRestart, err)
+		if pol.OnHookFailure == utils.HookFailureAbort {
+			return noop, err
+		}
+		logrus.WithError(err).Warn("Skipping hooks")
+		return noop, nil
+	}
+	hooked := make([]utils.PxConsumer, 0, len(pods))
+	for _, p := range pods {
+		if utils.HasHook(&p.Pod, utils.HookPreRestart) {
+			hooked = append(hooked, p)
+		}
+	}
+	if len(hooked) == 0 {
+		return noop, nil
+	}
+
+	results, err := pol.RunHooks(rt, hooked, utils.HookPreRestart)
+	recordHookResults(utils.HookPreRestart, results)
+	return func() { runPostRestartHooks(rt, pol, hooked) }, err
+}
+
+// runPostRestartHooks runs the post-restart hooks in the pods which ran the pre-restart hooks, and are still running
+// on this node (i.e. were not drained)
+func runPostRestartHooks(rt utils.InstallerRuntime, pol *utils.DrainPolicy, hooked []utils.PxConsumer) {
+	if optHealthTimeout > 0 {
+		if err := ociRestServer.WaitPxHealthy(lifecycleCtx, optHealthTimeout); err != nil {
+			logrus.WithError(err).Warnf("PX not healthy - running %s hooks anyway", utils.HookPostRestart)
+		}
+	}
+	pods, err := utils.FindPxConsumers(meNode.GetName())
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not find PX consumer pods for %s hooks", utils.HookPostRestart)
+		recordEvent(v1.EventTypeWarning, utils.EventHookFailed, "Could not run %s hooks: %s", utils.HookPostRestart,
+			err)
+		return
+	}
+	uids := make(map[types.UID]bool, len(hooked))
+	for _, p := range hooked {
+		uids[p.Pod.GetUID()] = true
+	}
+	remaining := make([]utils.PxConsumer, 0, len(hooked))
+	for _, p := range pods {
+		if uids[p.Pod.GetUID()] {
+			remaining = append(remaining, p)
+		}
+	}
+	results, _ := pol.RunHooks(rt, remaining, utils.HookPostRestart)
+	recordHookResults(utils.HookPostRestart, results)
+}
 
-	// NOTE: exiting the main() goroutine, the daemonSet is still maintained "alive" via Watcher
-	logrus.Info(lastOp, " done - MAIN exiting")
-	runtime.Goexit()
-	// normally unreachable
-	logrus.Error("Could not exit MAIN !!")
+// waitPxQuorum waits until the local PX node can be taken down without breaking the PX cluster quorum
+func waitPxQuorum() error {
+	if optSkipQuorum || isDryRun("check PX cluster quorum before taking PX down") {
+		return nil
+	}
+	defer ociRestServer.SetWaitingFor("")
+	for {
+		reason := checkPxQuorum()
+		if reason == "" {
+			return nil
+		}
+		logrus.Warnf("Not taking PX down: %s (will retry in %s)", reason, quorumPoll)
+		ociRestServer.SetWaitingFor("PX quorum: " + reason)
+		recordEvent(v1.EventTypeWarning, utils.EventQuorumWaiting, "Not taking PX down: %s", reason)
+		select {
+		case <-lifecycleCtx.Done():
+			return checkShutdown("PX quorum check")
+		case <-time.After(quorumPoll):
+		}
+	}
+}
+
+// checkPxQuorum checks once if the local PX node can be taken down, and returns the reason if not.
+// NOTE: only PX not running skips the check -- other errors (e.g. PX unresponsive) must not take PX down.
+func checkPxQuorum() string {
+	reason, err := ociRestServer.CheckQuorum()
+	if err != nil && utils.IsPxNotRunning(err) {
+		logrus.WithError(err).Warn("PX not running - skipping PX cluster quorum check")
+		return ""
+	} else if err != nil {
+		return fmt.Sprintf("could not check PX cluster quorum: %s", err)
+	} else if reason == "" {
+		logrus.Info("PX cluster quorum check passed")
+	}
+	return reason
+}
+
+// loadMaintenanceWindows loads the maintenance windows for this node (see utils.LoadMaintenanceWindows())
+func loadMaintenanceWindows() (utils.MaintenanceWindows, error) {
+	node, err := k8s.Instance().GetNodeByName(meNode.GetName())
+	if err != nil {
+		logrus.WithError(err).Warn("Could not refresh node (using cached annotations)")
+		node = meNode
+	}
+	return utils.LoadMaintenanceWindows(node, optMaintenance)
+}
+
+// outsideMaintenanceWindow returns TRUE if the disruptive install actions would have to wait for the maintenance
+// window (see deferToMaintenanceWindow()), along w/ the loaded windows.
+// NOTE: must be decided before running px-runc, which would otherwise update the live OCI config and unit-file.
+func outsideMaintenanceWindow(record *utils.InstallState, force bool) (utils.MaintenanceWindows, bool) {
+	if force {
+		logrus.Info("Maintenance windows overridden - proceeding with install")
+		return nil, false
+	} else if record.InProgress != "" {
+		logrus.Warnf("Resuming install interrupted during %s (ignoring maintenance windows)", record.InProgress)
+		return nil, false
+	}
+
+	windows, err := loadMaintenanceWindows()
+	if err != nil {
+		logrus.WithError(err).Error("Could not load maintenance windows (deferring install)")
+		recordEvent(v1.EventTypeWarning, utils.EventMaintenanceInvalid, "Could not load maintenance windows: %s", err)
+		return windows, true
+	}
+	return windows, !windows.IsOpen(time.Now())
+}
+
+// deferToMaintenanceWindow defers the disruptive install actions until the maintenance window.  The deferred
+// actions get staged on disk, and executed by waitMaintenanceWindow() once the window opens.
+func deferToMaintenanceWindow(plan *utils.InstallPlan, desired *utils.InstallState, windows utils.MaintenanceWindows) {
+	now := time.Now()
+	pending := &utils.PendingAction{
+		ImageName:  desired.ImageName,
+		ImageID:    desired.ImageID,
+		Reasons:    plan.Reasons,
+		DetectedAt: now.UTC(),
+	}
+	if old, err := utils.LoadPendingAction(pendingActionFile); err == nil && old.ImageID == desired.ImageID {
+		pending.DetectedAt = old.DetectedAt
+	}
+	nextMsg := "unknown"
+	if next := windows.NextOpen(now); !next.IsZero() {
+		pending.NextWindow, nextMsg = &next, next.String()
+	}
+	if isDryRun("defer install actions until the maintenance window (next at %s)", nextMsg) {
+		return
+	}
+
+	logrus.Infof("Outside maintenance window - deferring install actions until %s", nextMsg)
+	if err := pending.Save(pendingActionFile); err != nil {
+		logrus.WithError(err).Warn("Could not save pending action")
+	}
+	ociRestServer.SetPendingAction(pending)
+	recordEvent(v1.EventTypeNormal, utils.EventInstallDeferred, "PX-OCI install actions deferred until %s: %s",
+		nextMsg, strings.Join(plan.Reasons, "; "))
+	go waitMaintenanceWindow()
+}
+
+// clearPendingAction removes the pending action staged by deferToMaintenanceWindow()
+func clearPendingAction() {
+	if err := utils.RemovePendingAction(pendingActionFile); err != nil {
+		logrus.WithError(err).Warn("Could not remove ", pendingActionFile)
+	}
+	ociRestServer.SetPendingAction(nil)
+}
+
+// waitMaintenanceWindow waits for the maintenance window, and executes the pending install actions
+func waitMaintenanceWindow() {
+	if !atomic.CompareAndSwapInt32(&maintenanceWaiting, 0, 1) {
+		return // already waiting
+	}
+	defer atomic.StoreInt32(&maintenanceWaiting, 0)
+
+	ticker := time.NewTicker(maintenanceTick)
+	defer ticker.Stop()
+	failed := false
+	for {
+		select {
+		case <-lifecycleCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := utils.LoadPendingAction(pendingActionFile); os.IsNotExist(err) {
+			return // executed (e.g. via `px/service=upgrade-now`)
+		}
+		if windows, err := loadMaintenanceWindows(); err != nil || !windows.IsOpen(time.Now()) {
+			failed = false
+			continue
+		} else if failed {
+			continue
+		}
+		logrus.Info("Maintenance window open - executing pending install actions")
+		if err := doInstall(false); err != nil && lifecycleCtx.Err() == nil {
+			// note: failure is recorded via doInstall(), the pending actions stay staged for the next window
+			logrus.WithError(err).Error("Could not execute pending install actions (will retry in next window)")
+			failed = true
+		}
+	}
+}
+
+// retryInstall retries the failed install w/ exponential backoff, until it succeeds, PX gets disabled, or the
+// shutdown is requested
+func retryInstall() {
+	defer ociRestServer.SetWaitingFor("")
+	for d := installRetryMin; ; d *= 2 {
+		if d > installRetryMax {
+			d = installRetryMax
+		}
+		logrus.Infof("Retrying failed install in %s", d)
+		ociRestServer.SetWaitingFor(fmt.Sprintf("install retry (in %s)", d))
+		select {
+		case <-lifecycleCtx.Done():
+			return
+		case <-time.After(d):
+		}
+		if atomic.LoadInt32(&pxDisabled) != 0 {
+			logrus.Info("PX disabled - not retrying the failed install")
+			return
+		}
+		err := doInstall(false)
+		if err == nil || lifecycleCtx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Error("Install retry failed")
+	}
+}
+
+// resumeInterrupted detects the install interrupted by the previous px-oci-mon (e.g. pod killed mid-upgrade),
+// and undoes the node cordon.  The interrupted install itself is resumed by doInstall().
+func resumeInterrupted() {
+	record := loadInstallRecord()
+	if record.InProgress != "" {
+		logrus.Warnf("Detected install interrupted during %s - will resume", record.InProgress)
+		recordEvent(v1.EventTypeWarning, utils.EventInstallInterrupted,
+			"Previous install was interrupted during %s - resuming", record.InProgress)
+	}
+	if record.Cordoned {
+		logrus.Warn("Node left cordoned by interrupted install - uncordoning")
+		uncordonNode(record)
+	}
+}
+
+// shutdown waits for the current install step to abort (steps are cancelled via lifecycleCtx), uncordons the node
+// if we cordoned it, stops the REST server and exits.
+// NOTE: the node is not uncordoned while the step still runs -- if killed meanwhile, the install resumes on next start.
+func shutdown() {
+	done := make(chan struct{})
+	go func() {
+		// note: keeping the lock, so no other install step starts
+		installLock.Lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+		logrus.Warnf("Install step still in progress after %s - waiting for it to stop", shutdownGrace)
+		<-done
+	}
+	logrus.Info("No install in progress")
+
+	if record := loadInstallRecord(); record.Cordoned {
+		uncordonNode(record)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ociRestServer.Stop(ctx); err != nil {
+		logrus.WithError(err).Warn("Could not stop REST server")
+	}
+	logrus.Info("Shutdown completed - exiting")
+	os.Exit(0)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/portworx/px-installer/px-oci-mon/utils"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -37,18 +38,41 @@ INFO[0000] PX-RunC arguments: -c zox-dbg-mk126 -d enp0s8 -k etcd://70.0.0.65:237
 INFO[0000] PX-RunC mounts: /dev/:/dev/ /etc/hosts:/etc/hosts:ro /etc/pwx/:/etc/pwx/ /etc/resolv.conf:/etc/resolv.conf:ro /opt/pwx/bin/:/export_bin/ /lib/modules/:/lib/modules/ proc:/proc/:nosuid,noexec,nodev /run/docker/:/run/docker/ sysfs:/sys/:nosuid,noexec,nodev cgroup:/sys/fs/cgroup/:nosuid,noexec,nodev /usr/src/:/usr/src/ /var/cores/:/var/cores/ /var/run/:/var/host_run/ /var/lib/kubelet:/var/lib/kubelet:shared /var/lib/osd/:/var/lib/osd/:shared
 INFO[0000] PX-RunC env: PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin TERM=xterm GOTRACEBACK=crash GOMAXPROCS=64 PXMOD_SOURCE=/home/px-fuse PXMOD_VERSION=5 BTRFS_SOURCE=/home/px_btrfs PX_RUNC=true
 INFO[0000] Successfully written /etc/systemd/system/portworx.service`, false},
+		{`INFO[0000] SPEC UPDATED [cc824f500363f0cf4e60c570cf9e8931 /opt/pwx/oci/config.json]
+INFO[0000] > Updated mounts: add{/var/lib/kubelet/pods/e5b67f9c/etc-hosts:/etc/hosts /var/cores/:/var/cores/}`, true},
+		{`INFO[0000] SPEC UPDATED [cc824f500363f0cf4e60c570cf9e8931 /opt/pwx/oci/config.json]
+INFO[0000] > Updated env: add{KUBERNETES_PORT=tcp://10.96.0.2:443} rm{KUBERNETES_PORT=tcp://10.96.0.1:443}`, true},
 	}
 
-	origFn := getKubernetesRootDirFn
-	getKubernetesRootDirFn = func() (string, error) {
-		return "/var/lib/kubelet", nil
-	}
-	defer func() {
-		getKubernetesRootDirFn = origFn
-	}()
-
+	pol := utils.DefaultRestartPolicy().WithKubeletDir("/var/lib/kubelet")
 	for _, v := range data {
-		assert.Equal(t, v.expectation, isRestartRequired(v.log),
+		res, err := utils.ParseRuncInstallOutput(v.log)
+		assert.NoError(t, err)
+		restart, _ := isRestartRequired(res, pol)
+		assert.Equal(t, v.expectation, restart,
 			"Was expecting isRestartRequired()=%v for `%s`", v.expectation, v.log)
 	}
 }
+
+func TestIsRestartRequiredPolicy(t *testing.T) {
+	pol, err := utils.ParseRestartPolicy([]byte(`{"rules": [
+		{"name": "pods", "mountPrefixes": ["${KUBELET_DIR}/pods/"], "action": "ignore"},
+		{"name": "k8s-env", "envKeys": ["KUBERNETES_*"], "action": "ignore"},
+		{"name": "mgmt-iface", "args": ["-m"], "action": "next-restart"}
+	]}`))
+	assert.NoError(t, err)
+	pol = pol.WithKubeletDir("/var/lib/kubelet")
+
+	res, err := utils.ParseRuncInstallOutput(`INFO[0000] SPEC UPDATED [cc824f500363f0cf4e60c570cf9e8931 /opt/pwx/oci/config.json]
+INFO[0000] > Updated env: add{KUBERNETES_PORT=tcp://10.96.0.2:443} rm{KUBERNETES_PORT=tcp://10.96.0.1:443}
+INFO[0000] > Updated mounts: add{/var/lib/kubelet/pods/e5b67f9c/etc-hosts:/etc/hosts}
+INFO[0000] > Updated args: add{-m eth2} rm{-m eth1}`)
+	assert.NoError(t, err)
+	restart, deferred := isRestartRequired(res, pol)
+	assert.False(t, restart)
+	assert.Equal(t, []string{"add arg -m eth2", "rm arg -m eth1"}, deferred)
+
+	res.Env.Added = append(res.Env.Added, "PX_DEBUG=1")
+	restart, _ = isRestartRequired(res, pol)
+	assert.True(t, restart)
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	auth_v1 "k8s.io/api/authentication/v1"
+)
+
+const (
+	httpHeaderAuthorization = "Authorization"
+	httpHeaderAuthenticate  = "WWW-Authenticate"
+	bearerPrefix            = "Bearer "
+	// tokenFileUser is the user reported for requests authenticated via the static token
+	tokenFileUser = "token-file"
+)
+
+// RESTSecurityConfig configures the TLS and authentication of the OCI REST server.
+// Note that only the mutating (POST) calls are authenticated, while GET/HEAD calls remain open for kubelet probes.
+type RESTSecurityConfig struct {
+	// CertFile and KeyFile enable the TLS
+	CertFile, KeyFile string
+	// ClientCAFile enables authentication via client certificates (requires TLS)
+	ClientCAFile string
+	// TokenFile enables authentication via bearer token (e.g. mounted secret)
+	TokenFile string
+	// TokenReview enables authentication of bearer tokens via Kubernetes TokenReview API
+	TokenReview bool
+	// AllowedUsers restricts the users authenticated via client certificates or TokenReview (empty allows all)
+	AllowedUsers []string
+}
+
+// TLSEnabled returns TRUE if TLS has been configured
+func (c *RESTSecurityConfig) TLSEnabled() bool {
+	return c != nil && c.CertFile != ""
+}
+
+// AuthEnabled returns TRUE if any of the authentication methods has been configured
+func (c *RESTSecurityConfig) AuthEnabled() bool {
+	return c != nil && (c.ClientCAFile != "" || c.TokenFile != "" || c.TokenReview)
+}
+
+// tlsConfig validates the configuration, and returns the TLS config for the server (nil if TLS not enabled)
+func (c *RESTSecurityConfig) tlsConfig() (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("TLS requires both certificate and key")
+	} else if c.TokenFile != "" {
+		if _, err := readToken(c.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if !c.TLSEnabled() {
+		if c.ClientCAFile != "" {
+			return nil, fmt.Errorf("Client certificates authentication requires TLS")
+		}
+		return nil, nil
+	}
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return nil, fmt.Errorf("Could not load TLS certificate/key: %s", err)
+	}
+	ret := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile != "" {
+		buf, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read client CA: %s", err)
+		}
+		ret.ClientCAs = x509.NewCertPool()
+		if !ret.ClientCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("No valid certificates found in %s", c.ClientCAFile)
+		}
+		// note: client certs are optional, so the kubelet probes can still reach GET/HEAD
+		ret.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return ret, nil
+}
+
+// readToken reads the bearer token from a given file
+func readToken(fname string) (string, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", fmt.Errorf("Could not read token: %s", err)
+	}
+	tok := strings.TrimSpace(string(buf))
+	if tok == "" {
+		return "", fmt.Errorf("Empty token in %s", fname)
+	}
+	return tok, nil
+}
+
+// reviewToken authenticates the token via Kubernetes TokenReview API, and returns the user name
+func reviewToken(token string) (string, error) {
+	cli, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	tr, err := cli.AuthenticationV1().TokenReviews().Create(&auth_v1.TokenReview{
+		Spec: auth_v1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Could not review token: %s", err)
+	} else if !tr.Status.Authenticated {
+		return "", fmt.Errorf("Token not authenticated: %s", tr.Status.Error)
+	}
+	return tr.Status.User.Username, nil
+}
+
+// isAllowedUser checks if the authenticated user is allowed
+func (c *RESTSecurityConfig) isAllowedUser(user string) error {
+	if len(c.AllowedUsers) == 0 || inArray(user, c.AllowedUsers...) {
+		return nil
+	}
+	return fmt.Errorf("User %q not allowed", user)
+}
+
+// authenticate authenticates the REST request, and returns the user name
+func (s *OciRESTServlet) authenticate(req *http.Request) (string, error) {
+	c := s.security
+	if !c.AuthEnabled() {
+		return "", nil
+	}
+
+	// client certificates (verified against the client CA by the TLS stack)
+	if c.ClientCAFile != "" && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		user := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		return user, c.isAllowedUser(user)
+	}
+
+	// bearer tokens
+	hdr := req.Header.Get(httpHeaderAuthorization)
+	if !strings.HasPrefix(hdr, bearerPrefix) {
+		return "", fmt.Errorf("No credentials provided")
+	}
+	token := strings.TrimSpace(hdr[len(bearerPrefix):])
+	if c.TokenFile != "" {
+		// note: re-reading the token, in case the secret got updated
+		expected, err := readToken(c.TokenFile)
+		if err != nil {
+			return "", err
+		} else if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return tokenFileUser, nil
+		}
+	}
+	if c.TokenReview {
+		user, err := s.reviewToken(token)
+		if err != nil {
+			return "", err
+		}
+		return user, c.isAllowedUser(user)
+	}
+	return "", fmt.Errorf("Invalid token")
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRESTSecurityConfig(t *testing.T) {
+	cfg := &RESTSecurityConfig{}
+	tlsCfg, err := cfg.tlsConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, tlsCfg)
+	assert.False(t, cfg.AuthEnabled())
+
+	_, err = (&RESTSecurityConfig{CertFile: "/tmp/cert.pem"}).tlsConfig()
+	assert.Error(t, err)
+	_, err = (&RESTSecurityConfig{ClientCAFile: "/tmp/ca.pem"}).tlsConfig()
+	assert.Error(t, err)
+	_, err = (&RESTSecurityConfig{TokenFile: "/nonexistent/token"}).tlsConfig()
+	assert.Error(t, err)
+}
+
+func TestRESTAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-auth")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := path.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600))
+
+	s := NewRESTServlet(nil, nil)
+	rollbacks := 0
+	s.SetRollbackHandler(func(string) error {
+		rollbacks++
+		return nil
+	})
+	s.reviewToken = func(token string) (string, error) {
+		if token == "k8s-token" {
+			return "system:serviceaccount:kube-system:px-admin", nil
+		}
+		return "", fmt.Errorf("Token not authenticated")
+	}
+	assert.NoError(t, s.SetSecurity(&RESTSecurityConfig{
+		TokenFile:    tokenFile,
+		TokenReview:  true,
+		AllowedUsers: []string{"system:serviceaccount:kube-system:px-admin"},
+	}))
+
+	post := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, svcUriPrefix+opRollback, nil)
+		if token != "" {
+			req.Header.Set(httpHeaderAuthorization, bearerPrefix+token)
+		}
+		w := httptest.NewRecorder()
+		s.handleOciRest(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post("wrong"))
+	assert.Equal(t, 0, rollbacks)
+	assert.Equal(t, http.StatusOK, post("s3cr3t"))
+	assert.Equal(t, http.StatusOK, post("k8s-token"))
+	assert.Equal(t, 2, rollbacks)
+
+	// user not allowed
+	s.security.AllowedUsers = []string{"admin"}
+	assert.Equal(t, http.StatusUnauthorized, post("k8s-token"))
+
+	// GET remains unauthenticated
+	w := httptest.NewRecorder()
+	s.handleOciRest(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
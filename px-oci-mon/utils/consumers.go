@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Detection paths of the PX volume consumer pods
+const (
+	// DetectInlineVolume matches the pod's inline (in-tree) portworxVolume
+	DetectInlineVolume = "inline-volume"
+	// DetectPVInTree matches the PVC bound to PV with the in-tree portworxVolume source
+	DetectPVInTree = "pv-in-tree"
+	// DetectPVCSI matches the PVC bound to PV with the PX CSI driver
+	DetectPVCSI = "pv-csi"
+	// DetectStorageClass matches the PVC of the PX StorageClass (e.g. PVC not bound yet)
+	DetectStorageClass = "storage-class"
+	// DetectPVCProvisioner matches the PVC annotated with the PX storage-provisioner
+	DetectPVCProvisioner = "pvc-provisioner"
+)
+
+const (
+	pxCSIDriverName          = "pxd.portworx.com"
+	pvcStorageProvisionerKey = "volume.beta.kubernetes.io/storage-provisioner"
+)
+
+// pxProvisioners are the in-tree and CSI names of the PX provisioner
+var pxProvisioners = []string{pxStorageProvisionerName, pxCSIDriverName}
+
+// PxConsumer is the pod using the PX volumes
+type PxConsumer struct {
+	Pod v1.Pod
+	// Detection is the detection path which matched the pod (e.g. DetectPVCSI)
+	Detection string
+	// Source describes the matching volume (e.g. "pvc ns/name -> pv name")
+	Source string
+}
+
+// pvInfo is the subset of the PersistentVolume used to detect the PX volumes.
+// NOTE: our Kubernetes API does not know the CSI volume source, so the PVs are decoded from the raw JSON.
+type pvInfo struct {
+	Spec struct {
+		PortworxVolume *json.RawMessage `json:"portworxVolume,omitempty"`
+		CSI            *struct {
+			Driver string `json:"driver"`
+		} `json:"csi,omitempty"`
+	} `json:"spec"`
+}
+
+// consumerLookup is the subset of the Kubernetes API used to detect the PX consumer pods
+type consumerLookup interface {
+	listNodePods(node string) ([]v1.Pod, error)
+	getPVC(namespace, name string) (*v1.PersistentVolumeClaim, error)
+	getPV(name string) (*pvInfo, error)
+	getStorageClass(name string) (*storage.StorageClass, error)
+}
+
+type k8sConsumerLookup struct {
+	cli kubernetes.Interface
+}
+
+func (l *k8sConsumerLookup) listNodePods(node string) ([]v1.Pod, error) {
+	pods, err := l.cli.CoreV1().Pods("").List(meta_v1.ListOptions{FieldSelector: "spec.nodeName=" + node})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+func (l *k8sConsumerLookup) getPVC(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	return l.cli.CoreV1().PersistentVolumeClaims(namespace).Get(name, meta_v1.GetOptions{})
+}
+
+func (l *k8sConsumerLookup) getPV(name string) (*pvInfo, error) {
+	buf, err := l.cli.CoreV1().RESTClient().Get().Resource("persistentvolumes").Name(name).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	pv := &pvInfo{}
+	if err = json.Unmarshal(buf, pv); err != nil {
+		return nil, fmt.Errorf("Could not decode PV %s: %s", name, err)
+	}
+	return pv, nil
+}
+
+func (l *k8sConsumerLookup) getStorageClass(name string) (*storage.StorageClass, error) {
+	return l.cli.StorageV1().StorageClasses().Get(name, meta_v1.GetOptions{})
+}
+
+// consumerDetector walks the pod volumes to PVCs, PVs and StorageClasses (caching the lookups)
+type consumerDetector struct {
+	lookup  consumerLookup
+	pvcs    map[string]*v1.PersistentVolumeClaim
+	pvs     map[string]*pvInfo
+	classes map[string]*storage.StorageClass
+}
+
+func newConsumerDetector(lookup consumerLookup) *consumerDetector {
+	return &consumerDetector{
+		lookup:  lookup,
+		pvcs:    make(map[string]*v1.PersistentVolumeClaim),
+		pvs:     make(map[string]*pvInfo),
+		classes: make(map[string]*storage.StorageClass),
+	}
+}
+
+func (d *consumerDetector) pvc(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	key := namespace + "/" + name
+	if pvc, has := d.pvcs[key]; has {
+		return pvc, nil
+	}
+	pvc, err := d.lookup.getPVC(namespace, name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get PVC %s: %s", key, err)
+	}
+	d.pvcs[key] = pvc
+	return pvc, nil
+}
+
+func (d *consumerDetector) pv(name string) (*pvInfo, error) {
+	if pv, has := d.pvs[name]; has {
+		return pv, nil
+	}
+	pv, err := d.lookup.getPV(name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get PV %s: %s", name, err)
+	}
+	d.pvs[name] = pv
+	return pv, nil
+}
+
+func (d *consumerDetector) storageClass(name string) (*storage.StorageClass, error) {
+	if sc, has := d.classes[name]; has {
+		return sc, nil
+	}
+	sc, err := d.lookup.getStorageClass(name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get StorageClass %s: %s", name, err)
+	}
+	d.classes[name] = sc
+	return sc, nil
+}
+
+// detectPVC returns the detection path and source if the PVC uses PX volume (empty if not)
+func (d *consumerDetector) detectPVC(namespace, name string) (string, string, error) {
+	pvc, err := d.pvc(namespace, name)
+	if err != nil {
+		return "", "", err
+	}
+	src := fmt.Sprintf("pvc %s/%s", namespace, name)
+
+	// bound PV is authoritative
+	if pvName := pvc.Spec.VolumeName; pvName != "" {
+		pv, err := d.pv(pvName)
+		if err != nil {
+			return "", "", err
+		}
+		src += " -> pv " + pvName
+		if pv.Spec.CSI != nil {
+			if inArray(pv.Spec.CSI.Driver, pxProvisioners...) {
+				return DetectPVCSI, src + " (driver " + pv.Spec.CSI.Driver + ")", nil
+			}
+			return "", "", nil
+		} else if pv.Spec.PortworxVolume != nil {
+			return DetectPVInTree, src, nil
+		}
+		return "", "", nil
+	}
+
+	scName := pvc.GetAnnotations()[v1.BetaStorageClassAnnotation]
+	if pvc.Spec.StorageClassName != nil {
+		scName = *pvc.Spec.StorageClassName
+	}
+	if scName != "" {
+		sc, err := d.storageClass(scName)
+		if err != nil {
+			return "", "", err
+		} else if inArray(sc.Provisioner, pxProvisioners...) {
+			return DetectStorageClass, src + " -> storageclass " + scName, nil
+		}
+	}
+	if prov := pvc.GetAnnotations()[pvcStorageProvisionerKey]; inArray(prov, pxProvisioners...) {
+		return DetectPVCProvisioner, src + " (provisioner " + prov + ")", nil
+	}
+	return "", "", nil
+}
+
+// detect returns the consumer if the pod uses PX volumes (nil if not)
+func (d *consumerDetector) detect(p *v1.Pod) *PxConsumer {
+	for _, v := range p.Spec.Volumes {
+		if v.PortworxVolume != nil {
+			return &PxConsumer{Pod: *p, Detection: DetectInlineVolume, Source: "volume " + v.Name}
+		} else if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		det, src, err := d.detectPVC(p.GetNamespace(), v.PersistentVolumeClaim.ClaimName)
+		if err != nil {
+			logrus.WithError(err).Warnf("Could not check volume %s of pod %s/%s", v.Name, p.GetNamespace(),
+				p.GetName())
+		} else if det != "" {
+			return &PxConsumer{Pod: *p, Detection: det, Source: src}
+		}
+	}
+	return nil
+}
+
+// findPxConsumers returns the pods on a given node, which use the PX volumes
+func findPxConsumers(lookup consumerLookup, node string) ([]PxConsumer, error) {
+	pods, err := lookup.listNodePods(node)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list pods on node %s: %s", node, err)
+	}
+	d := newConsumerDetector(lookup)
+	ret := make([]PxConsumer, 0, len(pods))
+	for i := range pods {
+		if c := d.detect(&pods[i]); c != nil {
+			logrus.Infof("Pod %s/%s uses PX volumes (%s: %s)", c.Pod.GetNamespace(), c.Pod.GetName(),
+				c.Detection, c.Source)
+			ret = append(ret, *c)
+		}
+	}
+	return ret, nil
+}
+
+// FindPxConsumers returns the pods on a given node, which use the PX volumes via the in-tree or CSI driver
+func FindPxConsumers(node string) ([]PxConsumer, error) {
+	cli, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	return findPxConsumers(&k8sConsumerLookup{cli: cli}, node)
+}
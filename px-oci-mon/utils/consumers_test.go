@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+)
+
+// fakeConsumerLookup serves the pods, PVCs, PVs and StorageClasses from memory, and counts the lookups
+type fakeConsumerLookup struct {
+	pods    []v1.Pod
+	pvcs    map[string]*v1.PersistentVolumeClaim
+	pvs     map[string]string // PV name -> JSON
+	classes map[string]string // StorageClass name -> provisioner
+	lookups int
+}
+
+func (f *fakeConsumerLookup) listNodePods(node string) ([]v1.Pod, error) {
+	return f.pods, nil
+}
+
+func (f *fakeConsumerLookup) getPVC(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	f.lookups++
+	if pvc, has := f.pvcs[namespace+"/"+name]; has {
+		return pvc, nil
+	}
+	return nil, k8s_errors.NewNotFound(schema.GroupResource{Resource: "persistentvolumeclaims"}, name)
+}
+
+func (f *fakeConsumerLookup) getPV(name string) (*pvInfo, error) {
+	f.lookups++
+	if buf, has := f.pvs[name]; has {
+		pv := &pvInfo{}
+		return pv, json.Unmarshal([]byte(buf), pv)
+	}
+	return nil, k8s_errors.NewNotFound(schema.GroupResource{Resource: "persistentvolumes"}, name)
+}
+
+func (f *fakeConsumerLookup) getStorageClass(name string) (*storage.StorageClass, error) {
+	f.lookups++
+	if prov, has := f.classes[name]; has {
+		return &storage.StorageClass{ObjectMeta: meta_v1.ObjectMeta{Name: name}, Provisioner: prov}, nil
+	}
+	return nil, k8s_errors.NewNotFound(schema.GroupResource{Resource: "storageclasses"}, name)
+}
+
+func testPod(name string, vols ...v1.Volume) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "ns"},
+		Spec:       v1.PodSpec{Volumes: vols},
+	}
+}
+
+func pvcVolume(claim string) v1.Volume {
+	return v1.Volume{Name: "vol-" + claim, VolumeSource: v1.VolumeSource{
+		PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+	}}
+}
+
+func testPVC(name, volume, class string, ann map[string]string) *v1.PersistentVolumeClaim {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "ns", Annotations: ann},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: volume},
+	}
+	if class != "" {
+		pvc.Spec.StorageClassName = &class
+	}
+	return pvc
+}
+
+func TestFindPxConsumers(t *testing.T) {
+	f := &fakeConsumerLookup{
+		pods: []v1.Pod{
+			testPod("inline", v1.Volume{Name: "px", VolumeSource: v1.VolumeSource{
+				PortworxVolume: &v1.PortworxVolumeSource{VolumeID: "vol1"},
+			}}),
+			testPod("csi", v1.Volume{Name: "cfg"}, pvcVolume("csi-claim")),
+			testPod("csi-shared", pvcVolume("csi-claim")),
+			testPod("intree", pvcVolume("intree-claim")),
+			testPod("pending", pvcVolume("pending-claim")),
+			testPod("legacy", pvcVolume("legacy-claim")),
+			testPod("other-csi", pvcVolume("other-claim")),
+			testPod("missing", pvcVolume("missing-claim"), pvcVolume("csi-claim")),
+			testPod("no-volumes"),
+		},
+		pvcs: map[string]*v1.PersistentVolumeClaim{
+			"ns/csi-claim":     testPVC("csi-claim", "pv-csi", "px-csi", nil),
+			"ns/intree-claim":  testPVC("intree-claim", "pv-intree", "", nil),
+			"ns/pending-claim": testPVC("pending-claim", "", "px-csi", nil),
+			"ns/legacy-claim": testPVC("legacy-claim", "", "", map[string]string{
+				pvcStorageProvisionerKey: pxStorageProvisionerName,
+			}),
+			"ns/other-claim": testPVC("other-claim", "pv-other", "px-csi", nil),
+		},
+		pvs: map[string]string{
+			"pv-csi":    `{"spec": {"csi": {"driver": "pxd.portworx.com", "volumeHandle": "123"}}}`,
+			"pv-intree": `{"spec": {"portworxVolume": {"volumeID": "456"}}}`,
+			"pv-other":  `{"spec": {"csi": {"driver": "ebs.csi.aws.com"}}}`,
+		},
+		classes: map[string]string{"px-csi": pxCSIDriverName},
+	}
+
+	cs, err := findPxConsumers(f, "node1")
+	assert.NoError(t, err)
+	found := make(map[string]string)
+	for _, c := range cs {
+		found[c.Pod.GetName()] = c.Detection + ": " + c.Source
+	}
+	assert.Equal(t, map[string]string{
+		"inline":     "inline-volume: volume px",
+		"csi":        "pv-csi: pvc ns/csi-claim -> pv pv-csi (driver pxd.portworx.com)",
+		"csi-shared": "pv-csi: pvc ns/csi-claim -> pv pv-csi (driver pxd.portworx.com)",
+		"intree":     "pv-in-tree: pvc ns/intree-claim -> pv pv-intree",
+		"pending":    "storage-class: pvc ns/pending-claim -> storageclass px-csi",
+		"legacy":     "pvc-provisioner: pvc ns/legacy-claim (provisioner kubernetes.io/portworx-volume)",
+		"missing":    "pv-csi: pvc ns/csi-claim -> pv pv-csi (driver pxd.portworx.com)",
+	}, found)
+
+	// lookups are cached: 6 PVCs (incl. missing), 3 PVs, 1 StorageClass
+	assert.Equal(t, 10, f.lookups)
+}
@@ -0,0 +1,628 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	criAPIv1       = "runtime.v1"
+	criAPIv1alpha2 = "runtime.v1alpha2"
+	criVersion     = "0.1.0"
+	criNamespace   = "portworx"
+	criLabelKey    = "io.portworx.oci-installer"
+	criPodLabelKey = "io.kubernetes.pod.name"
+	criPollDelay   = time.Second
+
+	// criPodNamespaceLabelKey and criContainerLabelKey are set by kubelet on both CRI and Docker containers
+	criPodNamespaceLabelKey = "io.kubernetes.pod.namespace"
+	criContainerLabelKey    = "io.kubernetes.container.name"
+
+	// CRI enums (see k8s.io/cri-api/pkg/apis/runtime/v1/api.proto)
+	criStateRunning               = 1
+	criStateExited                = 2
+	criNamespaceModeNode          = 2
+	criPropagationHostToContainer = 1
+	criPropagationBidirectional   = 2
+)
+
+var criLogDir = path.Join(ociDir, "inst-logs")
+
+// criHostMountNs is the host's mount namespace, used to run the runtime's CLI (see ImportImage)
+const criHostMountNs = "/host_proc/1/ns/mnt"
+
+// criContainerInfo is the (partial) verbose container info, as reported by containerd and CRI-O
+type criContainerInfo struct {
+	Config struct {
+		Args []string `json:"args"`
+		Envs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"envs"`
+	} `json:"config"`
+	RuntimeSpec struct {
+		Process struct {
+			Args []string `json:"args"`
+			Env  []string `json:"env"`
+		} `json:"process"`
+		Mounts []struct {
+			Destination string `json:"destination"`
+			Source      string `json:"source"`
+		} `json:"mounts"`
+	} `json:"runtimeSpec"`
+}
+
+// ContainerdInstaller is a containerd client specialized for Container installation.
+// It talks the Kubernetes CRI API over the containerd socket (note, CRI-O socket works just as well).
+type ContainerdInstaller struct {
+	creds  *RegistryCredentials
+	ctx    context.Context
+	cli    *grpcClient
+	api    string
+	socket string
+	// LogDir is the directory for RunOnce container logs -- must be accessible from both host, and this container
+	LogDir string
+	// HostMountNs is the mount namespace to run the runtime's CLI in (empty runs the CLI in this container)
+	HostMountNs string
+}
+
+// NewContainerdInstaller creates an instance of the ContainerdInstaller, talking to a given socket, and pulling the
+// images w/ given registry credentials (nil if none).  The context will abort the CRI calls when cancelled.
+func NewContainerdInstaller(ctx context.Context, socket string, creds *RegistryCredentials) (*ContainerdInstaller, error) {
+	if socket == "" {
+		socket = ContainerdSocket
+	}
+	ci := &ContainerdInstaller{
+		creds:       creds,
+		ctx:         ctx,
+		cli:         newGrpcClient(socket),
+		socket:      socket,
+		LogDir:      criLogDir,
+		HostMountNs: criHostMountNs,
+	}
+
+	// negotiate CRI API version (containerd 2.x dropped v1alpha2, older runtimes only have v1alpha2)
+	var err error
+	for _, api := range []string{criAPIv1, criAPIv1alpha2} {
+		var resp pbFields
+		ci.api = api
+		resp, err = ci.call("RuntimeService/Version", new(pbMessage).str(1, criVersion))
+		if err == nil {
+			logrus.Infof("Connected to %s %s (CRI %s) at %s", resp.str(2), resp.str(3), api, socket)
+			return ci, nil
+		} else if !isGrpcUnimplemented(err) {
+			break
+		}
+		logrus.WithError(err).Debugf("CRI %s not supported", api)
+	}
+	return nil, fmt.Errorf("Could not talk to CRI runtime at %s: %s", socket, err)
+}
+
+// call invokes the CRI method (e.g. "ImageService/PullImage"), and returns the decoded response
+func (ci *ContainerdInstaller) call(method string, req *pbMessage) (pbFields, error) {
+	resp, err := ci.cli.invoke(ci.ctx, "/"+ci.api+"."+method, req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return pbDecode(resp)
+}
+
+func criImageSpec(name string) *pbMessage {
+	return new(pbMessage).str(1, name)
+}
+
+// PullImageCb pulls the image of a given name. The CallBack function is called if image does not exist, or
+// a different image was downloaded.
+func (ci *ContainerdInstaller) PullImageCb(name string, cb DownloadNotifyCbFunc) error {
+	oldID, err := ci.GetImageID(name)
+	if err != nil {
+		logrus.WithError(err).Debug("Could not inspect image ", name)
+	}
+	if oldID == "" && cb != nil {
+		if err := cb(); err != nil {
+			return err
+		}
+	}
+
+	logrus.Info("Pulling image ", name)
+	req := new(pbMessage).msg(1, criImageSpec(name))
+	if auth := ci.creds.Lookup(name); auth != nil {
+		req.msg(2, new(pbMessage).str(1, auth.Username).str(2, auth.Password).str(4, auth.ServerAddress).
+			str(5, auth.IdentityToken).str(6, auth.RegistryToken))
+	}
+	resp, err := ci.call("ImageService/PullImage", req)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Pulled image %s [%s]", name, resp.str(1))
+
+	if oldID != "" && cb != nil {
+		if newID, err := ci.GetImageID(name); err == nil && newID != oldID {
+			return cb()
+		}
+	}
+	return nil
+}
+
+// GetImageID inspects the image of a given name, and returns the image ID
+func (ci *ContainerdInstaller) GetImageID(name string) (string, error) {
+	resp, err := ci.call("ImageService/ImageStatus", new(pbMessage).msg(1, criImageSpec(name)))
+	if err != nil {
+		return "", err
+	}
+	img, err := resp.msg(1)
+	if err != nil {
+		return "", err
+	} else if id := img.str(1); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("No such image: %s", name)
+}
+
+// GetRepoDigests inspects the image of a given name, and returns its repository digests
+func (ci *ContainerdInstaller) GetRepoDigests(name string) ([]string, error) {
+	resp, err := ci.call("ImageService/ImageStatus", new(pbMessage).msg(1, criImageSpec(name)))
+	if err != nil {
+		return nil, err
+	}
+	img, err := resp.msg(1)
+	if err != nil {
+		return nil, err
+	} else if img.str(1) == "" {
+		return nil, fmt.Errorf("No such image: %s", name)
+	}
+	return img.strs(3), nil
+}
+
+// isCrio returns TRUE if we're talking to CRI-O (as opposed to containerd)
+func (ci *ContainerdInstaller) isCrio() bool {
+	return strings.Contains(ci.socket, "crio")
+}
+
+// runCLI runs the runtime's CLI (e.g. `ctr`), since the CRI API does not support the image import/export
+func (ci *ContainerdInstaller) runCLI(in io.Reader, out io.Writer, args ...string) error {
+	if ci.HostMountNs != "" {
+		args = append([]string{"/usr/bin/nsenter", "--mount=" + ci.HostMountNs, "--"}, args...)
+	}
+	logrus.Info("> run: ", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ci.ctx, args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ctrArgs returns the `ctr` command-line for the Kubernetes images namespace
+func (ci *ContainerdInstaller) ctrArgs(args ...string) []string {
+	return append([]string{"ctr", "--address", ci.socket, "--namespace", "k8s.io"}, args...)
+}
+
+// ImportImage imports the images from the tarball or OCI-layout directory (via `ctr images import`, or
+// `podman load` for CRI-O), and returns the imported image names
+func (ci *ContainerdInstaller) ImportImage(archive string) ([]string, error) {
+	in, err := openImageArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	args := ci.ctrArgs("images", "import", "-")
+	if ci.isCrio() {
+		args = []string{"podman", "load"}
+	}
+	var out bytes.Buffer
+	if err = ci.runCLI(in, &out, args...); err != nil {
+		return nil, err
+	}
+	return parseLoadedImages(out.String()), nil
+}
+
+// ExportImage exports the image of a given name as OCI tarball (via `ctr images export`, or `podman save` for CRI-O)
+func (ci *ContainerdInstaller) ExportImage(name string, w io.Writer) error {
+	// note: CLIs need fully qualified names (e.g. "docker.io/portworx/px-enterprise:2.0")
+	resp, err := ci.call("ImageService/ImageStatus", new(pbMessage).msg(1, criImageSpec(name)))
+	if err != nil {
+		return err
+	}
+	img, err := resp.msg(1)
+	if err != nil {
+		return err
+	} else if tags := img.strs(2); len(tags) > 0 {
+		name = tags[0]
+	} else if img.str(1) == "" {
+		return fmt.Errorf("No such image: %s", name)
+	}
+	args := ci.ctrArgs("images", "export", "-", name)
+	if ci.isCrio() {
+		args = []string{"podman", "save", "--format", "oci-archive", "--output", "/dev/stdout", name}
+	}
+	return ci.runCLI(nil, w, args...)
+}
+
+// criBindToMount converts Docker-CLI bind (ie. `source:dest[:shared,ro]`) into the CRI Mount
+func criBindToMount(bind string) (*pbMessage, error) {
+	parts := strings.SplitN(bind, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid bind %q", bind)
+	}
+	m := new(pbMessage).str(1, parts[1]).str(2, parts[0])
+	if len(parts) > 2 {
+		for _, o := range strings.Split(parts[2], ",") {
+			switch o {
+			case "ro":
+				m.boolean(3, true)
+			case "shared", "rshared":
+				m.varint(5, criPropagationBidirectional)
+			case "slave", "rslave":
+				m.varint(5, criPropagationHostToContainer)
+			}
+		}
+	}
+	return m, nil
+}
+
+// removeSandboxes stops and removes the pod-sandboxes w/ given labels
+func (ci *ContainerdInstaller) removeSandboxes(labels map[string]string) {
+	resp, err := ci.call("RuntimeService/ListPodSandbox",
+		new(pbMessage).msg(1, new(pbMessage).strMap(3, labels)))
+	if err != nil {
+		logrus.WithError(err).Warn("Could not list pod-sandboxes")
+		return
+	}
+	items, err := resp.msgs(1)
+	if err != nil {
+		logrus.WithError(err).Warn("Could not parse pod-sandboxes")
+		return
+	}
+	for _, sb := range items {
+		ci.removeSandbox(sb.str(1))
+	}
+}
+
+// removeSandbox stops and removes a given pod-sandbox
+func (ci *ContainerdInstaller) removeSandbox(id string) {
+	_, err := ci.call("RuntimeService/StopPodSandbox", new(pbMessage).str(1, id))
+	logrus.WithError(err).Debug("Sandbox stopped ", id)
+	_, err = ci.call("RuntimeService/RemovePodSandbox", new(pbMessage).str(1, id))
+	logrus.WithError(err).Debug("Sandbox removed ", id)
+}
+
+// criLogLine converts CRI log line (ie. `<timestamp> <stream> <P|F> <log>`) into the dockerLogReader-like output
+func criLogLine(l []byte) []byte {
+	parts := bytes.SplitN(l, []byte{' '}, 4)
+	if len(parts) < 4 {
+		return append(append([]byte("E "), l...), '\n')
+	}
+	out := []byte("E ")
+	if string(parts[1]) == "stdout" {
+		out = []byte("> ")
+	}
+	out = append(out, parts[0]...)
+	out = append(out, ' ')
+	out = append(out, parts[3]...)
+	if string(parts[2]) != "P" {
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// waitAndFollow follows the container's log-file, until the container exits.  Returns the container's exit-code.
+func (ci *ContainerdInstaller) waitAndFollow(id, logFile string, writers ...io.Writer) (int, error) {
+	var offs int64
+	follow := func() {
+		f, err := os.Open(logFile)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		if _, err = f.Seek(offs, io.SeekStart); err != nil {
+			return
+		}
+		buf, _ := ioutil.ReadAll(f)
+		// process only complete lines
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			offs += int64(i + 1)
+			for _, l := range bytes.Split(buf[:i], []byte{'\n'}) {
+				out := criLogLine(l)
+				for _, w := range writers {
+					w.Write(out)
+				}
+			}
+		}
+	}
+
+	for {
+		resp, err := ci.call("RuntimeService/ContainerStatus", new(pbMessage).str(1, id))
+		if err != nil {
+			return -1, err
+		}
+		st, err := resp.msg(1)
+		if err != nil {
+			return -1, err
+		}
+		follow()
+		if st.varint(3) == criStateExited {
+			return int(int32(st.varint(7))), nil
+		}
+		select {
+		case <-ci.ctx.Done():
+			return -1, ci.ctx.Err()
+		case <-time.After(criPollDelay):
+		}
+	}
+}
+
+// RunOnce will create container (inside a dedicated pod-sandbox), run it, and wait until it's finished.
+func (ci *ContainerdInstaller) RunOnce(name, cntr string, binds, entrypoint, args []string, lproc LogProcessCb) error {
+	labels := map[string]string{criLabelKey: cntr}
+
+	logrus.Infof("Removing old container %s (if any)", cntr)
+	ci.removeSandboxes(labels)
+
+	logPath := cntr + ".log"
+	if err := os.MkdirAll(ci.LogDir, 0700); err != nil {
+		return fmt.Errorf("Could not create log directory %s: %s", ci.LogDir, err)
+	}
+	os.Remove(path.Join(ci.LogDir, logPath))
+
+	// NOTE: using host-network, so we do not depend on CNI
+	sbConf := new(pbMessage).
+		msg(1, new(pbMessage).str(1, cntr).str(2, fmt.Sprintf("%s-%d", cntr, time.Now().Unix())).str(3, criNamespace)).
+		str(3, ci.LogDir).
+		strMap(6, labels).
+		msg(8, new(pbMessage).msg(2, new(pbMessage).
+			msg(1, new(pbMessage).varint(1, criNamespaceModeNode)).
+			boolean(6, true)))
+
+	logrus.Info("Creating pod-sandbox for ", cntr)
+	resp, err := ci.call("RuntimeService/RunPodSandbox", new(pbMessage).msg(1, sbConf))
+	if err != nil {
+		return fmt.Errorf("Could not create pod-sandbox %s: %s", cntr, err)
+	}
+	sbID := resp.str(1)
+	started := false
+	defer func() {
+		if !started {
+			// container did not start -- do not leave the pod-sandbox behind
+			ci.removeSandbox(sbID)
+		}
+	}()
+
+	if len(entrypoint) > 0 {
+		logrus.Infof("Overriding entrypoint with %v", entrypoint)
+	}
+	contConf := new(pbMessage).
+		msg(1, new(pbMessage).str(1, cntr)).
+		msg(2, criImageSpec(name)).
+		strs(3, entrypoint).
+		strs(4, args).
+		strMap(9, labels).
+		str(11, logPath).
+		msg(15, new(pbMessage).msg(2, new(pbMessage).boolean(2, true)))
+	for _, b := range binds {
+		m, err := criBindToMount(b)
+		if err != nil {
+			return err
+		}
+		contConf.msg(7, m)
+	}
+
+	logrus.Info("Creating container from image ", name)
+	resp, err = ci.call("RuntimeService/CreateContainer",
+		new(pbMessage).str(1, sbID).msg(2, contConf).msg(3, sbConf))
+	if err != nil {
+		return fmt.Errorf("Could not create container %s: %s", name, err)
+	}
+	id := resp.str(1)
+
+	logrus.Infof("Starting container %s [%s]", id, name)
+	if _, err = ci.call("RuntimeService/StartContainer", new(pbMessage).str(1, id)); err != nil {
+		return fmt.Errorf("Could not start container %s [%s]: %s", id, name, err)
+	}
+	started = true
+
+	// after this point, we want to always dump the logs
+	var retError error
+	writers := []io.Writer{os.Stdout}
+	var b bytes.Buffer
+	if lproc != nil { // append bytes-buff if log-processing desired
+		writers = append(writers, &b)
+	}
+
+	logrus.Infof("Logs for container %s [%s]", id, name)
+	rc, err := ci.waitAndFollow(id, path.Join(ci.LogDir, logPath), writers...)
+	if err != nil {
+		retError = fmt.Errorf("Error while running container %s [%s]: %s", id, name, err)
+	} else if rc != 0 {
+		retError = fmt.Errorf("Expected status code '0', got %d", rc)
+	}
+	if lproc != nil { // invoke log-processing (if required)
+		lproc(b.Bytes(), err)
+	}
+
+	// CHECKME: Not removing the container, not to provoke the fsync, also to keep the PX-image
+	logrus.Warnf("NOTE: Not removing the %s container [%s]", id, name)
+	if _, err = ci.call("RuntimeService/StopPodSandbox", new(pbMessage).str(1, sbID)); err != nil {
+		logrus.WithError(err).Warn("Could not stop pod-sandbox ", sbID)
+	}
+
+	return retError
+}
+
+// findContainerByPod finds the running container ID for a given POD name
+func (ci *ContainerdInstaller) findContainerByPod(pod string) (string, error) {
+	filter := new(pbMessage).
+		msg(2, new(pbMessage).varint(1, criStateRunning)).
+		strMap(4, map[string]string{criPodLabelKey: pod})
+	resp, err := ci.call("RuntimeService/ListContainers", new(pbMessage).msg(1, filter))
+	if err != nil {
+		return "", err
+	}
+	items, err := resp.msgs(1)
+	if err != nil {
+		return "", err
+	} else if len(items) != 1 {
+		return "", fmt.Errorf("Expected 1 container for POD %s, found %d", pod, len(items))
+	}
+	return items[0].str(1), nil
+}
+
+// criExecOutput merges the stdout and stderr of the executed command, prefixing the lines like dockerLogReader()
+func criExecOutput(stdout, stderr string) string {
+	var b bytes.Buffer
+	for _, o := range []struct{ pfx, out string }{{"> ", stdout}, {"E ", stderr}} {
+		if o.out = strings.TrimSuffix(o.out, "\n"); o.out == "" {
+			continue
+		}
+		for _, l := range strings.Split(o.out, "\n") {
+			b.WriteString(o.pfx)
+			b.WriteString(l)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// ExecInPod runs the command in the container of a given pod (running on this node), aborting it after timeout
+func (ci *ContainerdInstaller) ExecInPod(namespace, pod, container string, cmd []string, timeout time.Duration) (
+	*ExecResult, error) {
+	filter := new(pbMessage).
+		msg(2, new(pbMessage).varint(1, criStateRunning)).
+		strMap(4, map[string]string{
+			criPodNamespaceLabelKey: namespace,
+			criPodLabelKey:          pod,
+			criContainerLabelKey:    container,
+		})
+	resp, err := ci.call("RuntimeService/ListContainers", new(pbMessage).msg(1, filter))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list containers: %s", err)
+	}
+	items, err := resp.msgs(1)
+	if err != nil {
+		return nil, err
+	} else if len(items) == 0 {
+		return nil, fmt.Errorf("No running container %s found in pod %s/%s", container, namespace, pod)
+	}
+
+	id, secs := items[0].str(1), int64((timeout+time.Second-1)/time.Second)
+	resp, err = ci.call("RuntimeService/ExecSync", new(pbMessage).str(1, id).strs(2, cmd).varint(3, uint64(secs)))
+	if err != nil {
+		return nil, fmt.Errorf("Could not exec in container %s: %s", id, err)
+	}
+	return &ExecResult{
+		Output:   criExecOutput(resp.str(1), resp.str(2)),
+		ExitCode: int(int32(resp.varint(3))),
+	}, nil
+}
+
+// InspectSelf extracts the configuration of the container we're running in
+func (ci *ContainerdInstaller) InspectSelf() (*SimpleContainerConfig, error) {
+	id, err := GetMyContainerID()
+	if err != nil {
+		logrus.WithError(err).Warn("Could not determine my container ID via cgroups - looking up via POD name")
+		if id, err = ci.findContainerByPod(os.Getenv("HOSTNAME")); err != nil {
+			return nil, fmt.Errorf("Could not determine my container ID: %s", err)
+		}
+	}
+	return ci.ExtractConfig(id)
+}
+
+// ExtractConfig extracts the containers configuration
+func (ci *ContainerdInstaller) ExtractConfig(id string) (*SimpleContainerConfig, error) {
+	resp, err := ci.call("RuntimeService/ContainerStatus", new(pbMessage).str(1, id).boolean(2, true))
+	if err != nil {
+		return nil, fmt.Errorf("Error inspecting container '%s': %s", id, err)
+	}
+	st, err := resp.msg(1)
+	if err != nil {
+		return nil, err
+	}
+	info, err := resp.strMap(2)
+	if err != nil {
+		return nil, err
+	}
+	var cinfo criContainerInfo
+	if js, has := info["info"]; has {
+		if err = json.Unmarshal([]byte(js), &cinfo); err != nil {
+			return nil, fmt.Errorf("Could not parse container '%s' info: %s", id, err)
+		}
+	} else {
+		logrus.Warnf("No verbose info for container '%s' - arguments/environment will be incomplete", id)
+	}
+	logrus.Debugf("CONFIG:%+v", cinfo)
+
+	scc := SimpleContainerConfig{}
+
+	// Copy arguments (note, as w/ Docker, skipping the entrypoint)
+	if pargs := cinfo.RuntimeSpec.Process.Args; len(pargs) > 0 {
+		scc.Args = make([]string, len(pargs)-1)
+		copy(scc.Args, pargs[1:])
+	} else {
+		scc.Args = make([]string, len(cinfo.Config.Args))
+		copy(scc.Args, cinfo.Config.Args)
+	}
+
+	// Copy mounts
+	mlist, err := st.msgs(14)
+	if err != nil {
+		return nil, err
+	}
+	mounts := make([]types.MountPoint, 0, len(mlist))
+	for _, m := range mlist {
+		mp := types.MountPoint{
+			Destination: m.str(1),
+			Source:      m.str(2),
+			RW:          m.varint(3) == 0,
+			Propagation: mount.PropagationRPrivate,
+		}
+		switch m.varint(5) {
+		case criPropagationHostToContainer:
+			mp.Propagation = mount.PropagationRSlave
+		case criPropagationBidirectional:
+			mp.Propagation = mount.PropagationRShared
+		}
+		mounts = append(mounts, mp)
+	}
+	hostsPath, resolvConfPath := "", ""
+	for _, m := range cinfo.RuntimeSpec.Mounts {
+		switch m.Destination {
+		case "/etc/hosts":
+			hostsPath = m.Source
+		case "/etc/resolv.conf":
+			resolvConfPath = m.Source
+		}
+	}
+	scc.Mounts = formatMountPoints(mounts, hostsPath, resolvConfPath)
+
+	// Copy ENV
+	if penv := cinfo.RuntimeSpec.Process.Env; len(penv) > 0 {
+		scc.Env = make([]string, len(penv))
+		copy(scc.Env, penv)
+	} else {
+		scc.Env = make([]string, 0, len(cinfo.Config.Envs))
+		for _, e := range cinfo.Config.Envs {
+			scc.Env = append(scc.Env, e.Key+"="+e.Value)
+		}
+	}
+
+	// Copy LABELS
+	if scc.Labels, err = st.strMap(12); err != nil {
+		return nil, err
+	}
+
+	return &scc, nil
+}
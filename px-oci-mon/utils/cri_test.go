@@ -0,0 +1,303 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeImageName = "portworx/px-enterprise:1.2.3"
+	fakeImageID   = "sha256:d70eeb70bebdfa02dcbbda0e9aee666f38c0cba2e5664f1bc4eb0eb560932e7a"
+	fakeDigest    = "sha256:4b8e0e9c6bbb6a3c2f0f6a3a1ad1e5fd1d5c4e3bdfa4c9d0c6e8b0a3b6f1c2d7"
+	fakeSelfInfo  = `{"config":{"args":["-c","cl1"]},
+"runtimeSpec":{"process":{"args":["/px-oci-mon","-c","cl1"],"env":["PATH=/bin","PX_TEST=1"]},
+"mounts":[{"destination":"/etc/resolv.conf","source":"/var/lib/containerd/sb1/resolv.conf"}]}}`
+)
+
+// fakeCriServer is a fake CRI runtime, serving a minimal subset of the CRI API over the UNIX socket
+type fakeCriServer struct {
+	api     string
+	lock    sync.Mutex
+	images  map[string]string
+	calls   []string
+	auth    pbFields
+	logDir  string
+	logPath string
+	command []string
+	args    []string
+	binds   []pbFields
+	timeout uint64
+	failOp  string
+}
+
+func (f *fakeCriServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	f.calls = append(f.calls, method)
+
+	body, _ := ioutil.ReadAll(r.Body)
+	req, err := pbDecode(body[5:])
+	if err != nil || !strings.HasPrefix(method, f.api+".") || method == f.api+"."+f.failOp {
+		// "trailers-only" response
+		w.Header().Set("Grpc-Status", "12")
+		w.Header().Set("Grpc-Message", "unknown%20service")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	resp := new(pbMessage)
+	switch method[len(f.api)+1:] {
+	case "RuntimeService/Version":
+		resp.str(1, criVersion).str(2, "fakerd").str(3, "1.0")
+	case "ImageService/ImageStatus":
+		spec, _ := req.msg(1)
+		if id, has := f.images[spec.str(1)]; has {
+			resp.msg(1, new(pbMessage).str(1, id).strs(3, []string{"docker.io/portworx/px-enterprise@" + fakeDigest}))
+		}
+	case "ImageService/PullImage":
+		spec, _ := req.msg(1)
+		f.auth, _ = req.msg(2)
+		f.images[spec.str(1)] = fakeImageID
+		resp.str(1, "docker.io/"+spec.str(1))
+	case "RuntimeService/RunPodSandbox":
+		conf, _ := req.msg(1)
+		f.logDir = conf.str(3)
+		resp.str(1, "sb1")
+	case "RuntimeService/CreateContainer":
+		conf, _ := req.msg(2)
+		f.command, f.args, f.logPath = conf.strs(3), conf.strs(4), conf.str(11)
+		f.binds, _ = conf.msgs(7)
+		resp.str(1, "c1")
+	case "RuntimeService/StartContainer":
+		ioutil.WriteFile(path.Join(f.logDir, f.logPath), []byte(
+			"2018-01-01T00:00:00Z stdout F Installing PX\n"+
+				"2018-01-01T00:00:01Z stderr F Modules require reboot now\n"), 0600)
+	case "RuntimeService/ListContainers":
+		filter, _ := req.msg(1)
+		labels, _ := filter.strMap(4)
+		if labels[criPodLabelKey] == "db-0" && labels[criPodNamespaceLabelKey] == "ns" &&
+			labels[criContainerLabelKey] == "db" {
+			resp.msg(1, new(pbMessage).str(1, "db1"))
+		}
+	case "RuntimeService/ExecSync":
+		f.command, f.timeout = req.strs(2), req.varint(3)
+		resp.str(1, "flushed\n").str(2, "slow disk\n").varint(3, 2)
+	case "RuntimeService/ContainerStatus":
+		switch req.str(1) {
+		case "c1":
+			resp.msg(1, new(pbMessage).str(1, "c1").varint(3, criStateExited))
+		case "self":
+			resp.msg(1, new(pbMessage).str(1, "self").
+				msg(14, new(pbMessage).str(1, "/etc/pwx").str(2, "/etc/pwx")).
+				msg(14, new(pbMessage).str(1, "/var/lib/osd").str(2, "/var/lib/osd").varint(5, criPropagationBidirectional)).
+				msg(14, new(pbMessage).str(1, "/etc/hosts").str(2, "/var/lib/kubelet/pods/123/etc-hosts").boolean(3, true)).
+				strMap(12, map[string]string{"name": "portworx"})).
+				strMap(2, map[string]string{"info": fakeSelfInfo})
+		}
+	}
+
+	w.Header().Set(httpHeaderContentType, grpcContentType)
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	data := make([]byte, 5, 5+len(resp.Bytes()))
+	binary.BigEndian.PutUint32(data[1:], uint32(len(resp.Bytes())))
+	w.Write(append(data, resp.Bytes()...))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func startFakeCriServer(t *testing.T, api string) (*fakeCriServer, string, func()) {
+	dir, err := ioutil.TempDir("", "fake-cri")
+	assert.NoError(t, err)
+	sock := path.Join(dir, "cri.sock")
+	l, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+
+	f := &fakeCriServer{api: api, images: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: f})
+		}
+	}()
+	return f, sock, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestContainerdInstallerVersion(t *testing.T) {
+	f, sock, cleanup := startFakeCriServer(t, criAPIv1alpha2)
+	defer cleanup()
+
+	// should fall back to v1alpha2 API
+	ci, err := NewContainerdInstaller(context.Background(), sock, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, criAPIv1alpha2, ci.api)
+	assert.Equal(t, []string{"runtime.v1.RuntimeService/Version", "runtime.v1alpha2.RuntimeService/Version"}, f.calls)
+
+	// unsupported API
+	f.api = "runtime.v2"
+	_, err = NewContainerdInstaller(context.Background(), sock, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown service")
+}
+
+func TestContainerdInstallerPull(t *testing.T) {
+	f, sock, cleanup := startFakeCriServer(t, criAPIv1)
+	defer cleanup()
+
+	ci, err := NewContainerdInstaller(context.Background(), sock, NewRegistryCredentials("", "user1", "pass1"))
+	assert.NoError(t, err)
+
+	_, err = ci.GetImageID(fakeImageName)
+	assert.Error(t, err)
+
+	downloads := 0
+	cb := func() error {
+		downloads++
+		return nil
+	}
+	assert.NoError(t, ci.PullImageCb(fakeImageName, cb))
+	assert.Equal(t, 1, downloads)
+	assert.Equal(t, "user1", f.auth.str(1))
+	assert.Equal(t, "pass1", f.auth.str(2))
+
+	id, err := ci.GetImageID(fakeImageName)
+	assert.NoError(t, err)
+	assert.Equal(t, fakeImageID, id)
+	digests, err := ci.GetRepoDigests(fakeImageName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/portworx/px-enterprise@" + fakeDigest}, digests)
+
+	// image present, and unchanged -- no download callback
+	assert.NoError(t, ci.PullImageCb(fakeImageName, cb))
+	assert.Equal(t, 1, downloads)
+}
+
+func TestContainerdInstallerRunOnce(t *testing.T) {
+	f, sock, cleanup := startFakeCriServer(t, criAPIv1)
+	defer cleanup()
+
+	ci, err := NewContainerdInstaller(context.Background(), sock, nil)
+	assert.NoError(t, err)
+	ci.LogDir = path.Join(path.Dir(sock), "logs")
+
+	var log []byte
+	err = ci.RunOnce(fakeImageName, "px-oci-installer", []string{"/opt/pwx/oci/inst-k8s:/opt/pwx", "/etc/pwx:/etc/pwx:ro"},
+		[]string{"/runc-entry-point.sh"}, []string{"--upgrade"}, func(b []byte, err error) {
+			assert.NoError(t, err)
+			log = b
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/runc-entry-point.sh"}, f.command)
+	assert.Equal(t, []string{"--upgrade"}, f.args)
+	assert.Equal(t, 2, len(f.binds))
+	assert.Equal(t, "/opt/pwx", f.binds[0].str(1))
+	assert.Equal(t, "/opt/pwx/oci/inst-k8s", f.binds[0].str(2))
+	assert.Equal(t, uint64(1), f.binds[1].varint(3))
+	assert.Equal(t, "> 2018-01-01T00:00:00Z Installing PX\nE 2018-01-01T00:00:01Z Modules require reboot now\n",
+		string(log))
+	assert.Contains(t, f.calls, "runtime.v1.RuntimeService/StopPodSandbox")
+	assert.NotContains(t, f.calls, "runtime.v1.RuntimeService/RemovePodSandbox")
+
+	// failed container start -- pod-sandbox removed
+	f.calls, f.failOp = nil, "RuntimeService/StartContainer"
+	err = ci.RunOnce(fakeImageName, "px-oci-installer", nil, nil, []string{"--upgrade"}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, f.calls, "runtime.v1.RuntimeService/RemovePodSandbox")
+}
+
+func TestContainerdInstallerExtractConfig(t *testing.T) {
+	_, sock, cleanup := startFakeCriServer(t, criAPIv1)
+	defer cleanup()
+
+	ci, err := NewContainerdInstaller(context.Background(), sock, nil)
+	assert.NoError(t, err)
+
+	scc, err := ci.ExtractConfig("self")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-c", "cl1"}, scc.Args)
+	assert.Equal(t, []string{"PATH=/bin", "PX_TEST=1"}, scc.Env)
+	assert.Equal(t, []string{
+		"/etc/pwx:/etc/pwx",
+		"/var/lib/osd:/var/lib/osd:rshared",
+		"/var/lib/kubelet/pods/123/etc-hosts:/etc/hosts:ro",
+		"/var/lib/containerd/sb1/resolv.conf:/etc/resolv.conf:ro",
+	}, scc.Mounts)
+	assert.Equal(t, map[string]string{"name": "portworx"}, scc.Labels)
+}
+
+func TestContainerdInstallerExecInPod(t *testing.T) {
+	f, sock, cleanup := startFakeCriServer(t, criAPIv1)
+	defer cleanup()
+
+	ci, err := NewContainerdInstaller(context.Background(), sock, nil)
+	assert.NoError(t, err)
+
+	res, err := ci.ExecInPod("ns", "db-0", "db", []string{"/bin/sh", "-c", "flush"}, 1500*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, &ExecResult{Output: "> flushed\nE slow disk\n", ExitCode: 2}, res)
+	assert.Equal(t, []string{"/bin/sh", "-c", "flush"}, f.command)
+	assert.Equal(t, uint64(2), f.timeout)
+
+	_, err = ci.ExecInPod("ns", "db-1", "db", []string{"true"}, time.Second)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "No running container db found in pod ns/db-1")
+}
+
+func TestContainerdInstallerImportExport(t *testing.T) {
+	_, sock, cleanup := startFakeCriServer(t, criAPIv1)
+	defer cleanup()
+	dir := path.Dir(sock)
+
+	// fake `ctr` CLI, storing the imported archive
+	err := ioutil.WriteFile(path.Join(dir, "ctr"), []byte(`#!/bin/sh
+case "$6" in
+import) cat > `+dir+`/imported.tar; echo "unpacking docker.io/portworx/px-enterprise:2.0 (sha256:abc)...done" ;;
+export) echo "exported $8" ;;
+*) echo "bad args: $@" >&2; exit 2 ;;
+esac
+`), 0755)
+	assert.NoError(t, err)
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir+":"+oldPath)
+
+	ci, err := NewContainerdInstaller(context.Background(), sock, nil)
+	assert.NoError(t, err)
+	ci.HostMountNs = ""
+
+	layout := path.Join(dir, "layout")
+	makeOciLayout(t, layout)
+	loaded, err := ci.ImportImage(layout)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/portworx/px-enterprise:2.0"}, loaded)
+	images, err := ReadImageArchive(path.Join(dir, "imported.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, testConfigDigest, images[0].ImageID)
+
+	_, err = ci.ImportImage(path.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	assert.NoError(t, ci.PullImageCb(fakeImageName, nil))
+	var out bytes.Buffer
+	assert.NoError(t, ci.ExportImage(fakeImageName, &out))
+	assert.Equal(t, "exported "+fakeImageName+"\n", out.String())
+}
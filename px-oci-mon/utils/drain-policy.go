@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// DrainAnnotation set to DrainNever on the pod excludes the pod from the drain
+	DrainAnnotation = "px/drain"
+	// DrainNever excludes the pod from the drain (see DrainAnnotation)
+	DrainNever = "never"
+	// DrainGracePeriodAnnotation overrides the pod's termination grace period during the drain (e.g. "2m")
+	DrainGracePeriodAnnotation = "px/drain-grace-period"
+	// DrainPolicyKey is the ConfigMap key holding the drain policy
+	DrainPolicyKey = "drain.json"
+)
+
+// DrainNamespaceRule excludes the namespace from the drain, or overrides the grace period of its pods.  The
+// namespace may end with "*" wildcard (e.g. "kube-*").
+type DrainNamespaceRule struct {
+	Namespace   string `json:"namespace"`
+	Exclude     bool   `json:"exclude,omitempty"`
+	GracePeriod string `json:"gracePeriod,omitempty"`
+	grace       *int64
+}
+
+// DrainPolicy configures the drain of the PX consumer pods
+type DrainPolicy struct {
+	// Timeout is the deadline for evicting all the pods (dfl. "5m")
+	Timeout string `json:"timeout,omitempty"`
+	// OnBlocked is the action when the pods could not be evicted by the deadline (see DrainBlockedAbort etc.)
+	OnBlocked string `json:"onBlocked,omitempty"`
+	// GracePeriod overrides the pods' termination grace period (dfl. pod's own)
+	GracePeriod string `json:"gracePeriod,omitempty"`
+	// Namespaces are the per-namespace rules (first matching rule wins)
+	Namespaces []DrainNamespaceRule `json:"namespaces,omitempty"`
+	// HookTimeout is the timeout of the pre/post-restart hooks (dfl. "1m", see PreRestartHookAnnotation)
+	HookTimeout string `json:"hookTimeout,omitempty"`
+	// OnHookFailure is the action when the pre-restart hook fails (dfl. HookFailureAbort)
+	OnHookFailure string `json:"onHookFailure,omitempty"`
+	timeout       time.Duration
+	grace         *int64
+	hookTimeout   time.Duration
+}
+
+// DefaultDrainPolicy returns the default drain policy
+func DefaultDrainPolicy() *DrainPolicy {
+	p := &DrainPolicy{Timeout: "5m", OnBlocked: DrainBlockedAbort, HookTimeout: "1m", OnHookFailure: HookFailureAbort}
+	p.init()
+	return p
+}
+
+// IsValidDrainBlockedAction returns TRUE if a given drain-blocked action is supported
+func IsValidDrainBlockedAction(a string) bool {
+	return a == DrainBlockedAbort || a == DrainBlockedWait || a == DrainBlockedForce
+}
+
+// parseGracePeriod parses the grace period (e.g. "30s") into seconds (nil if empty)
+func parseGracePeriod(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("Invalid grace period %q", s)
+	}
+	secs := int64(d / time.Second)
+	return &secs, nil
+}
+
+func (p *DrainPolicy) init() (err error) {
+	if p.timeout, err = time.ParseDuration(p.Timeout); err != nil || p.timeout <= 0 {
+		return fmt.Errorf("Invalid drain timeout %q", p.Timeout)
+	} else if !IsValidDrainBlockedAction(p.OnBlocked) {
+		return fmt.Errorf("Invalid drain-blocked action %q", p.OnBlocked)
+	} else if p.grace, err = parseGracePeriod(p.GracePeriod); err != nil {
+		return err
+	} else if p.hookTimeout, err = time.ParseDuration(p.HookTimeout); err != nil || p.hookTimeout <= 0 {
+		return fmt.Errorf("Invalid hook timeout %q", p.HookTimeout)
+	} else if p.OnHookFailure != HookFailureAbort && p.OnHookFailure != HookFailureContinue {
+		return fmt.Errorf("Invalid hook-failure action %q", p.OnHookFailure)
+	}
+	for i := range p.Namespaces {
+		r := &p.Namespaces[i]
+		if r.Namespace == "" {
+			return fmt.Errorf("Drain policy namespace rule #%d has no namespace", i+1)
+		} else if r.grace, err = parseGracePeriod(r.GracePeriod); err != nil {
+			return fmt.Errorf("Drain policy namespace rule #%d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// ParseDrainPolicy parses and validates the JSON-encoded drain policy (the missing entries are set to defaults)
+func ParseDrainPolicy(buf []byte) (*DrainPolicy, error) {
+	p := DefaultDrainPolicy()
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("Could not parse drain policy: %s", err)
+	} else if err = p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadDrainPolicy loads the drain policy from a given file, or ConfigMap (see ReadConfigSource())
+func LoadDrainPolicy(location string) (*DrainPolicy, error) {
+	buf, err := ReadConfigSource(location, DrainPolicyKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read drain policy: %s", err)
+	}
+	return ParseDrainPolicy(buf)
+}
+
+// SetTimeout overrides the drain timeout
+func (p *DrainPolicy) SetTimeout(d time.Duration) {
+	p.Timeout, p.timeout = d.String(), d
+}
+
+// ExcludeNamespaces adds the namespace exclusions, taking precedence over the existing rules
+func (p *DrainPolicy) ExcludeNamespaces(namespaces ...string) {
+	rules := make([]DrainNamespaceRule, 0, len(namespaces)+len(p.Namespaces))
+	for _, ns := range namespaces {
+		rules = append(rules, DrainNamespaceRule{Namespace: ns, Exclude: true})
+	}
+	p.Namespaces = append(rules, p.Namespaces...)
+}
+
+// classify returns the reason if the pod is excluded from the drain, and the pod's grace period (nil if not
+// overridden)
+func (p *DrainPolicy) classify(pod *v1.Pod) (string, *int64) {
+	ann := pod.GetAnnotations()
+	if ann[DrainAnnotation] == DrainNever {
+		return fmt.Sprintf("annotation %s=%s", DrainAnnotation, DrainNever), nil
+	}
+	grace := p.grace
+	for _, r := range p.Namespaces {
+		if !matchName(r.Namespace, pod.GetNamespace()) {
+			continue
+		} else if r.Exclude {
+			return fmt.Sprintf("namespace %s excluded", pod.GetNamespace()), nil
+		} else if r.grace != nil {
+			grace = r.grace
+		}
+		break
+	}
+	if v, has := ann[DrainGracePeriodAnnotation]; has {
+		if g, err := parseGracePeriod(v); err != nil {
+			logrus.WithError(err).Warnf("Ignoring annotation %s of pod %s/%s", DrainGracePeriodAnnotation,
+				pod.GetNamespace(), pod.GetName())
+		} else {
+			grace = g
+		}
+	}
+	return "", grace
+}
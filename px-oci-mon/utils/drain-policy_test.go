@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestParseDrainPolicy(t *testing.T) {
+	p, err := ParseDrainPolicy([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, p.timeout)
+	assert.Equal(t, DrainBlockedAbort, p.OnBlocked)
+	assert.Nil(t, p.grace)
+
+	p, err = ParseDrainPolicy([]byte(`{"timeout": "15m", "onBlocked": "force", "gracePeriod": "30s",
+		"namespaces": [{"namespace": "kube-*", "exclude": true}, {"namespace": "db", "gracePeriod": "5m"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, p.timeout)
+	assert.Equal(t, DrainBlockedForce, p.OnBlocked)
+	assert.Equal(t, int64(30), *p.grace)
+	assert.Len(t, p.Namespaces, 2)
+
+	for _, bad := range []string{
+		`{"timeout": "0s"}`,
+		`{"timeout": "soon"}`,
+		`{"onBlocked": "ignore"}`,
+		`{"gracePeriod": "-1s"}`,
+		`{"namespaces": [{"exclude": true}]}`,
+		`{"namespaces": [{"namespace": "db", "gracePeriod": "x"}]}`,
+		`[]`,
+	} {
+		_, err = ParseDrainPolicy([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestDrainPolicyClassify(t *testing.T) {
+	p, err := ParseDrainPolicy([]byte(`{"gracePeriod": "30s", "namespaces": [
+		{"namespace": "kube-*", "exclude": true}, {"namespace": "db", "gracePeriod": "5m"}]}`))
+	assert.NoError(t, err)
+	p.ExcludeNamespaces("db")
+
+	pod := func(ns string, ann map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "p", Namespace: ns, Annotations: ann}}
+	}
+	data := []struct {
+		pod    *v1.Pod
+		reason string
+		grace  int64
+	}{
+		{pod("default", nil), "", 30},
+		{pod("default", map[string]string{DrainAnnotation: DrainNever}), "annotation px/drain=never", -1},
+		{pod("default", map[string]string{DrainAnnotation: "always"}), "", 30},
+		{pod("default", map[string]string{DrainGracePeriodAnnotation: "1m"}), "", 60},
+		{pod("default", map[string]string{DrainGracePeriodAnnotation: "bogus"}), "", 30},
+		{pod("kube-system", nil), "namespace kube-system excluded", -1},
+		{pod("db", nil), "namespace db excluded", -1},
+	}
+	for i, d := range data {
+		reason, grace := p.classify(d.pod)
+		assert.Equal(t, d.reason, reason, "case #%d", i+1)
+		if d.grace < 0 {
+			assert.Nil(t, grace, "case #%d", i+1)
+		} else if assert.NotNil(t, grace, "case #%d", i+1) {
+			assert.Equal(t, d.grace, *grace, "case #%d", i+1)
+		}
+	}
+
+	// per-namespace grace period
+	p.Namespaces = p.Namespaces[1:]
+	_, grace := p.classify(pod("db", nil))
+	assert.Equal(t, int64(300), *grace)
+}
@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Actions when the PodDisruptionBudgets block the drain past the deadline
+const (
+	// DrainBlockedAbort aborts the drain (and the upgrade), and uncordons the node
+	DrainBlockedAbort = "abort"
+	// DrainBlockedWait keeps retrying the evictions until the PodDisruptionBudgets allow them
+	DrainBlockedWait = "wait"
+	// DrainBlockedForce deletes the remaining pods, bypassing the PodDisruptionBudgets
+	DrainBlockedForce = "force"
+)
+
+// Outcomes of the pod drain
+const (
+	PodDrainPending       = "pending"
+	PodDrainBlocked       = "blocked"
+	PodDrainRetrying      = "retrying"
+	PodDrainEvicting      = "evicting"
+	PodDrainEvicted       = "evicted"
+	PodDrainGone          = "gone"
+	PodDrainForceDeleting = "force-deleting"
+	PodDrainForceDeleted  = "force-deleted"
+	PodDrainSkipped       = "skipped"
+)
+
+const (
+	drainPollInterval = 2 * time.Second
+	evictBackoffMin   = 2 * time.Second
+	evictBackoffMax   = 30 * time.Second
+	forceDeleteWait   = 2 * time.Minute
+)
+
+// PodDrainResult is the outcome of the drain of the single pod
+type PodDrainResult struct {
+	Namespace   string    `json:"namespace"`
+	Name        string    `json:"name"`
+	Outcome     string    `json:"outcome"`
+	Attempts    int       `json:"attempts"`
+	Detection   string    `json:"detection,omitempty"`
+	GracePeriod *int64    `json:"gracePeriodSeconds,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	uid         types.UID // to detect the pod got replaced (e.g. StatefulSet)
+	after       *PodDrainResult
+	nextAttempt time.Time
+	backoff     time.Duration
+}
+
+func (r *PodDrainResult) String() string {
+	return r.Namespace + "/" + r.Name
+}
+
+// IsDone returns TRUE if the pod is no longer running on the node
+func (r *PodDrainResult) IsDone() bool {
+	return r.Outcome == PodDrainEvicted || r.Outcome == PodDrainGone || r.Outcome == PodDrainForceDeleted ||
+		r.Outcome == PodDrainSkipped
+}
+
+// DrainReport reports the per-pod outcome of the drain
+type DrainReport struct {
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	OnBlocked string            `json:"onBlocked"`
+	Pods      []*PodDrainResult `json:"pods"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// Summary returns the pod counts per outcome (e.g. "evicted=3, blocked=1")
+func (r *DrainReport) Summary() string {
+	counts := make(map[string]int)
+	for _, p := range r.Pods {
+		counts[p.Outcome]++
+	}
+	parts := make([]string, 0, len(counts))
+	for k, v := range counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, v))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// DrainBlockedError is returned when the drain got aborted because the pods could not be evicted by the deadline
+type DrainBlockedError struct {
+	Pods []string
+}
+
+func (e *DrainBlockedError) Error() string {
+	return fmt.Sprintf("Drain blocked past deadline (see PodDisruptionBudgets) by pods %s", strings.Join(e.Pods, ", "))
+}
+
+// podEvictor is the subset of the Kubernetes Pods API used by the drainer
+type podEvictor interface {
+	Get(name string, options meta_v1.GetOptions) (*v1.Pod, error)
+	Delete(name string, options *meta_v1.DeleteOptions) error
+	Evict(eviction *policy.Eviction) error
+}
+
+// drainer evicts the pods via Eviction API (honoring the PodDisruptionBudgets)
+type drainer struct {
+	policy                 *DrainPolicy
+	pods                   func(namespace string) podEvictor
+	poll                   time.Duration
+	backoffMin, backoffMax time.Duration
+	forceWait              time.Duration
+}
+
+func newDrainer(policy *DrainPolicy) (*drainer, error) {
+	cli, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	return &drainer{
+		policy:     policy,
+		pods:       func(ns string) podEvictor { return cli.CoreV1().Pods(ns) },
+		poll:       drainPollInterval,
+		backoffMin: evictBackoffMin,
+		backoffMax: evictBackoffMax,
+		forceWait:  forceDeleteWait,
+	}, nil
+}
+
+// evict attempts to evict the pod, and updates the pod's outcome
+func (d *drainer) evict(r *PodDrainResult, now time.Time) {
+	r.Attempts++
+	err := d.pods(r.Namespace).Evict(&policy.Eviction{
+		ObjectMeta:    meta_v1.ObjectMeta{Name: r.Name, Namespace: r.Namespace},
+		DeleteOptions: &meta_v1.DeleteOptions{GracePeriodSeconds: r.GracePeriod},
+	})
+	if err == nil {
+		logrus.Infof("Evicting pod %s", r)
+		r.Outcome, r.LastError = PodDrainEvicting, ""
+		return
+	} else if k8s_errors.IsNotFound(err) {
+		logrus.Infof("Pod %s already gone", r)
+		r.Outcome, r.LastError = PodDrainGone, ""
+		return
+	}
+
+	if k8s_errors.IsTooManyRequests(err) {
+		// eviction refused due to the PodDisruptionBudget
+		if r.Outcome != PodDrainBlocked {
+			logrus.WithError(err).Warnf("Eviction of pod %s blocked (will retry)", r)
+		}
+		r.Outcome = PodDrainBlocked
+	} else {
+		logrus.WithError(err).Warnf("Could not evict pod %s (will retry)", r)
+		r.Outcome = PodDrainRetrying
+	}
+	r.LastError = err.Error()
+	if r.backoff *= 2; r.backoff < d.backoffMin {
+		r.backoff = d.backoffMin
+	} else if r.backoff > d.backoffMax {
+		r.backoff = d.backoffMax
+	}
+	r.nextAttempt = now.Add(r.backoff)
+}
+
+// checkDeleted checks if the evicted pod got deleted
+func (d *drainer) checkDeleted(r *PodDrainResult) {
+	p, err := d.pods(r.Namespace).Get(r.Name, meta_v1.GetOptions{})
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		logrus.WithError(err).Warnf("Could not get pod %s", r)
+		return
+	} else if err == nil && p.GetUID() == r.uid {
+		return
+	}
+	if r.Outcome == PodDrainForceDeleting {
+		r.Outcome = PodDrainForceDeleted
+	} else {
+		r.Outcome = PodDrainEvicted
+	}
+	logrus.Infof("Pod %s %s", r, r.Outcome)
+}
+
+// forceDelete deletes the pod, bypassing the PodDisruptionBudgets
+func (d *drainer) forceDelete(r *PodDrainResult) {
+	logrus.Warnf("Force-deleting pod %s (%s)", r, r.Outcome)
+	opts := &meta_v1.DeleteOptions{GracePeriodSeconds: r.GracePeriod}
+	if r.uid != "" {
+		// do not delete the replacement pod (e.g. StatefulSet)
+		opts.Preconditions = &meta_v1.Preconditions{UID: &r.uid}
+	}
+	err := d.pods(r.Namespace).Delete(r.Name, opts)
+	if err == nil || k8s_errors.IsNotFound(err) || k8s_errors.IsConflict(err) {
+		r.Outcome = PodDrainForceDeleting
+	} else {
+		logrus.WithError(err).Errorf("Could not delete pod %s", r)
+		r.LastError = err.Error()
+	}
+}
+
+// statefulSetOrdinal returns the StatefulSet owning the pod, and the pod's ordinal (empty if not StatefulSet pod)
+func statefulSetOrdinal(p *v1.Pod) (string, int) {
+	for _, o := range p.GetOwnerReferences() {
+		if o.Kind != "StatefulSet" || !strings.HasPrefix(p.GetName(), o.Name+"-") {
+			continue
+		} else if ord, err := strconv.Atoi(p.GetName()[len(o.Name)+1:]); err == nil {
+			return p.GetNamespace() + "/" + o.Name, ord
+		}
+	}
+	return "", 0
+}
+
+// orderStatefulSets makes the StatefulSet pods evict in the reverse ordinal order (i.e. each pod waits for the
+// pod with the next higher ordinal)
+func orderStatefulSets(pods []PxConsumer, results []*PodDrainResult) {
+	type stsPod struct {
+		ord int
+		r   *PodDrainResult
+	}
+	sets := make(map[string][]stsPod)
+	for i := range pods {
+		if results[i].IsDone() {
+			continue
+		} else if sts, ord := statefulSetOrdinal(&pods[i].Pod); sts != "" {
+			sets[sts] = append(sets[sts], stsPod{ord, results[i]})
+		}
+	}
+	for _, sp := range sets {
+		sort.Slice(sp, func(i, j int) bool { return sp[i].ord > sp[j].ord })
+		for i := 1; i < len(sp); i++ {
+			sp[i].r.after = sp[i-1].r
+		}
+	}
+}
+
+// drain evicts the pods (except the ones excluded by the policy), and waits until they are deleted.  Returns the
+// per-pod report, and an error if the drain did not complete.
+func (d *drainer) drain(ctx context.Context, pods []PxConsumer) (*DrainReport, error) {
+	rep := &DrainReport{Started: time.Now(), OnBlocked: d.policy.OnBlocked, Pods: make([]*PodDrainResult, 0, len(pods))}
+	for i := range pods {
+		p := &pods[i].Pod
+		r := &PodDrainResult{
+			Namespace: p.GetNamespace(),
+			Name:      p.GetName(),
+			Outcome:   PodDrainPending,
+			Detection: pods[i].Detection,
+			uid:       p.GetUID(),
+		}
+		if r.Reason, r.GracePeriod = d.policy.classify(p); r.Reason != "" {
+			logrus.Infof("Skipping drain of pod %s (%s)", r, r.Reason)
+			r.Outcome = PodDrainSkipped
+		}
+		rep.Pods = append(rep.Pods, r)
+	}
+	orderStatefulSets(pods, rep.Pods)
+
+	err := d.run(ctx, rep)
+	rep.Finished = time.Now()
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	for _, r := range rep.Pods {
+		logrus.WithField("attempts", r.Attempts).Infof("Drain of pod %s: %s", r, r.Outcome)
+	}
+	return rep, err
+}
+
+func (d *drainer) run(ctx context.Context, rep *DrainReport) error {
+	deadline := rep.Started.Add(d.policy.timeout)
+	var forceDeadline time.Time
+	waiting := false
+	for {
+		now := time.Now()
+		remaining := make([]string, 0, len(rep.Pods))
+		for _, r := range rep.Pods {
+			switch r.Outcome {
+			case PodDrainPending, PodDrainBlocked, PodDrainRetrying:
+				if r.after != nil && !r.after.IsDone() {
+					// StatefulSet pods evict in the reverse ordinal order
+				} else if !forceDeadline.IsZero() {
+					d.forceDelete(r)
+				} else if !now.Before(r.nextAttempt) {
+					d.evict(r, now)
+				}
+			case PodDrainEvicting, PodDrainForceDeleting:
+				d.checkDeleted(r)
+			}
+			if !r.IsDone() {
+				remaining = append(remaining, fmt.Sprintf("%s (%s)", r, r.Outcome))
+			}
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+
+		if !forceDeadline.IsZero() {
+			if now.After(forceDeadline) {
+				return fmt.Errorf("Timeout waiting for deletion of pods %s", strings.Join(remaining, ", "))
+			}
+		} else if now.After(deadline) {
+			switch d.policy.OnBlocked {
+			case DrainBlockedWait:
+				if !waiting {
+					logrus.Warnf("Drain blocked past deadline by pods %s - waiting", strings.Join(remaining, ", "))
+					waiting = true
+				}
+			case DrainBlockedForce:
+				logrus.Warnf("Drain blocked past deadline by pods %s - forcing", strings.Join(remaining, ", "))
+				forceDeadline = now.Add(d.forceWait)
+				continue
+			default:
+				return &DrainBlockedError{Pods: remaining}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Drain interrupted: %s", ctx.Err())
+		case <-time.After(d.poll):
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var podResource = schema.GroupResource{Resource: "pods"}
+
+// fakePods is the in-memory pod store, where the evictions are refused while the pod's PDB budget is exhausted
+type fakePods struct {
+	sync.Mutex
+	pods    map[string]*v1.Pod
+	blocked map[string]int // number of evictions to refuse (<0 refuses forever)
+	evicted []string
+	graces  map[string]int64
+	deletes []string
+}
+
+func newFakePods(blocked map[string]int, names ...string) *fakePods {
+	f := &fakePods{pods: make(map[string]*v1.Pod), blocked: blocked, graces: make(map[string]int64)}
+	for _, n := range names {
+		f.pods[n] = &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: n, Namespace: "ns", UID: types.UID("uid-" + n)}}
+	}
+	return f
+}
+
+func (f *fakePods) Get(name string, options meta_v1.GetOptions) (*v1.Pod, error) {
+	f.Lock()
+	defer f.Unlock()
+	p, has := f.pods[name]
+	if !has {
+		return nil, k8s_errors.NewNotFound(podResource, name)
+	}
+	return p.DeepCopy(), nil
+}
+
+func (f *fakePods) Delete(name string, options *meta_v1.DeleteOptions) error {
+	f.Lock()
+	defer f.Unlock()
+	f.deletes = append(f.deletes, name)
+	if _, has := f.pods[name]; !has {
+		return k8s_errors.NewNotFound(podResource, name)
+	}
+	delete(f.pods, name)
+	return nil
+}
+
+func (f *fakePods) Evict(eviction *policy.Eviction) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, has := f.pods[eviction.Name]; !has {
+		return k8s_errors.NewNotFound(podResource, eviction.Name)
+	} else if n := f.blocked[eviction.Name]; n != 0 {
+		f.blocked[eviction.Name] = n - 1
+		return k8s_errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	}
+	delete(f.pods, eviction.Name)
+	f.evicted = append(f.evicted, eviction.Name)
+	if g := eviction.DeleteOptions.GracePeriodSeconds; g != nil {
+		f.graces[eviction.Name] = *g
+	}
+	return nil
+}
+
+func (f *fakePods) list() []PxConsumer {
+	f.Lock()
+	defer f.Unlock()
+	names := make([]string, 0, len(f.pods))
+	for n := range f.pods {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	ret := make([]PxConsumer, 0, len(names))
+	for _, n := range names {
+		ret = append(ret, PxConsumer{Pod: *f.pods[n], Detection: DetectPVCSI})
+	}
+	return ret
+}
+
+func newTestDrainer(f *fakePods, onBlocked string) *drainer {
+	pol := DefaultDrainPolicy()
+	pol.SetTimeout(100 * time.Millisecond)
+	pol.OnBlocked = onBlocked
+	return &drainer{
+		policy:     pol,
+		pods:       func(string) podEvictor { return f },
+		poll:       time.Millisecond,
+		backoffMin: time.Millisecond,
+		backoffMax: 4 * time.Millisecond,
+		forceWait:  time.Second,
+	}
+}
+
+func TestDrainEvicts(t *testing.T) {
+	f := newFakePods(map[string]int{"b": 2}, "a", "b")
+	pods := f.list()
+	pods = append(pods, PxConsumer{Pod: v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "c", Namespace: "ns"}}})
+
+	rep, err := newTestDrainer(f, DrainBlockedAbort).drain(context.Background(), pods)
+	assert.NoError(t, err)
+	assert.Len(t, rep.Pods, 3)
+	assert.Equal(t, PodDrainEvicted, rep.Pods[0].Outcome)
+	assert.Equal(t, 1, rep.Pods[0].Attempts)
+	assert.Equal(t, PodDrainEvicted, rep.Pods[1].Outcome)
+	assert.Equal(t, 3, rep.Pods[1].Attempts)
+	assert.Equal(t, PodDrainGone, rep.Pods[2].Outcome)
+	assert.Equal(t, DetectPVCSI, rep.Pods[0].Detection)
+	assert.Equal(t, "evicted=2, gone=1", rep.Summary())
+	assert.Empty(t, f.deletes)
+	assert.Empty(t, rep.Error)
+}
+
+func TestDrainBlockedAbort(t *testing.T) {
+	f := newFakePods(map[string]int{"b": -1}, "a", "b")
+	rep, err := newTestDrainer(f, DrainBlockedAbort).drain(context.Background(), f.list())
+	assert.Error(t, err)
+	assert.IsType(t, &DrainBlockedError{}, err)
+	assert.Equal(t, []string{"ns/b (blocked)"}, err.(*DrainBlockedError).Pods)
+	assert.Equal(t, PodDrainEvicted, rep.Pods[0].Outcome)
+	assert.Equal(t, PodDrainBlocked, rep.Pods[1].Outcome)
+	assert.True(t, rep.Pods[1].Attempts > 1)
+	assert.Contains(t, rep.Pods[1].LastError, "disruption budget")
+	assert.Equal(t, err.Error(), rep.Error)
+	assert.Empty(t, f.deletes)
+}
+
+func TestDrainBlockedForce(t *testing.T) {
+	f := newFakePods(map[string]int{"b": -1}, "a", "b")
+	rep, err := newTestDrainer(f, DrainBlockedForce).drain(context.Background(), f.list())
+	assert.NoError(t, err)
+	assert.Equal(t, PodDrainEvicted, rep.Pods[0].Outcome)
+	assert.Equal(t, PodDrainForceDeleted, rep.Pods[1].Outcome)
+	assert.Equal(t, []string{"b"}, f.deletes)
+}
+
+func TestDrainBlockedWait(t *testing.T) {
+	f := newFakePods(map[string]int{"b": -1}, "a", "b")
+	d := newTestDrainer(f, DrainBlockedWait)
+
+	// unblock the PDB well past the deadline
+	go func() {
+		time.Sleep(3 * d.policy.timeout)
+		f.Lock()
+		f.blocked["b"] = 0
+		f.Unlock()
+	}()
+	rep, err := d.drain(context.Background(), f.list())
+	assert.NoError(t, err)
+	assert.Equal(t, PodDrainEvicted, rep.Pods[1].Outcome)
+	assert.True(t, rep.Finished.Sub(rep.Started) >= 3*d.policy.timeout)
+	assert.Empty(t, f.deletes)
+
+	// interrupted wait
+	f = newFakePods(map[string]int{"b": -1}, "a", "b")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*d.policy.timeout)
+	defer cancel()
+	_, err = newTestDrainer(f, DrainBlockedWait).drain(ctx, f.list())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "interrupted")
+}
+
+func TestDrainPolicyApplied(t *testing.T) {
+	f := newFakePods(nil, "a", "b", "c", "web-0", "web-1", "web-2")
+	for _, n := range []string{"web-0", "web-1", "web-2"} {
+		f.pods[n].OwnerReferences = []meta_v1.OwnerReference{{Kind: "StatefulSet", Name: "web"}}
+	}
+	f.pods["a"].Annotations = map[string]string{DrainAnnotation: DrainNever}
+	f.pods["b"].Annotations = map[string]string{DrainGracePeriodAnnotation: "2m"}
+	d := newTestDrainer(f, DrainBlockedAbort)
+	d.policy.GracePeriod = "10s"
+	assert.NoError(t, d.policy.init())
+
+	rep, err := d.drain(context.Background(), f.list())
+	assert.NoError(t, err)
+	assert.Equal(t, "evicted=5, skipped=1", rep.Summary())
+	assert.Equal(t, PodDrainSkipped, rep.Pods[0].Outcome)
+	assert.Equal(t, "annotation px/drain=never", rep.Pods[0].Reason)
+	assert.Equal(t, []string{"b", "c", "web-2", "web-1", "web-0"}, f.evicted)
+	assert.Equal(t, int64(120), f.graces["b"])
+	assert.Equal(t, int64(10), f.graces["c"])
+	assert.Equal(t, int64(10), *rep.Pods[2].GracePeriod)
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	eventSourceComponent = "px-oci-mon"
+	// eventDedupInterval suppresses repeated identical events (e.g. failed service-requests retried on every watch)
+	eventDedupInterval  = 5 * time.Minute
+	eventDedupMax       = 100
+	defaultPodNamespace = "kube-system"
+	podSelector         = "name=portworx"
+)
+
+// Event reasons, recorded against the Node and the px-oci-mon Pod
+const (
+	EventInstallPlanned         = "PxInstallPlanned"
+	EventInstallUpToDate        = "PxInstallUpToDate"
+	EventInstallCompleted       = "PxInstallCompleted"
+	EventInstallFailed          = "PxInstallFailed"
+	EventInstallInterrupted     = "PxInstallInterrupted"
+	EventInstallDeferred        = "PxInstallDeferred"
+	EventMaintenanceInvalid     = "PxMaintenanceWindowsInvalid"
+	EventUpgradeLockWaiting     = "PxUpgradeLockWaiting"
+	EventQuorumWaiting          = "PxQuorumWaiting"
+	EventImagePulled            = "PxImagePulled"
+	EventImageUntrusted         = "PxImageUntrusted"
+	EventImageImported          = "PxImageImported"
+	EventRuncOutputUnrecognized = "PxRuncOutputUnrecognized"
+	EventRestartPolicyInvalid   = "PxRestartPolicyInvalid"
+	EventDrainStarted           = "PxDrainStarted"
+	EventDrainCompleted         = "PxDrainCompleted"
+	EventDrainFailed            = "PxDrainFailed"
+	EventDrainBlocked           = "PxDrainBlocked"
+	EventDrainPolicyInvalid     = "PxDrainPolicyInvalid"
+	EventHookFailed             = "PxHookFailed"
+	EventHooksCompleted         = "PxHooksCompleted"
+	EventUncordoned             = "PxNodeUncordoned"
+	EventUncordonFailed         = "PxNodeUncordonFailed"
+	EventOciSwitched            = "PxOciSwitched"
+	EventSwitchRecovered        = "PxOciSwitchRecovered"
+	EventServiceRestarted       = "PxServiceRestarted"
+	EventServiceRestartFailed   = "PxServiceRestartFailed"
+	EventUpgradeRolledBack      = "PxUpgradeRolledBack"
+	EventRollbackCompleted      = "PxRolledBack"
+	EventRollbackFailed         = "PxRollbackFailed"
+	EventUninstallStarted       = "PxUninstallStarted"
+	EventUninstallCompleted     = "PxUninstallCompleted"
+	EventUninstallFailed        = "PxUninstallFailed"
+	EventEnableRequested        = "PxEnableRequested"
+	EventDisableRequested       = "PxDisableRequested"
+	EventServiceRequest         = "PxServiceRequest"
+	EventServiceRequestFailed   = "PxServiceRequestFailed"
+)
+
+var (
+	myPod      *v1.Pod
+	myPodOnce  sync.Once
+	eventsLock sync.Mutex
+	lastEvents = make(map[string]time.Time)
+)
+
+// findMyPod locates the px-oci-mon Pod running on a given node.
+// The POD_NAME and POD_NAMESPACE environment variables (i.e. Downward API) are used if set, otherwise the Pod
+// is looked up via the DaemonSet's labels.
+func findMyPod(n *v1.Node) *v1.Pod {
+	myPodOnce.Do(func() {
+		cli, err := getK8sClient()
+		if err != nil {
+			return
+		}
+		ns := os.Getenv("POD_NAMESPACE")
+		if ns == "" {
+			ns = defaultPodNamespace
+		}
+		if name := os.Getenv("POD_NAME"); name != "" {
+			if myPod, err = cli.CoreV1().Pods(ns).Get(name, meta_v1.GetOptions{}); err != nil {
+				logrus.WithError(err).Warnf("Could not find pod %s/%s", ns, name)
+				myPod = nil
+			}
+			return
+		}
+		pods, err := cli.CoreV1().Pods(ns).List(meta_v1.ListOptions{
+			LabelSelector: podSelector,
+			FieldSelector: "spec.nodeName=" + n.GetName(),
+		})
+		if err != nil {
+			logrus.WithError(err).Warn("Could not find px-oci-mon pod")
+		} else if len(pods.Items) != 1 {
+			logrus.Warnf("Could not find px-oci-mon pod (found %d pods w/ %s on %s)",
+				len(pods.Items), podSelector, n.GetName())
+		} else {
+			myPod = &pods.Items[0]
+		}
+	})
+	return myPod
+}
+
+// isDuplicateEvent returns TRUE if identical event was recently recorded
+func isDuplicateEvent(key string) bool {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	now := time.Now()
+	if last, has := lastEvents[key]; has && now.Sub(last) < eventDedupInterval {
+		return true
+	}
+	if len(lastEvents) >= eventDedupMax {
+		lastEvents = make(map[string]time.Time)
+	}
+	lastEvents[key] = now
+	return false
+}
+
+// RecordEvent records the Kubernetes Event against the Node object, and the px-oci-mon Pod.
+// Errors are logged, but otherwise ignored.
+func RecordEvent(n *v1.Node, eventType, reason, format string, args ...interface{}) {
+	if n == nil {
+		logrus.Warnf("Could not record event %s: node not known", reason)
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if isDuplicateEvent(eventType + "/" + reason + "/" + msg) {
+		logrus.Debugf("Skipping duplicate event %s: %s", reason, msg)
+		return
+	}
+
+	objs := []v1.ObjectReference{{
+		Kind: "Node",
+		Name: n.GetName(),
+		// note: Node events use node-name as UID (as does kubelet)
+		UID: types.UID(n.GetName()),
+	}}
+	if p := findMyPod(n); p != nil {
+		objs = append(objs, v1.ObjectReference{
+			Kind:       "Pod",
+			Namespace:  p.GetNamespace(),
+			Name:       p.GetName(),
+			UID:        p.GetUID(),
+			APIVersion: "v1",
+		})
+	}
+
+	cli, err := getK8sClient()
+	if err != nil {
+		logrus.WithError(err).Warnf("Could not record event %s", reason)
+		return
+	}
+	now := meta_v1.Now()
+	for _, obj := range objs {
+		ns := obj.Namespace
+		if ns == "" {
+			ns = meta_v1.NamespaceDefault
+		}
+		ev := &v1.Event{
+			ObjectMeta: meta_v1.ObjectMeta{
+				GenerateName: obj.Name + ".",
+				Namespace:    ns,
+			},
+			InvolvedObject: obj,
+			Reason:         reason,
+			Message:        msg,
+			Type:           eventType,
+			Source:         v1.EventSource{Component: eventSourceComponent, Host: n.GetName()},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          1,
+		}
+		if _, err = cli.CoreV1().Events(ns).Create(ev); err != nil {
+			logrus.WithError(err).Warnf("Could not record %s event %s", obj.Kind, reason)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+)
+
+const (
+	grpcContentType       = "application/grpc"
+	grpcStatusOK          = 0
+	grpcStatusUnimplement = 12
+	grpcDialTimeout       = 10 * time.Second
+)
+
+// grpcError is the error returned by the gRPC server
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", e.code, e.msg)
+}
+
+// isGrpcUnimplemented returns TRUE if the error reports unimplemented gRPC service or method
+func isGrpcUnimplemented(err error) bool {
+	ge, ok := err.(*grpcError)
+	return ok && ge.code == grpcStatusUnimplement
+}
+
+// grpcClient is a minimal unary-call gRPC client, talking over the UNIX socket.
+// NOTE: the full gRPC stack is not required for the handful of unary calls we issue (e.g. CRI API).
+type grpcClient struct {
+	cli *http.Client
+}
+
+// newGrpcClient creates a gRPC client for the given UNIX socket
+func newGrpcClient(socket string) *grpcClient {
+	return &grpcClient{
+		cli: &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.DialTimeout("unix", socket, grpcDialTimeout)
+				},
+			},
+		},
+	}
+}
+
+// invoke calls the unary gRPC method (e.g. "/runtime.v1.ImageService/PullImage") w/ given protobuf-encoded request,
+// and returns the protobuf-encoded response.
+func (c *grpcClient) invoke(ctx context.Context, method string, req []byte) ([]byte, error) {
+	body := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	body = append(body, req...)
+
+	hreq, err := http.NewRequest(http.MethodPost, "http://localhost"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq = hreq.WithContext(ctx)
+	hreq.Header.Set(httpHeaderContentType, grpcContentType)
+	hreq.Header.Set("Te", "trailers")
+
+	resp, err := c.cli.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s response: %s", method, err)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status %s for %s", resp.Status, method)
+	}
+
+	// note: status is sent via trailers, or via headers for "trailers-only" responses
+	st := resp.Trailer.Get("Grpc-Status")
+	msg := resp.Trailer.Get("Grpc-Message")
+	if st == "" {
+		st, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code, err := strconv.Atoi(st); err != nil {
+		return nil, fmt.Errorf("Invalid gRPC status %q for %s", st, method)
+	} else if code != grpcStatusOK {
+		if m, err := url.PathUnescape(msg); err == nil {
+			msg = m
+		}
+		return nil, &grpcError{code, msg}
+	}
+
+	if len(data) < 5 {
+		return nil, fmt.Errorf("Short gRPC response for %s", method)
+	} else if data[0] != 0 {
+		return nil, fmt.Errorf("Compressed gRPC response for %s not supported", method)
+	}
+	msgLen := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < msgLen {
+		return nil, fmt.Errorf("Truncated gRPC response for %s", method)
+	}
+	return data[5 : 5+msgLen], nil
+}
+
+// Protobuf encoding/decoding helpers --
+
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbMessage is a simple builder of protobuf-encoded messages
+type pbMessage struct {
+	proto.Buffer
+}
+
+func (m *pbMessage) tag(field, wire int) {
+	m.EncodeVarint(uint64(field<<3 | wire))
+}
+
+func (m *pbMessage) str(field int, s string) *pbMessage {
+	if s != "" {
+		m.tag(field, pbBytes)
+		m.EncodeStringBytes(s)
+	}
+	return m
+}
+
+func (m *pbMessage) strs(field int, l []string) *pbMessage {
+	for _, s := range l {
+		m.tag(field, pbBytes)
+		m.EncodeStringBytes(s)
+	}
+	return m
+}
+
+func (m *pbMessage) varint(field int, v uint64) *pbMessage {
+	if v != 0 {
+		m.tag(field, pbVarint)
+		m.EncodeVarint(v)
+	}
+	return m
+}
+
+func (m *pbMessage) boolean(field int, b bool) *pbMessage {
+	if b {
+		m.varint(field, 1)
+	}
+	return m
+}
+
+func (m *pbMessage) msg(field int, sub *pbMessage) *pbMessage {
+	if sub != nil {
+		m.tag(field, pbBytes)
+		m.EncodeRawBytes(sub.Bytes())
+	}
+	return m
+}
+
+func (m *pbMessage) strMap(field int, kv map[string]string) *pbMessage {
+	for k, v := range kv {
+		m.msg(field, new(pbMessage).str(1, k).str(2, v))
+	}
+	return m
+}
+
+// pbField is a decoded protobuf field
+type pbField struct {
+	num  int
+	val  uint64
+	data []byte
+}
+
+// pbFields is a decoded protobuf message
+type pbFields []pbField
+
+// pbDecode decodes the protobuf message into list of fields (nested messages are decoded on-demand)
+func pbDecode(buf []byte) (pbFields, error) {
+	ret := make(pbFields, 0, 8)
+	for len(buf) > 0 {
+		tag, n := proto.DecodeVarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("Could not decode protobuf tag")
+		}
+		buf = buf[n:]
+		f := pbField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case pbVarint:
+			if f.val, n = proto.DecodeVarint(buf); n <= 0 {
+				return nil, fmt.Errorf("Could not decode protobuf varint field %d", f.num)
+			}
+		case pbFixed64:
+			if n = 8; len(buf) < n {
+				return nil, fmt.Errorf("Could not decode protobuf fixed64 field %d", f.num)
+			}
+			f.val = binary.LittleEndian.Uint64(buf)
+		case pbFixed32:
+			if n = 4; len(buf) < n {
+				return nil, fmt.Errorf("Could not decode protobuf fixed32 field %d", f.num)
+			}
+			f.val = uint64(binary.LittleEndian.Uint32(buf))
+		case pbBytes:
+			sz, m := proto.DecodeVarint(buf)
+			if m <= 0 || uint64(len(buf)-m) < sz {
+				return nil, fmt.Errorf("Could not decode protobuf bytes field %d", f.num)
+			}
+			f.data, n = buf[m:m+int(sz)], m+int(sz)
+		default:
+			return nil, fmt.Errorf("Unsupported protobuf wire-type %d", tag&7)
+		}
+		buf = buf[n:]
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// str returns the (last) string field of a given number
+func (fl pbFields) str(num int) string {
+	ret := ""
+	for _, f := range fl {
+		if f.num == num {
+			ret = string(f.data)
+		}
+	}
+	return ret
+}
+
+// strs returns all string fields of a given number (ie. repeated strings)
+func (fl pbFields) strs(num int) []string {
+	ret := make([]string, 0, 2)
+	for _, f := range fl {
+		if f.num == num {
+			ret = append(ret, string(f.data))
+		}
+	}
+	return ret
+}
+
+// varint returns the (last) varint field of a given number
+func (fl pbFields) varint(num int) uint64 {
+	var ret uint64
+	for _, f := range fl {
+		if f.num == num {
+			ret = f.val
+		}
+	}
+	return ret
+}
+
+// msg returns the decoded (last) message field of a given number (empty if not present)
+func (fl pbFields) msg(num int) (pbFields, error) {
+	var data []byte
+	for _, f := range fl {
+		if f.num == num {
+			data = f.data
+		}
+	}
+	return pbDecode(data)
+}
+
+// msgs returns all decoded message fields of a given number (ie. repeated messages)
+func (fl pbFields) msgs(num int) ([]pbFields, error) {
+	ret := make([]pbFields, 0, 2)
+	for _, f := range fl {
+		if f.num == num {
+			m, err := pbDecode(f.data)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// strMap returns the decoded map<string,string> field of a given number
+func (fl pbFields) strMap(num int) (map[string]string, error) {
+	entries, err := fl.msgs(num)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(entries))
+	for _, e := range entries {
+		ret[e.str(1)] = e.str(2)
+	}
+	return ret, nil
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// PreRestartHookAnnotation is the pod annotation naming the command to run before PX gets drained/restarted
+	// (e.g. `fsfreeze`, or flush the database).  The command is run via `/bin/sh -c`, or exec'd directly if
+	// formatted as JSON array (e.g. `["/usr/bin/flush", "--all"]`).
+	PreRestartHookAnnotation = "px/pre-restart-hook"
+	// PostRestartHookAnnotation is the pod annotation naming the command to run once PX is healthy again
+	PostRestartHookAnnotation = "px/post-restart-hook"
+	// HookContainerAnnotation names the container to run the hooks in (dfl. pod's first container)
+	HookContainerAnnotation = "px/hook-container"
+	// HookTimeoutAnnotation overrides the hook timeout of the drain policy (e.g. "5m")
+	HookTimeoutAnnotation = "px/hook-timeout"
+	maxHookOutputLines    = 20
+)
+
+// Hook kinds
+const (
+	HookPreRestart  = "pre-restart"
+	HookPostRestart = "post-restart"
+)
+
+// Actions when the pre-restart hook fails
+const (
+	// HookFailureAbort aborts the upgrade if the pre-restart hook fails
+	HookFailureAbort = "abort"
+	// HookFailureContinue continues the upgrade even if the pre-restart hook fails
+	HookFailureContinue = "continue"
+)
+
+// podExecutor runs the commands in the pod containers (see InstallerRuntime)
+type podExecutor interface {
+	ExecInPod(namespace, pod, container string, cmd []string, timeout time.Duration) (*ExecResult, error)
+}
+
+// HookResult is the outcome of the hook executed in the pod
+type HookResult struct {
+	Hook      string   `json:"hook"`
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	Command   []string `json:"command"`
+	ExitCode  int      `json:"exitCode"`
+	Output    []string `json:"output,omitempty"`
+	Duration  string   `json:"duration"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Failed returns TRUE if the hook did not complete successfully
+func (r *HookResult) Failed() bool {
+	return r.Error != "" || r.ExitCode != 0
+}
+
+// HookFailedError is returned when the failed pre-restart hooks abort the upgrade
+type HookFailedError struct {
+	Pods []string
+}
+
+func (e *HookFailedError) Error() string {
+	return fmt.Sprintf("Pre-restart hooks failed in pods %s", strings.Join(e.Pods, ", "))
+}
+
+// ParseHookCommand parses the hook command, which is either a JSON array, or a shell command
+func ParseHookCommand(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("Empty hook command")
+	} else if !strings.HasPrefix(s, "[") {
+		return []string{"/bin/sh", "-c", s}, nil
+	}
+	var ret []string
+	if err := json.Unmarshal([]byte(s), &ret); err != nil {
+		return nil, fmt.Errorf("Could not parse hook command %q: %s", s, err)
+	} else if len(ret) == 0 || ret[0] == "" {
+		return nil, fmt.Errorf("Empty hook command %q", s)
+	}
+	return ret, nil
+}
+
+// hookAnnotation returns the annotation defining a given hook kind
+func hookAnnotation(hook string) string {
+	if hook == HookPostRestart {
+		return PostRestartHookAnnotation
+	}
+	return PreRestartHookAnnotation
+}
+
+// HasHook returns TRUE if the pod defines a given hook kind
+func HasHook(p *v1.Pod, hook string) bool {
+	_, has := p.GetAnnotations()[hookAnnotation(hook)]
+	return has
+}
+
+// runHook runs a given hook kind in the pod
+func (p *DrainPolicy) runHook(exec podExecutor, pod *v1.Pod, hook string) *HookResult {
+	ann := pod.GetAnnotations()
+	r := &HookResult{
+		Hook:      hook,
+		Namespace: pod.GetNamespace(),
+		Pod:       pod.GetName(),
+		Container: ann[HookContainerAnnotation],
+		ExitCode:  -1,
+	}
+	if r.Container == "" && len(pod.Spec.Containers) > 0 {
+		r.Container = pod.Spec.Containers[0].Name
+	}
+	timeout := p.hookTimeout
+	if v, has := ann[HookTimeoutAnnotation]; has {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			logrus.Warnf("Ignoring invalid annotation %s=%s of pod %s/%s", HookTimeoutAnnotation, v, r.Namespace,
+				r.Pod)
+		} else {
+			timeout = d
+		}
+	}
+
+	var err error
+	if r.Command, err = ParseHookCommand(ann[hookAnnotation(hook)]); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	logrus.Infof("Running %s hook %q in pod %s/%s (container %s, timeout %s)", hook, r.Command, r.Namespace, r.Pod,
+		r.Container, timeout)
+	start := time.Now()
+	res, err := exec.ExecInPod(r.Namespace, r.Pod, r.Container, r.Command, timeout)
+	r.Duration = time.Since(start).Round(time.Millisecond).String()
+	if res != nil {
+		r.ExitCode = res.ExitCode
+		if out := strings.TrimSpace(res.Output); out != "" {
+			r.Output = strings.Split(out, "\n")
+			if len(r.Output) > maxHookOutputLines {
+				r.Output = r.Output[len(r.Output)-maxHookOutputLines:]
+			}
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// RunHooks runs a given hook kind in the pods which define it, and returns the hook results.  Returns the
+// HookFailedError if the pre-restart hooks failed, and the policy says to abort the upgrade.
+func (p *DrainPolicy) RunHooks(exec podExecutor, pods []PxConsumer, hook string) ([]*HookResult, error) {
+	ret := make([]*HookResult, 0, len(pods))
+	var failed []string
+	for i := range pods {
+		if !HasHook(&pods[i].Pod, hook) {
+			continue
+		}
+		r := p.runHook(exec, &pods[i].Pod, hook)
+		ret = append(ret, r)
+		log := logrus.WithField("output", r.Output)
+		if r.Failed() {
+			log.Errorf("%s hook in pod %s/%s failed (exit code %d, %s): %s", hook, r.Namespace, r.Pod, r.ExitCode,
+				r.Duration, r.Error)
+			failed = append(failed, r.Namespace+"/"+r.Pod)
+		} else {
+			log.Infof("%s hook in pod %s/%s completed (%s)", hook, r.Namespace, r.Pod, r.Duration)
+		}
+	}
+	if len(failed) > 0 && hook == HookPreRestart && p.OnHookFailure == HookFailureAbort {
+		return ret, &HookFailedError{Pods: failed}
+	}
+	return ret, nil
+}
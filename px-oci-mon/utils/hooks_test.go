@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeExecutor fails the commands containing "fail", and times out the commands containing "hang"
+type fakeExecutor struct {
+	calls []string
+}
+
+func (f *fakeExecutor) ExecInPod(namespace, pod, container string, cmd []string, timeout time.Duration) (
+	*ExecResult, error) {
+	f.calls = append(f.calls, fmt.Sprintf("%s/%s/%s %s %s", namespace, pod, container, strings.Join(cmd, " "),
+		timeout))
+	last := cmd[len(cmd)-1]
+	if strings.Contains(last, "hang") {
+		return &ExecResult{Output: "> started\n", ExitCode: -1}, fmt.Errorf("Timeout after %s", timeout)
+	} else if strings.Contains(last, "fail") {
+		return &ExecResult{Output: "E failed\n", ExitCode: 3}, nil
+	}
+	return &ExecResult{Output: "> ok\n"}, nil
+}
+
+func hookPod(name string, ann map[string]string) PxConsumer {
+	return PxConsumer{Pod: v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "ns", Annotations: ann},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}, {Name: "sidecar"}}},
+	}}
+}
+
+func TestParseHookCommand(t *testing.T) {
+	cmd, err := ParseHookCommand("sync && echo done")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/sh", "-c", "sync && echo done"}, cmd)
+
+	cmd, err = ParseHookCommand(` ["/usr/bin/flush", "--all"] `)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/usr/bin/flush", "--all"}, cmd)
+
+	for _, bad := range []string{"", "  ", "[]", `[""]`, `["x"`} {
+		_, err = ParseHookCommand(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	pods := []PxConsumer{
+		hookPod("a", map[string]string{PreRestartHookAnnotation: "flush", PostRestartHookAnnotation: "resume"}),
+		hookPod("b", nil),
+		hookPod("c", map[string]string{PreRestartHookAnnotation: `["fail"]`, HookContainerAnnotation: "sidecar"}),
+		hookPod("d", map[string]string{PreRestartHookAnnotation: "hang", HookTimeoutAnnotation: "5s"}),
+		hookPod("e", map[string]string{PreRestartHookAnnotation: "[bad"}),
+	}
+	f := &fakeExecutor{}
+	pol := DefaultDrainPolicy()
+
+	res, err := pol.RunHooks(f, pods, HookPreRestart)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"ns/c", "ns/d", "ns/e"}, err.(*HookFailedError).Pods)
+	assert.Equal(t, []string{
+		"ns/a/app /bin/sh -c flush 1m0s",
+		"ns/c/sidecar fail 1m0s",
+		"ns/d/app /bin/sh -c hang 5s",
+	}, f.calls)
+	if assert.Len(t, res, 4) {
+		assert.False(t, res[0].Failed())
+		assert.Equal(t, []string{"> ok"}, res[0].Output)
+		assert.Equal(t, 3, res[1].ExitCode)
+		assert.Equal(t, "sidecar", res[1].Container)
+		assert.Equal(t, "Timeout after 5s", res[2].Error)
+		assert.Equal(t, []string{"> started"}, res[2].Output)
+		assert.Contains(t, res[3].Error, "Could not parse hook command")
+	}
+
+	// policy says continue
+	pol.OnHookFailure = HookFailureContinue
+	res, err = pol.RunHooks(&fakeExecutor{}, pods, HookPreRestart)
+	assert.NoError(t, err)
+	assert.Len(t, res, 4)
+
+	// post-restart hook failures never abort
+	pol.OnHookFailure = HookFailureAbort
+	pods[0].Pod.Annotations[PostRestartHookAnnotation] = "fail"
+	res, err = pol.RunHooks(&fakeExecutor{}, pods, HookPostRestart)
+	assert.NoError(t, err)
+	if assert.Len(t, res, 1) {
+		assert.True(t, res[0].Failed())
+		assert.Equal(t, HookPostRestart, res[0].Hook)
+	}
+}
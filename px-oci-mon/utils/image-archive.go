@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const (
+	ociIndexFile             = "index.json"
+	dockerManifestFile       = "manifest.json"
+	ociRefNameAnnotation     = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation = "io.containerd.image.name"
+	// maxArchiveMetaSize limits the size of the archive's metadata files (index, manifests)
+	maxArchiveMetaSize = 4 << 20
+	maxIndexDepth      = 3
+)
+
+var (
+	tagRegex          = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	loadedImagesRegex = regexp.MustCompile(`(?m)^(?:Loaded image: |unpacking )(\S+)`)
+)
+
+// ArchivedImage is the image found in the image archive
+type ArchivedImage struct {
+	// Name is the image name (e.g. "docker.io/portworx/px-enterprise:2.0", or "2.0" tag only)
+	Name string `json:"name,omitempty"`
+	// Digest is the manifest digest (empty for archives w/o OCI index, e.g. older `docker save`)
+	Digest string `json:"digest,omitempty"`
+	// ImageID is the config digest, ie. the image ID once imported
+	ImageID string `json:"imageID"`
+}
+
+// ociDescriptor is the OCI content descriptor (see https://github.com/opencontainers/image-spec)
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is either the OCI image index, or the image manifest
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+	Config    *ociDescriptor  `json:"config,omitempty"`
+}
+
+// dockerSaveManifest is the `manifest.json` entry of the `docker save` archive
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+}
+
+// archiveFiles reads the small files of a given names from the tarball (optionally gzip-compressed), or directory
+func archiveFiles(archive string, names ...string) (map[string][]byte, error) {
+	ret := make(map[string][]byte, len(names))
+	if st, err := os.Stat(archive); err != nil {
+		return nil, err
+	} else if st.IsDir() {
+		for _, n := range names {
+			buf, err := ioutil.ReadFile(filepath.Join(archive, n))
+			if err == nil {
+				ret[n] = buf
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// note: plain file lets the tar reader seek past the (large) layers
+	var r io.Reader = f
+	magic := make([]byte, 2)
+	if _, err = io.ReadFull(f, magic); err != nil {
+		return nil, fmt.Errorf("Could not read tarball: %s", err)
+	} else if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	} else if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if r, err = gzip.NewReader(f); err != nil {
+			return nil, err
+		}
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read tarball: %s", err)
+		}
+		n := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag == tar.TypeReg && hdr.Size <= maxArchiveMetaSize && inArray(n, names...) {
+			if ret[n], err = ioutil.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// blobPath returns the location of the blob in the OCI layout (e.g. "blobs/sha256/<hex>")
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// readBlob reads the blob of a given digest, verifying its content
+func readBlob(archive, digest string) ([]byte, error) {
+	if !IsValidDigest(digest) {
+		return nil, fmt.Errorf("Unsupported digest %q", digest)
+	}
+	files, err := archiveFiles(archive, blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	buf, has := files[blobPath(digest)]
+	if !has {
+		return nil, fmt.Errorf("Blob %s not found", digest)
+	} else if sum := fmt.Sprintf("%s%x", digestPrefix, sha256.Sum256(buf)); sum != digest {
+		return nil, fmt.Errorf("Blob %s is corrupted (content digest %s)", digest, sum)
+	}
+	return buf, nil
+}
+
+// resolveOciManifest returns the config digest of the image manifest, descending into the image index for the
+// platform we're running on
+func resolveOciManifest(archive string, desc ociDescriptor, depth int) (string, error) {
+	if depth > maxIndexDepth {
+		return "", fmt.Errorf("Image index %s nested too deep", desc.Digest)
+	}
+	buf, err := readBlob(archive, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	m := ociManifest{}
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return "", fmt.Errorf("Could not parse manifest %s: %s", desc.Digest, err)
+	} else if m.Config != nil {
+		return m.Config.Digest, nil
+	}
+	for _, d := range m.Manifests {
+		if d.Platform == nil || (d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH) {
+			return resolveOciManifest(archive, d, depth+1)
+		}
+	}
+	return "", fmt.Errorf("No linux/%s image found in index %s", runtime.GOARCH, desc.Digest)
+}
+
+// ReadImageArchive lists the images in the tarball (`docker save`, `ctr images export`, OCI archive), or OCI-layout
+// directory.  The OCI manifests are verified against their digests.
+func ReadImageArchive(archive string) ([]ArchivedImage, error) {
+	files, err := archiveFiles(archive, ociIndexFile, dockerManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read image archive %s: %s", archive, err)
+	}
+
+	var ret []ArchivedImage
+	if buf, has := files[ociIndexFile]; has {
+		idx := ociManifest{}
+		if err = json.Unmarshal(buf, &idx); err != nil {
+			return nil, fmt.Errorf("Could not parse %s in %s: %s", ociIndexFile, archive, err)
+		}
+		for _, d := range idx.Manifests {
+			img := ArchivedImage{Name: d.Annotations[containerdNameAnnotation], Digest: d.Digest}
+			if img.Name == "" {
+				img.Name = d.Annotations[ociRefNameAnnotation]
+			}
+			if img.ImageID, err = resolveOciManifest(archive, d, 1); err != nil {
+				return nil, fmt.Errorf("Invalid image archive %s: %s", archive, err)
+			}
+			ret = append(ret, img)
+		}
+	} else if buf, has := files[dockerManifestFile]; has {
+		var mm []dockerSaveManifest
+		if err = json.Unmarshal(buf, &mm); err != nil {
+			return nil, fmt.Errorf("Could not parse %s in %s: %s", dockerManifestFile, archive, err)
+		}
+		for _, m := range mm {
+			// config is stored as "<hex>.json" (docker < 25), or "blobs/sha256/<hex>"
+			id := digestPrefix + strings.TrimSuffix(path.Base(m.Config), ".json")
+			if !IsValidDigest(id) {
+				return nil, fmt.Errorf("Invalid image archive %s: unsupported config %s", archive, m.Config)
+			} else if len(m.RepoTags) == 0 {
+				ret = append(ret, ArchivedImage{ImageID: id})
+			}
+			for _, t := range m.RepoTags {
+				ret = append(ret, ArchivedImage{Name: t, ImageID: id})
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("Invalid image archive %s: no %s or %s found", archive, ociIndexFile,
+			dockerManifestFile)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No images found in archive %s", archive)
+	}
+	return ret, nil
+}
+
+// imageTag returns the tag of the image reference ("latest" if none)
+func imageTag(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[i+1:]
+	}
+	return "latest"
+}
+
+// FindArchivedImage returns the archived image matching a given reference (by digest if pinned, otherwise by name),
+// or the only image in the archive (nil if not found)
+func FindArchivedImage(images []ArchivedImage, ref string) *ArchivedImage {
+	pinned := ImageDigest(ref)
+	for i, img := range images {
+		if pinned != "" {
+			if img.Digest == pinned {
+				return &images[i]
+			}
+		} else if tagRegex.MatchString(img.Name) {
+			// tag-only name (e.g. `org.opencontainers.image.ref.name` annotation)
+			if img.Name == imageTag(ref) {
+				return &images[i]
+			}
+		} else if img.Name != "" && imageRepository(img.Name) == imageRepository(ref) &&
+			imageTag(img.Name) == imageTag(ref) {
+			return &images[i]
+		}
+	}
+	if len(images) == 1 && pinned == "" {
+		return &images[0]
+	}
+	return nil
+}
+
+// parseLoadedImages parses the image names from the `docker load`, `podman load` or `ctr images import` output
+func parseLoadedImages(out string) []string {
+	var ret []string
+	for _, m := range loadedImagesRegex.FindAllStringSubmatch(out, -1) {
+		ret = append(ret, m[1])
+	}
+	return ret
+}
+
+// openImageArchive opens the tarball, or streams the OCI-layout directory as tarball
+func openImageArchive(archive string) (io.ReadCloser, error) {
+	st, err := os.Stat(archive)
+	if err != nil {
+		return nil, err
+	} else if !st.IsDir() {
+		return os.Open(archive)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(archive, func(fname string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(archive, fname)
+			if err != nil || rel == "." {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if err = tw.WriteHeader(hdr); err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			f, err := os.Open(fname)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
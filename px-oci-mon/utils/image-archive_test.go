@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+const testConfigDigest = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+
+// writeBlob stores the blob into OCI-layout directory, and returns its digest
+func writeBlob(t *testing.T, dir, content string) string {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, blobPath(digest)), []byte(content), 0644))
+	return digest
+}
+
+// makeOciLayout creates the OCI-layout directory w/ the multi-arch image
+func makeOciLayout(t *testing.T, dir string) string {
+	manifest := writeBlob(t, dir, `{"schemaVersion": 2, "config": {"digest": "`+testConfigDigest+`"}}`)
+	index := writeBlob(t, dir, `{"schemaVersion": 2, "manifests": [
+		{"digest": "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+		 "platform": {"architecture": "other", "os": "linux"}},
+		{"digest": "`+manifest+`", "platform": {"architecture": "`+runtime.GOARCH+`", "os": "linux"}}]}`)
+	err := ioutil.WriteFile(path.Join(dir, ociIndexFile), []byte(`{"schemaVersion": 2, "manifests": [
+		{"digest": "`+index+`", "annotations": {"`+containerdNameAnnotation+`": "docker.io/portworx/px-enterprise:2.0"}}]}`),
+		0644)
+	assert.NoError(t, err)
+	return index
+}
+
+func TestReadImageArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	layout := path.Join(dir, "layout")
+	digest := makeOciLayout(t, layout)
+	expected := []ArchivedImage{{Name: "docker.io/portworx/px-enterprise:2.0", Digest: digest, ImageID: testConfigDigest}}
+
+	// OCI-layout directory
+	images, err := ReadImageArchive(layout)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, images)
+
+	// tarball, and gzip-compressed tarball
+	in, err := openImageArchive(layout)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(in)
+	assert.NoError(t, err)
+	in.Close()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "px.tar"), buf, 0644))
+	images, err = ReadImageArchive(path.Join(dir, "px.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, images)
+
+	f, err := os.Create(path.Join(dir, "px.tgz"))
+	assert.NoError(t, err)
+	zw := gzip.NewWriter(f)
+	_, err = zw.Write(buf)
+	assert.NoError(t, err)
+	zw.Close()
+	f.Close()
+	images, err = ReadImageArchive(path.Join(dir, "px.tgz"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, images)
+
+	// corrupted manifest
+	err = ioutil.WriteFile(path.Join(layout, blobPath(digest)), []byte(`{"manifests": []}`), 0644)
+	assert.NoError(t, err)
+	_, err = ReadImageArchive(layout)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is corrupted")
+
+	// docker save
+	save := path.Join(dir, "save")
+	assert.NoError(t, os.Mkdir(save, 0755))
+	err = ioutil.WriteFile(path.Join(save, dockerManifestFile), []byte(`[{"Config": "`+testConfigDigest[7:]+`.json",
+		"RepoTags": ["portworx/px-enterprise:2.0", "portworx/px-enterprise:latest"]}]`), 0644)
+	assert.NoError(t, err)
+	images, err = ReadImageArchive(save)
+	assert.NoError(t, err)
+	assert.Equal(t, []ArchivedImage{
+		{Name: "portworx/px-enterprise:2.0", ImageID: testConfigDigest},
+		{Name: "portworx/px-enterprise:latest", ImageID: testConfigDigest},
+	}, images)
+
+	_, err = ReadImageArchive(dir)
+	assert.Error(t, err)
+	_, err = ReadImageArchive(path.Join(dir, "missing.tar"))
+	assert.Error(t, err)
+}
+
+func TestFindArchivedImage(t *testing.T) {
+	images := []ArchivedImage{
+		{Name: "docker.io/portworx/px-enterprise:2.0", Digest: testDigest1},
+		{Name: "portworx/px-enterprise:latest"},
+		{Name: "2.1", Digest: testDigest2},
+	}
+	for _, v := range []struct {
+		ref      string
+		expected int
+	}{
+		{"portworx/px-enterprise:2.0", 0},
+		{"portworx/px-enterprise", 1},
+		{"docker.io/portworx/px-enterprise:latest", 1},
+		{"registry.local/px-enterprise:2.1", 2},
+		{"portworx/px-enterprise@" + testDigest2, 2},
+		{"portworx/px-enterprise:2.2", -1},
+		{"portworx/px-enterprise@" + testConfigDigest, -1},
+	} {
+		img := FindArchivedImage(images, v.ref)
+		if v.expected < 0 {
+			assert.Nil(t, img, v.ref)
+		} else {
+			assert.Equal(t, &images[v.expected], img, v.ref)
+		}
+	}
+	assert.Equal(t, &images[0], FindArchivedImage(images[:1], "px:any"))
+}
+
+func TestParseLoadedImages(t *testing.T) {
+	assert.Equal(t, []string{"portworx/px-enterprise:2.0", "docker.io/portworx/px-base:2.0"},
+		parseLoadedImages("Loaded image: portworx/px-enterprise:2.0\n"+
+			"unpacking docker.io/portworx/px-base:2.0 (sha256:abc)...done\nLoaded image ID: sha256:abc\n"))
+	assert.Empty(t, parseLoadedImages(""))
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	digestPrefix    = "sha256:"
+	signatureSuffix = ".sig"
+	dockerHubDomain = "docker.io"
+)
+
+var digestRegex = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// IsValidDigest returns TRUE if a given string is the image manifest digest (e.g. "sha256:<64 hex chars>")
+func IsValidDigest(d string) bool {
+	return digestRegex.MatchString(d)
+}
+
+// ImageDigest returns the digest of the digest-pinned image reference (e.g. "portworx/px-enterprise@sha256:..."),
+// or empty if the reference is not pinned
+func ImageDigest(ref string) string {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		return ref[i+1:]
+	}
+	return ""
+}
+
+// imageRepository returns the normalized repository of the image reference
+// (e.g. "busybox:1.2" -> "docker.io/library/busybox")
+func imageRepository(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 1 || (!strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost") {
+		parts = []string{dockerHubDomain, ref}
+	} else if parts[0] == "index.docker.io" || parts[0] == "registry-1.docker.io" {
+		parts[0] = dockerHubDomain
+	}
+	if parts[0] == dockerHubDomain && !strings.Contains(parts[1], "/") {
+		parts[1] = "library/" + parts[1]
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// ImageVerification is the outcome of the PX image verification, reported via the status API
+type ImageVerification struct {
+	Time   time.Time `json:"time"`
+	Image  string    `json:"image"`
+	Digest string    `json:"digest,omitempty"`
+	// Pinned is TRUE if the image reference was pinned to the digest
+	Pinned bool `json:"pinned"`
+	// Trusted is TRUE if the digest was found in the trusted digests
+	Trusted bool `json:"trusted"`
+	// Signed is TRUE if the digest's signature was verified
+	Signed bool   `json:"signed"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (v *ImageVerification) String() string {
+	checks := make([]string, 0, 3)
+	if v.Pinned {
+		checks = append(checks, "pinned")
+	}
+	if v.Trusted {
+		checks = append(checks, "trusted")
+	}
+	if v.Signed {
+		checks = append(checks, "signed")
+	}
+	if len(checks) == 0 {
+		checks = append(checks, "unverified")
+	}
+	return fmt.Sprintf("digest %s (%s)", v.Digest, strings.Join(checks, ", "))
+}
+
+// ImageVerifier verifies the pulled image against the pinned digest, the trusted digests, and the digest's
+// signature.  The signatures are read from `<signature dir>/sha256-<hex>.sig` files (raw, or base64-encoded), and
+// are made over the digest string, e.g.
+// `echo -n sha256:<hex> | openssl dgst -sha256 -sign key.pem | base64 > sha256-<hex>.sig`.
+type ImageVerifier struct {
+	trusted []string
+	key     crypto.PublicKey
+	sigDir  string
+}
+
+// loadPublicKey loads the PEM-encoded public key (RSA, ECDSA or Ed25519)
+func loadPublicKey(fname string) (crypto.PublicKey, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(buf)
+	if blk == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", fname)
+	}
+	key, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse public key %s: %s", fname, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported public key type %T in %s", key, fname)
+}
+
+// NewImageVerifier creates the image verifier for given trusted digests (empty allows any digest), and public key
+// (empty skips the signature verification).  The signatures are read from given directory (dfl. key's directory).
+func NewImageVerifier(trusted []string, keyFile, sigDir string) (*ImageVerifier, error) {
+	v := &ImageVerifier{trusted: make([]string, 0, len(trusted)), sigDir: sigDir}
+	for _, d := range trusted {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		} else if !IsValidDigest(d) {
+			return nil, fmt.Errorf("Invalid trusted digest %q (expected sha256:<hex>)", d)
+		}
+		v.trusted = append(v.trusted, d)
+	}
+	if keyFile != "" {
+		var err error
+		if v.key, err = loadPublicKey(keyFile); err != nil {
+			return nil, fmt.Errorf("Could not load image verification key: %s", err)
+		}
+		if v.sigDir == "" {
+			v.sigDir = filepath.Dir(keyFile)
+		}
+	}
+	return v, nil
+}
+
+// verifySignature verifies the signature of a given digest
+func (v *ImageVerifier) verifySignature(digest string) error {
+	fname := filepath.Join(v.sigDir, strings.Replace(digest, ":", "-", 1)+signatureSuffix)
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("Could not read signature: %s", err)
+	}
+	sig := buf
+	if dec, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf))); err == nil {
+		sig = dec
+	}
+
+	hash := sha256.Sum256([]byte(digest))
+	ok := false
+	switch key := v.key.(type) {
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, hash[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, []byte(digest), sig)
+	}
+	if !ok {
+		return fmt.Errorf("Invalid signature %s", fname)
+	}
+	return nil
+}
+
+// Verify verifies the image of a given reference, where repoDigests are the pulled image's repository digests
+// (e.g. "docker.io/portworx/px-enterprise@sha256:...").  The failed verification is recorded in the result.
+func (v *ImageVerifier) Verify(ref string, repoDigests []string) (*ImageVerification, error) {
+	res := &ImageVerification{Time: time.Now().UTC(), Image: ref}
+	err := v.verify(res, repoDigests)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res, err
+}
+
+func (v *ImageVerifier) verify(res *ImageVerification, repoDigests []string) error {
+	repo := imageRepository(res.Image)
+	digests, others := make([]string, 0, len(repoDigests)), make([]string, 0, len(repoDigests))
+	for _, rd := range repoDigests {
+		if d := ImageDigest(rd); d != "" && imageRepository(rd) == repo {
+			digests = append(digests, d)
+		} else if d != "" {
+			others = append(others, d)
+		}
+	}
+	if len(digests) == 0 {
+		// e.g. pulled from the registry mirror (the digests identify the same content)
+		digests = others
+	}
+
+	if pinned := ImageDigest(res.Image); pinned != "" {
+		res.Pinned = true
+		if !IsValidDigest(pinned) {
+			return fmt.Errorf("Image %s is pinned to invalid digest %q", res.Image, pinned)
+		} else if !inArray(pinned, digests...) {
+			return fmt.Errorf("Image %s does not match its pinned digest (pulled %s)", res.Image,
+				strings.Join(repoDigests, ", "))
+		}
+		digests = []string{pinned}
+	}
+	if len(digests) > 0 {
+		res.Digest = digests[0]
+	}
+	if len(v.trusted) == 0 && v.key == nil {
+		return nil
+	} else if len(digests) == 0 {
+		return fmt.Errorf("Could not verify image %s: no repository digest found", res.Image)
+	}
+
+	if len(v.trusted) > 0 {
+		allowed := make([]string, 0, len(digests))
+		for _, d := range digests {
+			if inArray(d, v.trusted...) {
+				allowed = append(allowed, d)
+			}
+		}
+		if len(allowed) == 0 {
+			return fmt.Errorf("Image %s digest %s is not trusted", res.Image, strings.Join(digests, ", "))
+		}
+		digests, res.Digest, res.Trusted = allowed, allowed[0], true
+	}
+
+	if v.key != nil {
+		var err error
+		for _, d := range digests {
+			if err = v.verifySignature(d); err == nil {
+				res.Digest, res.Signed = d, true
+				return nil
+			}
+		}
+		return fmt.Errorf("Could not verify signature of image %s: %s", res.Image, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	testDigest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	testDigest2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestImageRepository(t *testing.T) {
+	for _, v := range []struct{ ref, repo string }{
+		{"busybox", "docker.io/library/busybox"},
+		{"portworx/px-enterprise:2.0.1", "docker.io/portworx/px-enterprise"},
+		{"portworx/px-enterprise@" + testDigest1, "docker.io/portworx/px-enterprise"},
+		{"index.docker.io/portworx/px-enterprise", "docker.io/portworx/px-enterprise"},
+		{"registry.local:5000/pwx/px-enterprise:2.0", "registry.local:5000/pwx/px-enterprise"},
+		{"localhost/px:1", "localhost/px"},
+	} {
+		assert.Equal(t, v.repo, imageRepository(v.ref), v.ref)
+	}
+	assert.Equal(t, testDigest1, ImageDigest("portworx/px-enterprise@"+testDigest1))
+	assert.Empty(t, ImageDigest("portworx/px-enterprise:2.0.1"))
+	assert.True(t, IsValidDigest(testDigest1))
+	assert.False(t, IsValidDigest("sha256:abc"))
+}
+
+func TestImageVerifierDigests(t *testing.T) {
+	pulled := []string{"docker.io/portworx/px-enterprise@" + testDigest1, "registry.local/px-enterprise@" + testDigest2}
+
+	// no verification configured
+	v, err := NewImageVerifier(nil, "", "")
+	assert.NoError(t, err)
+	res, err := v.Verify("portworx/px-enterprise:2.0", pulled)
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest1, res.Digest)
+	assert.Equal(t, "digest "+testDigest1+" (unverified)", res.String())
+
+	// pinned reference
+	res, err = v.Verify("portworx/px-enterprise@"+testDigest1, pulled)
+	assert.NoError(t, err)
+	assert.True(t, res.Pinned)
+	_, err = v.Verify("portworx/px-enterprise@"+testDigest2, pulled)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match its pinned digest")
+
+	// allow-list
+	_, err = NewImageVerifier([]string{"sha256:bad"}, "", "")
+	assert.Error(t, err)
+	v, err = NewImageVerifier([]string{testDigest1}, "", "")
+	assert.NoError(t, err)
+	res, err = v.Verify("portworx/px-enterprise:2.0", pulled)
+	assert.NoError(t, err)
+	assert.True(t, res.Trusted)
+	res, err = v.Verify("registry.local/px-enterprise:2.0", pulled)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not trusted")
+	assert.Equal(t, err.Error(), res.Error)
+	_, err = v.Verify("portworx/px-enterprise:2.0", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no repository digest")
+
+	// pulled from the registry mirror
+	res, err = v.Verify("portworx/px-enterprise:2.0", []string{"mirror.local:5000/portworx/px-enterprise@" + testDigest1})
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest1, res.Digest)
+}
+
+func TestImageVerifierSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-verify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	hash := sha256.Sum256([]byte(testDigest1))
+	for _, v := range []struct {
+		name string
+		pub  interface{}
+		sign func() ([]byte, error)
+	}{
+		{"rsa", &rsaKey.PublicKey, func() ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+		}},
+		{"ecdsa", &ecKey.PublicKey, func() ([]byte, error) { return ecdsa.SignASN1(rand.Reader, ecKey, hash[:]) }},
+		{"ed25519", edPub, func() ([]byte, error) { return ed25519.Sign(edKey, []byte(testDigest1)), nil }},
+	} {
+		der, err := x509.MarshalPKIXPublicKey(v.pub)
+		assert.NoError(t, err)
+		keyFile := path.Join(dir, v.name+".pem")
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+		assert.NoError(t, err)
+		sigDir := path.Join(dir, v.name)
+		assert.NoError(t, os.Mkdir(sigDir, 0700))
+
+		iv, err := NewImageVerifier(nil, keyFile, sigDir)
+		assert.NoError(t, err)
+		_, err = iv.Verify("portworx/px-enterprise@"+testDigest1, []string{"portworx/px-enterprise@" + testDigest1})
+		assert.Error(t, err, v.name)
+		assert.Contains(t, err.Error(), "Could not read signature", v.name)
+
+		sig, err := v.sign()
+		assert.NoError(t, err)
+		sigFile := path.Join(sigDir, strings.Replace(testDigest1, ":", "-", 1)+".sig")
+		err = ioutil.WriteFile(sigFile, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0600)
+		assert.NoError(t, err)
+		res, err := iv.Verify("portworx/px-enterprise@"+testDigest1, []string{"portworx/px-enterprise@" + testDigest1})
+		assert.NoError(t, err, v.name)
+		assert.True(t, res.Signed, v.name)
+		assert.Equal(t, "digest "+testDigest1+" (pinned, signed)", res.String())
+
+		// tampered signature
+		sig[len(sig)-1] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(sigFile, sig, 0600))
+		_, err = iv.Verify("portworx/px-enterprise@"+testDigest1, []string{"portworx/px-enterprise@" + testDigest1})
+		assert.Error(t, err, v.name)
+		assert.Contains(t, err.Error(), "Invalid signature", v.name)
+	}
+
+	_, err = NewImageVerifier(nil, path.Join(dir, "missing.pem"), "")
+	assert.Error(t, err)
+}
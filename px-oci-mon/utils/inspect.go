@@ -85,7 +85,12 @@ func GetMyContainerID() (string, error) {
 // formatMounts is a helper-function which converts `types.MountPoint` structs into the Docker-CLI representation
 // (ie. `source:dest[:shared,ro]`)
 func formatMounts(cconf types.ContainerJSON) []string {
-	mounts := cconf.Mounts
+	return formatMountPoints(cconf.Mounts, cconf.HostsPath, cconf.ResolvConfPath)
+}
+
+// formatMountPoints converts the mount-points into the Docker-CLI representation, and adds the hosts/resolv.conf
+// files (if not mounted explicitly).
+func formatMountPoints(mounts []types.MountPoint, hostsPath, resolvConfPath string) []string {
 	outList := make([]string, 0, 5)
 	lookupCache := make(map[string]string)
 
@@ -118,9 +123,9 @@ func formatMounts(cconf types.ContainerJSON) []string {
 		newMount := out.String()
 		if oldMount, has := lookupCache[m.Destination]; has {
 			if oldMount == newMount {
-				logrus.Warn("Duplicate mount-entry for '%s'", newMount)
+				logrus.Warnf("Duplicate mount-entry for '%s'", newMount)
 			} else {
-				logrus.Warn("Overriding mount-entry for '%s' - from %s to %s",
+				logrus.Warnf("Overriding mount-entry for '%s' - from %s to %s",
 					m.Destination, oldMount, newMount)
 			}
 		}
@@ -134,8 +139,8 @@ func formatMounts(cconf types.ContainerJSON) []string {
 		destination string
 		label       string
 	}{
-		{cconf.HostsPath, "/etc/hosts", "HostsPath"},
-		{cconf.ResolvConfPath, "/etc/resolv.conf", "ResolvConfPath"},
+		{hostsPath, "/etc/hosts", "HostsPath"},
+		{resolvConfPath, "/etc/resolv.conf", "ResolvConfPath"},
 	}
 	for _, ex := range extras {
 		if ex.confSource != "" {
@@ -3,34 +3,39 @@ package utils
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/sirupsen/logrus"
 )
 
 const clientAPIDefaultVersion = "1.23"
 
-var (
-	dockerDownloadMsg = []byte(`"Pulling fs layer"`)
-)
-
 // DockerInstaller is a Docker client specialized for Container installation
 type DockerInstaller struct {
-	auth string
-	ctx  context.Context
-	cli  *client.Client
+	creds *RegistryCredentials
+	pull  *PullConfig
+	ctx   context.Context
+	cli   *client.Client
 }
 
-// NewDockerInstaller creates an instance of the DockerInstaller
-func NewDockerInstaller(user, pass string) (*DockerInstaller, error) {
-	auth, ctx := "", context.Background()
+// NewDockerInstaller creates an instance of the DockerInstaller, talking to a given Docker endpoint
+// (e.g. "unix:///var/run/docker.sock"), and pulling the images w/ given registry credentials (nil if none), and pull
+// configuration (nil for defaults).  The context will abort the Docker calls when cancelled.
+func NewDockerInstaller(ctx context.Context, endpoint string, creds *RegistryCredentials, pull *PullConfig) (
+	*DockerInstaller, error) {
+	if endpoint == "" {
+		endpoint = unixPrefix + DockerSocket
+	}
 
 	cliVer := os.Getenv("DOCKER_API_VERSION")
 	if cliVer == "" {
@@ -38,68 +43,50 @@ func NewDockerInstaller(user, pass string) (*DockerInstaller, error) {
 	}
 
 	// NOTE: see https://docs.docker.com/engine/api/v1.26/#section/Versioning
-	cli, err := client.NewClient("unix:///var/run/docker.sock", cliVer, nil, nil)
+	cli, err := client.NewClient(endpoint, cliVer, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	cli.NegotiateAPIVersion(ctx)
 
-	if user != "" {
-		js := fmt.Sprintf(`{"username":%q,"password":%q}`, user, pass)
-		auth = base64.StdEncoding.EncodeToString([]byte(js))
+	if pull == nil {
+		pull = DefaultPullConfig()
 	}
 	return &DockerInstaller{
-		auth: auth,
-		ctx:  ctx,
-		cli:  cli,
+		creds: creds,
+		pull:  pull,
+		ctx:   ctx,
+		cli:   cli,
 	}, nil
 }
 
 // PullImage pulls the image of a given name
 func (di *DockerInstaller) PullImage(name string) error {
-	opts := types.ImagePullOptions{RegistryAuth: di.auth}
-	out, err := di.cli.ImagePull(di.ctx, name, opts)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(os.Stdout, out)
-	return err
+	return di.PullImageCb(name, nil)
 }
 
 // DownloadNotifyCbFunc is used in conjunction with PullImageCb, to provide callback when "image pull" is downloading
 // the content (as opposed to {"status":"Status: Image is up to date for portworx/px-base:338f20e"})
 type DownloadNotifyCbFunc func() error
 
-// PullImageCb pulls the image of a given name. The CallBack function is called if image does not exist, and is being downloaded.
+// PullImageCb pulls the image of a given name, retrying the transient errors and falling back to the registry
+// mirrors (see PullConfig).  The CallBack function is called if image does not exist, and is being downloaded.
 func (di *DockerInstaller) PullImageCb(name string, cb DownloadNotifyCbFunc) error {
-	opts := types.ImagePullOptions{RegistryAuth: di.auth}
-	out, err := di.cli.ImagePull(di.ctx, name, opts)
-	if err != nil {
-		return err
+	pull := func(ctx context.Context, ref string) (io.ReadCloser, error) {
+		opts := types.ImagePullOptions{RegistryAuth: encodeDockerAuth(di.creds.Lookup(ref))}
+		return di.cli.ImagePull(ctx, ref, opts)
 	}
-
-	buf := make([]byte, 512)
-	if n, err := io.ReadFull(out, buf); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			// this is an OK condition (incomplete read), copy the bytes we've got and exit
-			_, err = os.Stdout.Write(buf[0:n])
-			return err
-		}
+	src, err := di.pull.pullWithRetries(di.ctx, name, pull, cb)
+	if err != nil {
 		return err
-	}
-	// based on initial read, let's determine if we started downloading layers
-	if cb != nil && bytes.Contains(buf, dockerDownloadMsg) {
-		if err := cb(); err != nil {
-			return err
+	} else if src != name {
+		// pulled from the mirror -- tag as the requested image
+		if err = di.cli.ImageTag(di.ctx, src, name); err != nil {
+			return fmt.Errorf("Could not tag %s as %s: %s", src, name, err)
 		}
 	}
-	// flush initial content, and continue...
-	os.Stdout.Write(buf)
-
-	// Keep on copying w/ 512b buffer, so we'll see some output (dfl. is 32k buffer)
-	_, err = io.CopyBuffer(os.Stdout, out, buf)
-	return err
+	return nil
 }
 
 // GetImageID inspects the image of a given name, and returns the image ID
@@ -111,6 +98,62 @@ func (di *DockerInstaller) GetImageID(name string) (string, error) {
 	return out.ID, nil
 }
 
+// GetRepoDigests inspects the image of a given name, and returns its repository digests
+func (di *DockerInstaller) GetRepoDigests(name string) ([]string, error) {
+	out, _, err := di.cli.ImageInspectWithRaw(di.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return out.RepoDigests, nil
+}
+
+// ImportImage loads the images from the tarball or OCI-layout directory, and returns the loaded image names
+func (di *DockerInstaller) ImportImage(archive string) ([]string, error) {
+	in, err := openImageArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	resp, err := di.cli.ImageLoad(di.ctx, in, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if !resp.JSON {
+		out, err := ioutil.ReadAll(resp.Body)
+		return parseLoadedImages(string(out)), err
+	}
+	var out bytes.Buffer
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}{}
+		if err = dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if msg.Error != "" {
+			return nil, fmt.Errorf("%s", msg.Error)
+		}
+		out.WriteString(msg.Stream)
+	}
+	return parseLoadedImages(out.String()), nil
+}
+
+// ExportImage exports the image of a given name as tarball (see `docker save`)
+func (di *DockerInstaller) ExportImage(name string, w io.Writer) error {
+	out, err := di.cli.ImageSave(di.ctx, []string{name})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(w, out)
+	return err
+}
+
 // dockerLogsReader is a simplified version of stdcopy.StdCopy docker logs stream de-multiplexer.
 // See also: https://stackoverflow.com/questions/46428721/how-to-stream-docker-container-logs-via-the-go-sdk
 func dockerLogReader(dockLog io.ReadCloser, writers ...io.Writer) error {
@@ -254,6 +297,66 @@ func (di *DockerInstaller) RunOnce(name, cntr string, binds, entrypoint, args []
 	return retError
 }
 
+// ExecInPod runs the command in the container of a given pod (running on this node), aborting it after timeout
+func (di *DockerInstaller) ExecInPod(namespace, pod, container string, cmd []string, timeout time.Duration) (
+	*ExecResult, error) {
+	args := filters.NewArgs()
+	args.Add("label", criPodNamespaceLabelKey+"="+namespace)
+	args.Add("label", criPodLabelKey+"="+pod)
+	args.Add("label", criContainerLabelKey+"="+container)
+	args.Add("status", "running")
+	cntrs, err := di.cli.ContainerList(di.ctx, types.ContainerListOptions{Filters: args})
+	if err != nil {
+		return nil, fmt.Errorf("Could not list containers: %s", err)
+	} else if len(cntrs) == 0 {
+		return nil, fmt.Errorf("No running container %s found in pod %s/%s", container, namespace, pod)
+	}
+
+	ctx, cancel := context.WithTimeout(di.ctx, timeout)
+	defer cancel()
+	cfg := types.ExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true}
+	exec, err := di.cli.ContainerExecCreate(ctx, cntrs[0].ID, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create exec in container %s: %s", cntrs[0].ID, err)
+	}
+	att, err := di.cli.ContainerExecAttach(ctx, exec.ID, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Could not start exec in container %s: %s", cntrs[0].ID, err)
+	}
+
+	var buf bytes.Buffer
+	errC := make(chan error, 1)
+	go func() {
+		errC <- dockerLogReader(ioutil.NopCloser(att.Reader), &buf)
+	}()
+	select {
+	case err = <-errC:
+		att.Close()
+	case <-ctx.Done():
+		// note: Docker does not kill the exec'd process, it keeps running in the container
+		att.Close()
+		<-errC
+		return &ExecResult{Output: buf.String(), ExitCode: -1}, fmt.Errorf("Timeout after %s", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	insp, err := di.cli.ContainerExecInspect(di.ctx, exec.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not inspect exec in container %s: %s", cntrs[0].ID, err)
+	}
+	return &ExecResult{Output: buf.String(), ExitCode: insp.ExitCode}, nil
+}
+
+// InspectSelf extracts the configuration of the container we're running in
+func (di *DockerInstaller) InspectSelf() (*SimpleContainerConfig, error) {
+	id, err := GetMyContainerID()
+	if err != nil {
+		return nil, fmt.Errorf("Could not determine my container ID: %s", err)
+	}
+	return di.ExtractConfig(id)
+}
+
 // ExtractConfig extracts the containers configuration
 func (di *DockerInstaller) ExtractConfig(id string) (*SimpleContainerConfig, error) {
 	scc := SimpleContainerConfig{}
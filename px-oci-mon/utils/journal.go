@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SwitchJournalVersion is the current version of the switchover-journal file format
+const SwitchJournalVersion = 1
+
+// MoveFunc moves a file or directory from src to dest
+type MoveFunc func(src, dest string) error
+
+// SwitchMove is a single move of the OCI switchover
+type SwitchMove struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+}
+
+// SwitchJournal is the on-disk journal of the OCI switchover.  The moves are journaled one by one, so the
+// switchover interrupted by a crash can be completed or rolled back on the next start.
+// NOTE: the moves must not leave a partially moved source or destination behind (see MoveFileOrDir()).
+type SwitchJournal struct {
+	Version   int          `json:"version"`
+	Source    string       `json:"source"`
+	ImageName string       `json:"imageName,omitempty"`
+	ImageID   string       `json:"imageID,omitempty"`
+	Moves     []SwitchMove `json:"moves"`
+	Done      int          `json:"done"`
+	StartedAt time.Time    `json:"startedAt"`
+	fname     string
+}
+
+// NewSwitchJournal creates the switchover journal for a given list of moves, and persists it into a given file.
+// The image name and ID identify the OCI install being switched in (so the completed switchover can be recorded).
+func NewSwitchJournal(fname, source, imageName, imageID string, moves []SwitchMove) (*SwitchJournal, error) {
+	j := &SwitchJournal{
+		Version:   SwitchJournalVersion,
+		Source:    source,
+		ImageName: imageName,
+		ImageID:   imageID,
+		Moves:     moves,
+		StartedAt: time.Now().UTC(),
+		fname:     fname,
+	}
+	return j, j.save()
+}
+
+// LoadSwitchJournal reads the switchover journal from a given file.
+// Returns os.IsNotExist() -compatible error if the file does not exist (i.e. no switchover in progress).
+func LoadSwitchJournal(fname string) (*SwitchJournal, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	j := &SwitchJournal{fname: fname}
+	if err = json.Unmarshal(buf, j); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", fname, err)
+	} else if j.Done < 0 || j.Done > len(j.Moves) {
+		return nil, fmt.Errorf("Invalid journal %s (done %d of %d moves)", fname, j.Done, len(j.Moves))
+	}
+	return j, nil
+}
+
+func (j *SwitchJournal) save() error {
+	buf, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.fname, append(buf, '\n'))
+}
+
+// Complete returns TRUE if all the moves have been completed
+func (j *SwitchJournal) Complete() bool {
+	return j.Done >= len(j.Moves)
+}
+
+// isMoved returns TRUE if the move has been done (source gone, destination in place)
+func isMoved(m SwitchMove) bool {
+	_, errSrc := os.Stat(m.Src)
+	_, errDest := os.Stat(m.Dest)
+	return os.IsNotExist(errSrc) && errDest == nil
+}
+
+// Apply performs the remaining moves, journaling each completed move.
+func (j *SwitchJournal) Apply(move MoveFunc) error {
+	for j.Done < len(j.Moves) {
+		m := j.Moves[j.Done]
+		if isMoved(m) {
+			// crashed after the move, but before journaling it
+			logrus.Infof("> %s already moved to %s", m.Src, m.Dest)
+		} else if err := move(m.Src, m.Dest); err != nil {
+			return err
+		} else {
+			logrus.Infof("> mv %s %s -OK.", m.Src, m.Dest)
+		}
+		if err := j.saveProgress(j.Done + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveProgress journals the number of completed moves
+func (j *SwitchJournal) saveProgress(done int) error {
+	old := j.Done
+	j.Done = done
+	if err := j.save(); err != nil {
+		j.Done = old
+		return fmt.Errorf("Could not update journal %s: %s", j.fname, err)
+	}
+	return nil
+}
+
+// Rollback reverts the completed moves in reverse order, journaling each reverted move.
+func (j *SwitchJournal) Rollback(move MoveFunc) error {
+	if j.Done < len(j.Moves) && isMoved(j.Moves[j.Done]) {
+		// crashed after the move, but before journaling it
+		j.Done++
+	}
+	for j.Done > 0 {
+		m := j.Moves[j.Done-1]
+		if isMoved(SwitchMove{Src: m.Dest, Dest: m.Src}) {
+			logrus.Warnf("ROLLBACK: %s already moved back to %s", m.Dest, m.Src)
+		} else if err := move(m.Dest, m.Src); err != nil {
+			return err
+		} else {
+			logrus.Warnf("ROLLBACK: Moved %s to %s", m.Dest, m.Src)
+		}
+		if err := j.saveProgress(j.Done - 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the journal (i.e. switchover completed or rolled back)
+func (j *SwitchJournal) Remove() error {
+	if err := os.Remove(j.fname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
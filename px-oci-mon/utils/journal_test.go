@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func setupSwitchDirs(t *testing.T) (string, []SwitchMove) {
+	dir, err := ioutil.TempDir("", "oci-journal")
+	assert.NoError(t, err)
+	for _, d := range []string{"opt/bin", "new/bin", "scratch"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, d), 0700))
+	}
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "opt/bin/px-runc"), []byte("old"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "new/bin/px-runc"), []byte("new"), 0600))
+	return dir, []SwitchMove{
+		{Src: path.Join(dir, "opt/bin"), Dest: path.Join(dir, "scratch/bin")},
+		{Src: path.Join(dir, "new/bin"), Dest: path.Join(dir, "opt/bin")},
+	}
+}
+
+func readPxRunc(t *testing.T, dir string) string {
+	buf, err := ioutil.ReadFile(path.Join(dir, "opt/bin/px-runc"))
+	assert.NoError(t, err)
+	return string(buf)
+}
+
+func TestSwitchJournalApply(t *testing.T) {
+	dir, moves := setupSwitchDirs(t)
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "journal.json")
+
+	j, err := NewSwitchJournal(fname, path.Join(dir, "new"), "px:2.0", "sha256:fedcba", moves)
+	assert.NoError(t, err)
+	assert.NoError(t, j.Apply(os.Rename))
+	assert.True(t, j.Complete())
+	assert.Equal(t, "new", readPxRunc(t, dir))
+
+	j2, err := LoadSwitchJournal(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, j2.Done)
+	assert.True(t, j2.Complete())
+	assert.Equal(t, "px:2.0", j2.ImageName)
+	assert.Equal(t, "sha256:fedcba", j2.ImageID)
+
+	assert.NoError(t, j2.Remove())
+	_, err = LoadSwitchJournal(fname)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSwitchJournalRecovery(t *testing.T) {
+	dir, moves := setupSwitchDirs(t)
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "journal.json")
+
+	// "crash" after the first move, before it got journaled
+	_, err := NewSwitchJournal(fname, path.Join(dir, "new"), "px:2.0", "sha256:fedcba", moves)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Rename(moves[0].Src, moves[0].Dest))
+
+	j, err := LoadSwitchJournal(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, j.Done)
+	assert.False(t, j.Complete())
+	assert.NoError(t, j.Rollback(os.Rename))
+	assert.Equal(t, 0, j.Done)
+	assert.Equal(t, "old", readPxRunc(t, dir))
+
+	// failed move, rolled back in-process
+	failing := func(src, dest string) error {
+		if src == moves[1].Src {
+			return fmt.Errorf("mv failed")
+		}
+		return os.Rename(src, dest)
+	}
+	j, err = NewSwitchJournal(fname, path.Join(dir, "new"), "px:2.0", "sha256:fedcba", moves)
+	assert.NoError(t, err)
+	assert.Error(t, j.Apply(failing))
+	assert.Equal(t, 1, j.Done)
+	assert.NoError(t, j.Rollback(os.Rename))
+	assert.Equal(t, "old", readPxRunc(t, dir))
+	_, err = os.Stat(path.Join(dir, "new/bin/px-runc"))
+	assert.NoError(t, err)
+}
@@ -2,19 +2,28 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/portworx/sched-ops/k8s"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	enablementKey            = "px/enabled"
 	serviceKey               = "px/service"
 	pxStorageProvisionerName = "kubernetes.io/portworx-volume"
+	// ConfigMapPrefix prefixes the ConfigMap configuration sources (e.g. "configmap:kube-system/name")
+	ConfigMapPrefix = "configmap:"
 )
 
 var (
@@ -24,8 +33,28 @@ var (
 		"remove",
 		"rm",
 	}
+	k8sClient     kubernetes.Interface
+	k8sClientErr  error
+	k8sClientOnce sync.Once
 )
 
+// getK8sClient returns the Kubernetes client, configured the same way as the sched-ops client
+// NOTE: sched-ops does not expose its client, nor the APIs we need (e.g. events)
+func getK8sClient() (kubernetes.Interface, error) {
+	k8sClientOnce.Do(func() {
+		var cfg *rest.Config
+		if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+			cfg, k8sClientErr = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		} else {
+			cfg, k8sClientErr = rest.InClusterConfig()
+		}
+		if k8sClientErr == nil {
+			k8sClient, k8sClientErr = kubernetes.NewForConfig(cfg)
+		}
+	})
+	return k8sClient, k8sClientErr
+}
+
 func inArray(needle string, stack ...string) (has bool) {
 	for i := range stack {
 		if has = needle == stack[i]; has {
@@ -78,38 +107,67 @@ func RemoveServiceLabel(n *v1.Node) error {
 	return k8s.Instance().RemoveLabelOnNode(n.GetName(), serviceKey)
 }
 
+// ReadConfigSource reads the configuration from a given file, or from the ConfigMap's key if the location is
+// formatted as "configmap:<namespace>/<name>".
+func ReadConfigSource(location, key string) ([]byte, error) {
+	if !strings.HasPrefix(location, ConfigMapPrefix) {
+		return ioutil.ReadFile(location)
+	}
+
+	parts := strings.SplitN(location[len(ConfigMapPrefix):], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid ConfigMap %q (expected %s<namespace>/<name>)", location, ConfigMapPrefix)
+	}
+	cli, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := cli.CoreV1().ConfigMaps(parts[0]).Get(parts[1], meta_v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Could not get ConfigMap %s/%s: %s", parts[0], parts[1], err)
+	}
+	data, has := cm.Data[key]
+	if !has {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no %s key", parts[0], parts[1], key)
+	}
+	return []byte(data), nil
+}
+
 // FindMyNode finds LOCAL Node from Kubernetes env.
 func FindMyNode() (*v1.Node, error) {
 	return k8s.Instance().FindMyNode()
 }
 
-func podsListToString(plist []v1.Pod) string {
+func podsListToString(plist []PxConsumer) string {
 	b, sep := bytes.Buffer{}, ""
 	for _, p := range plist {
 		b.WriteString(sep)
-		b.WriteString(p.GetName())
+		b.WriteString(p.Pod.GetName())
 		sep = ", "
 	}
 	return string(b.Bytes())
 }
 
-// DrainPxVolumeConsumerPods will cordon the node (prevent new PODs), and "kick out" all current PODs that use PX volumes.
-// PARAMS: K8s Node (self) where to run the command, and bool-flag specifying if all PX-dependent nodes should be drained,
-// or only the managed ones (note only managed pods are guaranteed to restart elsewhere).
+// DrainPxVolumeConsumerPods will cordon the node (prevent new PODs), and evict all current PODs that use PX volumes
+// (in-tree or CSI, see FindPxConsumers()) via Eviction API (i.e. honoring the PodDisruptionBudgets).
+// PARAMS: K8s Node (self) where to run the command, bool-flag specifying if all PX-dependent nodes should be drained,
+// or only the managed ones (note only managed pods are guaranteed to restart elsewhere), and the drain policy.
+// Returns the per-pod drain report (nil if no pods were found).
 // NOTE: after successful call of this function, must call uncordonNode to undo the effects
-func DrainPxVolumeConsumerPods(n *v1.Node, drainAllPxDepPods bool) error {
+func DrainPxVolumeConsumerPods(ctx context.Context, n *v1.Node, drainAllPxDepPods bool, policy *DrainPolicy) (
+	*DrainReport, error) {
 	k8si := k8s.Instance()
-	pods, err := k8si.GetPodsUsingVolumePluginByNodeName(n.GetName(), pxStorageProvisionerName)
+	pods, err := FindPxConsumers(n.GetName())
 	if err != nil {
-		return fmt.Errorf("Failed to get PX consumer pods: %s", err)
+		return nil, fmt.Errorf("Failed to get PX consumer pods: %s", err)
 	}
 
 	// should we filter out only managed pods?
 	podNames := podsListToString(pods)
 	if !drainAllPxDepPods && len(pods) > 0 {
-		newPods := make([]v1.Pod, 0, len(pods))
+		newPods := make([]PxConsumer, 0, len(pods))
 		for _, p := range pods {
-			if k8si.IsPodBeingManaged(p) {
+			if k8si.IsPodBeingManaged(p.Pod) {
 				newPods = append(newPods, p)
 			}
 		}
@@ -123,20 +181,34 @@ func DrainPxVolumeConsumerPods(n *v1.Node, drainAllPxDepPods bool) error {
 
 	if len(pods) <= 0 {
 		logrus.Info("No PX consumer pods found.")
-		return nil
+		return nil, nil
 	}
 	// ELSE len(pods) > 0 ... we have extra work to do
 
+	d, err := newDrainer(policy)
+	if err != nil {
+		return nil, err
+	}
+	if err = k8si.CordonNode(n.GetName()); err != nil {
+		return nil, fmt.Errorf("Failed to cordon node: %s", err)
+	}
+
 	podNames = podsListToString(pods)
-	err = k8si.DrainPodsFromNode(n.GetName(), pods, 5*time.Minute)
+	rep, err := d.drain(ctx, pods)
 	if err != nil {
-		logrus.WithError(err).WithField("pods", podNames).Warnf("Failed to drain PX volume consumer pods")
-		err = fmt.Errorf("Failed to drain pods: %s", err)
+		logrus.WithError(err).WithField("pods", podNames).Warnf("Failed to drain PX volume consumer pods (%s)",
+			rep.Summary())
+		if e := k8si.UnCordonNode(n.GetName()); e != nil { // rollback cordon
+			logrus.WithError(e).Error("Failed to uncordon node")
+		}
+		if _, ok := err.(*DrainBlockedError); !ok {
+			err = fmt.Errorf("Failed to drain pods: %s", err)
+		}
 	} else {
-		logrus.WithField("pods", podNames).Warnf("PX consumer pods drained successfully" +
-			" - node cordon in effect.")
+		logrus.WithField("pods", podNames).Warnf("PX consumer pods drained successfully (%s)"+
+			" - node cordon in effect.", rep.Summary())
 	}
-	return err
+	return rep, err
 }
 
 // CordonNode sets up the "PODs ban", so NO new PODs can be scheduled on this node.
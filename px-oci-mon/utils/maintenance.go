@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// MaintenanceWindowsAnnotation is the node annotation defining the maintenance windows (overrides cluster config)
+	MaintenanceWindowsAnnotation = "px/maintenance-windows"
+	// MaintenanceWindowsKey is the ConfigMap key holding the maintenance windows
+	MaintenanceWindowsKey = "windows.json"
+	// maxWindowDuration limits the duration of the maintenance windows
+	maxWindowDuration = 7 * 24 * time.Hour
+	// maxWindowLookahead limits the search for the next maintenance window
+	maxWindowLookahead = 366 * 24 * time.Hour
+)
+
+// cronSchedule is the parsed cron-like schedule ("minute hour day-of-month month day-of-week")
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// parseCronField parses the cron field (e.g. "*", "*/15", "1-5", "0,30") into the bitmask
+func parseCronField(f string, lo, hi int) (uint64, error) {
+	var ret uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:idx]
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for i := from; i <= to; i += step {
+			ret |= 1 << uint(i)
+		}
+	}
+	return ret, nil
+}
+
+// parseCron parses the cron-like schedule (e.g. "0 2 * * 6" for Saturdays at 2am)
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %q (expected 5 fields)", spec)
+	}
+	c := &cronSchedule{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	var err error
+	for _, f := range []struct {
+		val    *uint64
+		lo, hi int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}} {
+		if *f.val, err = parseCronField(fields[0], f.lo, f.hi); err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %s", spec, err)
+		}
+		fields = fields[1:]
+	}
+	if c.dow&(1<<7) != 0 {
+		// both 0 and 7 are Sunday
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// matchesDay returns TRUE if the schedule matches the day (note, like cron, matches either day-of-month or
+// day-of-week if both are restricted)
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	if c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domOK, dowOK := c.dom&(1<<uint(t.Day())) != 0, c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// matches returns TRUE if the schedule matches the time (in minute resolution)
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.matchesDay(t) && c.hour&(1<<uint(t.Hour())) != 0 && c.minute&(1<<uint(t.Minute())) != 0
+}
+
+// next returns the first time after t matching the schedule (zero if none found within the lookahead)
+func (c *cronSchedule) next(t time.Time) time.Time {
+	end := t.Add(maxWindowLookahead)
+	for s := t.Truncate(time.Minute).Add(time.Minute); s.Before(end); {
+		if !c.matchesDay(s) {
+			s = time.Date(s.Year(), s.Month(), s.Day()+1, 0, 0, 0, 0, s.Location())
+		} else if c.hour&(1<<uint(s.Hour())) == 0 {
+			s = time.Date(s.Year(), s.Month(), s.Day(), s.Hour()+1, 0, 0, 0, s.Location())
+		} else if c.minute&(1<<uint(s.Minute())) == 0 {
+			s = s.Add(time.Minute)
+		} else {
+			return s
+		}
+	}
+	return time.Time{}
+}
+
+// MaintenanceWindow is the recurring window for the disruptive actions (drain, OCI switchover, PX restart)
+type MaintenanceWindow struct {
+	// Schedule is the cron-like start of the window (e.g. "0 2 * * 6" for Saturdays at 2am)
+	Schedule string `json:"schedule"`
+	// Duration is the length of the window (e.g. "4h")
+	Duration string `json:"duration"`
+	// TimeZone is the time zone of the schedule (e.g. "Europe/Berlin", dfl. UTC)
+	TimeZone string `json:"timeZone,omitempty"`
+	cron     *cronSchedule
+	dur      time.Duration
+	loc      *time.Location
+}
+
+func (w *MaintenanceWindow) init() (err error) {
+	if w.cron, err = parseCron(w.Schedule); err != nil {
+		return err
+	} else if w.dur, err = time.ParseDuration(w.Duration); err != nil {
+		return fmt.Errorf("Invalid duration %q: %s", w.Duration, err)
+	} else if w.dur < time.Minute || w.dur > maxWindowDuration {
+		return fmt.Errorf("Invalid duration %q (must be between 1m and %s)", w.Duration, maxWindowDuration)
+	} else if w.loc, err = time.LoadLocation(w.TimeZone); err != nil {
+		return fmt.Errorf("Invalid time zone %q: %s", w.TimeZone, err)
+	}
+	return nil
+}
+
+// IsOpen returns TRUE if the window is open at a given time
+func (w *MaintenanceWindow) IsOpen(t time.Time) bool {
+	t = t.In(w.loc)
+	for s := t.Truncate(time.Minute); t.Sub(s) < w.dur; s = s.Add(-time.Minute) {
+		if w.cron.matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns the next opening of the window after a given time (zero if none found)
+func (w *MaintenanceWindow) NextOpen(t time.Time) time.Time {
+	return w.cron.next(t.In(w.loc))
+}
+
+// MaintenanceWindows is the list of the maintenance windows (empty list means always open)
+type MaintenanceWindows []*MaintenanceWindow
+
+// ParseMaintenanceWindows parses and validates the JSON-encoded list of maintenance windows
+func ParseMaintenanceWindows(buf []byte) (MaintenanceWindows, error) {
+	var ret MaintenanceWindows
+	if err := json.Unmarshal(buf, &ret); err != nil {
+		return nil, fmt.Errorf("Could not parse maintenance windows: %s", err)
+	}
+	for _, w := range ret {
+		if w == nil {
+			return nil, fmt.Errorf("Invalid maintenance window: null")
+		} else if err := w.init(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// LoadMaintenanceWindows loads the maintenance windows from the node annotation, or a given file or ConfigMap
+// (see ReadConfigSource()) if the annotation is not set.  Returns nil if the windows are not defined.
+func LoadMaintenanceWindows(n *v1.Node, location string) (MaintenanceWindows, error) {
+	if ann, has := n.GetAnnotations()[MaintenanceWindowsAnnotation]; has {
+		ret, err := ParseMaintenanceWindows([]byte(ann))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid annotation %s: %s", MaintenanceWindowsAnnotation, err)
+		}
+		return ret, nil
+	} else if location == "" {
+		return nil, nil
+	}
+	buf, err := ReadConfigSource(location, MaintenanceWindowsKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read maintenance windows: %s", err)
+	}
+	return ParseMaintenanceWindows(buf)
+}
+
+// IsOpen returns TRUE if any of the windows is open at a given time (or, if no windows defined)
+func (ws MaintenanceWindows) IsOpen(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+	for _, w := range ws {
+		if w.IsOpen(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns the earliest opening of the windows after a given time (zero if none found)
+func (ws MaintenanceWindows) NextOpen(t time.Time) time.Time {
+	var ret time.Time
+	for _, w := range ws {
+		if next := w.NextOpen(t); !next.IsZero() && (ret.IsZero() || next.Before(ret)) {
+			ret = next
+		}
+	}
+	return ret
+}
+
+// PendingAction is the install/restart deferred until the maintenance window, staged on disk
+type PendingAction struct {
+	ImageName  string     `json:"imageName,omitempty"`
+	ImageID    string     `json:"imageID,omitempty"`
+	Reasons    []string   `json:"reasons"`
+	DetectedAt time.Time  `json:"detectedAt"`
+	NextWindow *time.Time `json:"nextWindow,omitempty"`
+}
+
+// Save stores the pending action into a given file
+func (p *PendingAction) Save(fname string) error {
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, append(buf, '\n'))
+}
+
+// LoadPendingAction reads the pending action from a given file.
+// Returns os.IsNotExist() -compatible error if the file does not exist (i.e. no action pending).
+func LoadPendingAction(fname string) (*PendingAction, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	p := &PendingAction{}
+	if err = json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", fname, err)
+	}
+	return p, nil
+}
+
+// RemovePendingAction removes the pending action from a given file
+func RemovePendingAction(fname string) error {
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	// Saturdays 02:00-06:00 in Berlin, and every 1st of month 22:30-23:00 UTC
+	ws, err := ParseMaintenanceWindows([]byte(`[
+		{"schedule": "0 2 * * 6", "duration": "4h", "timeZone": "Europe/Berlin"},
+		{"schedule": "30 22 1 * *", "duration": "30m"}
+	]`))
+	assert.NoError(t, err)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+
+	for _, v := range []struct {
+		t    time.Time
+		open bool
+	}{
+		{time.Date(2018, 3, 10, 1, 59, 0, 0, berlin), false}, // Saturday
+		{time.Date(2018, 3, 10, 2, 0, 0, 0, berlin), true},
+		{time.Date(2018, 3, 10, 5, 59, 59, 0, berlin), true},
+		{time.Date(2018, 3, 10, 6, 0, 0, 0, berlin), false},
+		{time.Date(2018, 3, 10, 1, 30, 0, 0, time.UTC), true}, // 02:30 in Berlin
+		{time.Date(2018, 3, 11, 3, 0, 0, 0, berlin), false},   // Sunday
+		{time.Date(2018, 3, 1, 22, 45, 0, 0, time.UTC), true},
+		{time.Date(2018, 3, 1, 23, 0, 0, 0, time.UTC), false},
+	} {
+		assert.Equal(t, v.open, ws.IsOpen(v.t), "Unexpected IsOpen() at %s", v.t)
+	}
+
+	next := ws.NextOpen(time.Date(2018, 3, 2, 12, 0, 0, 0, time.UTC))
+	assert.True(t, next.Equal(time.Date(2018, 3, 3, 2, 0, 0, 0, berlin)), "Unexpected NextOpen() %s", next)
+	next = ws.NextOpen(time.Date(2018, 3, 31, 12, 0, 0, 0, time.UTC))
+	assert.True(t, next.Equal(time.Date(2018, 4, 1, 22, 30, 0, 0, time.UTC)), "Unexpected NextOpen() %s", next)
+
+	var none MaintenanceWindows
+	assert.True(t, none.IsOpen(time.Now()))
+	assert.True(t, none.NextOpen(time.Now()).IsZero())
+
+	for _, bad := range []string{
+		`[{"schedule": "0 2 * *", "duration": "4h"}]`,
+		`[{"schedule": "0 25 * * *", "duration": "4h"}]`,
+		`[{"schedule": "*/0 2 * * *", "duration": "4h"}]`,
+		`[{"schedule": "0 2 * * 6", "duration": "4 hours"}]`,
+		`[{"schedule": "0 2 * * 6", "duration": "30s"}]`,
+		`[{"schedule": "0 2 * * 6", "duration": "4h", "timeZone": "Mars/Olympus"}]`,
+		`[null]`,
+		`{}`,
+	} {
+		_, err = ParseMaintenanceWindows([]byte(bad))
+		assert.Error(t, err, "Expected error for %s", bad)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	c, err := parseCron("*/15 9-17 * * 1-5")
+	assert.NoError(t, err)
+	assert.True(t, c.matches(time.Date(2018, 3, 9, 9, 45, 0, 0, time.UTC)))   // Friday
+	assert.False(t, c.matches(time.Date(2018, 3, 9, 9, 50, 0, 0, time.UTC)))  // not on 15m
+	assert.False(t, c.matches(time.Date(2018, 3, 10, 9, 45, 0, 0, time.UTC))) // Saturday
+
+	// day-of-month OR day-of-week, if both restricted
+	c, err = parseCron("0 0 13 * 7")
+	assert.NoError(t, err)
+	assert.True(t, c.matches(time.Date(2018, 3, 13, 0, 0, 0, 0, time.UTC))) // Tuesday, 13th
+	assert.True(t, c.matches(time.Date(2018, 3, 11, 0, 0, 0, 0, time.UTC))) // Sunday
+	assert.False(t, c.matches(time.Date(2018, 3, 12, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestLoadMaintenanceWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-maintenance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "windows.json")
+	assert.NoError(t, ioutil.WriteFile(fname, []byte(`[{"schedule": "0 2 * * *", "duration": "1h"}]`), 0600))
+
+	n := &v1.Node{}
+	ws, err := LoadMaintenanceWindows(n, "")
+	assert.NoError(t, err)
+	assert.Nil(t, ws)
+
+	ws, err = LoadMaintenanceWindows(n, fname)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ws))
+	assert.Equal(t, "0 2 * * *", ws[0].Schedule)
+
+	// node annotation overrides
+	n.ObjectMeta = meta_v1.ObjectMeta{Annotations: map[string]string{
+		MaintenanceWindowsAnnotation: `[{"schedule": "0 3 * * *", "duration": "1h"}, {"schedule": "0 4 * * *", "duration": "1h"}]`,
+	}}
+	ws, err = LoadMaintenanceWindows(n, fname)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ws))
+
+	n.Annotations[MaintenanceWindowsAnnotation] = "invalid"
+	_, err = LoadMaintenanceWindows(n, fname)
+	assert.Error(t, err)
+}
+
+func TestPendingAction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-maintenance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "pending.json")
+
+	_, err = LoadPendingAction(fname)
+	assert.True(t, os.IsNotExist(err))
+
+	next := time.Date(2018, 3, 10, 2, 0, 0, 0, time.UTC)
+	p := &PendingAction{ImageID: "sha256:0123", Reasons: []string{"install: new image"}, NextWindow: &next}
+	assert.NoError(t, p.Save(fname))
+	p2, err := LoadPendingAction(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, p.Reasons, p2.Reasons)
+	assert.True(t, next.Equal(*p2.NextWindow))
+
+	assert.NoError(t, RemovePendingAction(fname))
+	assert.NoError(t, RemovePendingAction(fname))
+	_, err = LoadPendingAction(fname)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsPrefix      = "px_oci_mon_"
+	metricsContentType = "text/plain; version=0.0.4"
+	resultOK           = "ok"
+	resultFailed       = "failed"
+)
+
+// Operations tracked via ObserveOperation()
+const (
+	OpPull    = "pull"
+	OpInstall = "install"
+	OpRestart = "restart"
+	OpDrain   = "drain"
+)
+
+// opStats tracks the count and duration of an operation
+type opStats struct {
+	ok, failed uint64
+	seconds    float64
+}
+
+// ociMetrics collects the OCI-Monitor metrics, exposed in Prometheus text format
+type ociMetrics struct {
+	lock               sync.Mutex
+	ops                map[string]*opStats
+	restActions        map[string]*opStats
+	lastError          time.Time
+	installedImageID   string
+	desiredImageID     string
+	healthFailingSince time.Time
+	pull               *PullProgress
+	pullRetries        uint64
+}
+
+var metrics = newOciMetrics()
+
+func newOciMetrics() *ociMetrics {
+	return &ociMetrics{
+		ops:         make(map[string]*opStats),
+		restActions: make(map[string]*opStats),
+	}
+}
+
+func (m *ociMetrics) observe(stats map[string]*opStats, name string, start time.Time, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	st, has := stats[name]
+	if !has {
+		st = &opStats{}
+		stats[name] = st
+	}
+	st.seconds += time.Since(start).Seconds()
+	if err != nil {
+		st.failed++
+		m.lastError = time.Now()
+	} else {
+		st.ok++
+	}
+}
+
+// ObserveOperation records the count and duration of a given operation (e.g. OpPull), started at a given time.
+// Failed operations also update the last-error timestamp.
+func ObserveOperation(op string, start time.Time, err error) {
+	metrics.observe(metrics.ops, op, start, err)
+}
+
+// MarkLastError updates the last-error timestamp
+func MarkLastError() {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.lastError = time.Now()
+}
+
+// SetImageIDs records the installed and desired (pulled) PX image IDs (empty IDs are ignored)
+func SetImageIDs(installed, desired string) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if installed != "" {
+		metrics.installedImageID = installed
+	}
+	if desired != "" {
+		metrics.desiredImageID = desired
+	}
+}
+
+// setPullProgress records the progress of the current (or last) image pull
+func setPullProgress(p *PullProgress) {
+	cp := *p
+	cp.Layers = make([]*LayerProgress, 0, len(p.Layers))
+	for _, l := range p.Layers {
+		lc := *l
+		cp.Layers = append(cp.Layers, &lc)
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.pull = &cp
+}
+
+// observePullRetry counts the retried image pulls
+func observePullRetry() {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.pullRetries++
+}
+
+// observeHealth tracks since when the PX node-health has been failing
+func (m *ociMetrics) observeHealth(healthy bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if healthy {
+		m.healthFailingSince = time.Time{}
+	} else if m.healthFailingSince.IsZero() {
+		m.healthFailingSince = time.Now()
+	}
+}
+
+// escapeLabel escapes the Prometheus label value
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// writeOpStats writes the counter and summary for the operations, labeled by a given label
+func writeOpStats(w io.Writer, name, help, label string, stats map[string]*opStats) {
+	keys := make([]string, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s%s_total %s\n# TYPE %[1]s%[2]s_total counter\n", metricsPrefix, name, help)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s_total{%s=\"%s\",result=\"%s\"} %d\n", metricsPrefix, name, label, escapeLabel(k),
+			resultOK, stats[k].ok)
+		fmt.Fprintf(w, "%s%s_total{%s=\"%s\",result=\"%s\"} %d\n", metricsPrefix, name, label, escapeLabel(k),
+			resultFailed, stats[k].failed)
+	}
+	fmt.Fprintf(w, "# HELP %s%s_duration_seconds Duration of %s\n# TYPE %[1]s%[2]s_duration_seconds summary\n",
+		metricsPrefix, name, strings.ToLower(help))
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s_duration_seconds_sum{%s=\"%s\"} %g\n", metricsPrefix, name, label, escapeLabel(k),
+			stats[k].seconds)
+		fmt.Fprintf(w, "%s%s_duration_seconds_count{%s=\"%s\"} %d\n", metricsPrefix, name, label, escapeLabel(k),
+			stats[k].ok+stats[k].failed)
+	}
+}
+
+// write writes the metrics in Prometheus text format
+func (m *ociMetrics) write(w io.Writer, state installState) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %sinstall_state Current install state of the PX-OCI service\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %sinstall_state gauge\n", metricsPrefix)
+	for _, st := range []installState{unknown, installing, finished, rolledBack} {
+		v := 0
+		if st == state {
+			v = 1
+		}
+		fmt.Fprintf(w, "%sinstall_state{state=\"%s\"} %d\n", metricsPrefix, st, v)
+	}
+
+	writeOpStats(w, "operations", "Operations performed by OCI-Monitor", "op", m.ops)
+	writeOpStats(w, "rest_actions", "REST actions performed by OCI-Monitor", "action", m.restActions)
+
+	var lastErr float64
+	if !m.lastError.IsZero() {
+		lastErr = float64(m.lastError.UnixNano()) / 1e9
+	}
+	fmt.Fprintf(w, "# HELP %slast_error_timestamp_seconds Time of the last error (0 if none)\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %slast_error_timestamp_seconds gauge\n", metricsPrefix)
+	fmt.Fprintf(w, "%slast_error_timestamp_seconds %g\n", metricsPrefix, lastErr)
+
+	upToDate := 0
+	if m.installedImageID != "" && m.installedImageID == m.desiredImageID {
+		upToDate = 1
+	}
+	fmt.Fprintf(w, "# HELP %simage_info Installed and desired PX image IDs\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %simage_info gauge\n", metricsPrefix)
+	fmt.Fprintf(w, "%simage_info{installed=\"%s\",desired=\"%s\"} 1\n", metricsPrefix,
+		escapeLabel(m.installedImageID), escapeLabel(m.desiredImageID))
+	fmt.Fprintf(w, "# HELP %simage_up_to_date Set to 1 if installed PX image matches the desired image\n",
+		metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %simage_up_to_date gauge\n", metricsPrefix)
+	fmt.Fprintf(w, "%simage_up_to_date %d\n", metricsPrefix, upToDate)
+
+	fmt.Fprintf(w, "# HELP %spull_retries_total Image pulls retried after transient errors\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %spull_retries_total counter\n", metricsPrefix)
+	fmt.Fprintf(w, "%spull_retries_total %d\n", metricsPrefix, m.pullRetries)
+	if m.pull != nil {
+		fmt.Fprintf(w, "# HELP %spull_layer_bytes Downloaded bytes of the image layers (current or last pull)\n",
+			metricsPrefix)
+		fmt.Fprintf(w, "# TYPE %spull_layer_bytes gauge\n", metricsPrefix)
+		for _, l := range m.pull.Layers {
+			fmt.Fprintf(w, "%spull_layer_bytes{image=\"%s\",layer=\"%s\"} %d\n", metricsPrefix,
+				escapeLabel(m.pull.Image), escapeLabel(l.ID), l.Current)
+		}
+		fmt.Fprintf(w, "# HELP %spull_layer_size_bytes Size of the image layers (0 if unknown)\n", metricsPrefix)
+		fmt.Fprintf(w, "# TYPE %spull_layer_size_bytes gauge\n", metricsPrefix)
+		for _, l := range m.pull.Layers {
+			fmt.Fprintf(w, "%spull_layer_size_bytes{image=\"%s\",layer=\"%s\"} %d\n", metricsPrefix,
+				escapeLabel(m.pull.Image), escapeLabel(l.ID), l.Total)
+		}
+	}
+
+	var failing float64
+	if !m.healthFailingSince.IsZero() {
+		failing = time.Since(m.healthFailingSince).Seconds()
+	}
+	fmt.Fprintf(w, "# HELP %snode_health_failing_seconds How long PX node-health has been failing (0 if healthy)\n",
+		metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %snode_health_failing_seconds gauge\n", metricsPrefix)
+	fmt.Fprintf(w, "%snode_health_failing_seconds %g\n", metricsPrefix, failing)
+}
+
+// metricsText returns the metrics in Prometheus text format
+func (m *ociMetrics) metricsText(state installState) []byte {
+	var b bytes.Buffer
+	m.write(&b, state)
+	return b.Bytes()
+}
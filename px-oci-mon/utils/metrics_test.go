@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := newOciMetrics()
+	start := time.Now().Add(-2 * time.Second)
+	m.observe(m.ops, OpPull, start, nil)
+	m.observe(m.ops, OpPull, start, fmt.Errorf("boom"))
+	m.observe(m.restActions, "restart", start, nil)
+	m.installedImageID, m.desiredImageID = "sha256:1111", "sha256:2222"
+	m.observeHealth(false)
+
+	out := string(m.metricsText(installing))
+	assert.Contains(t, out, `px_oci_mon_install_state{state="installing"} 1`)
+	assert.Contains(t, out, `px_oci_mon_install_state{state="finished"} 0`)
+	assert.Contains(t, out, `px_oci_mon_operations_total{op="pull",result="ok"} 1`)
+	assert.Contains(t, out, `px_oci_mon_operations_total{op="pull",result="failed"} 1`)
+	assert.Contains(t, out, `px_oci_mon_operations_duration_seconds_count{op="pull"} 2`)
+	assert.Contains(t, out, `px_oci_mon_rest_actions_total{action="restart",result="ok"} 1`)
+	assert.Contains(t, out, `px_oci_mon_image_info{installed="sha256:1111",desired="sha256:2222"} 1`)
+	assert.Contains(t, out, "px_oci_mon_image_up_to_date 0\n")
+	assert.NotContains(t, out, "px_oci_mon_last_error_timestamp_seconds 0\n")
+	assert.NotContains(t, out, "px_oci_mon_node_health_failing_seconds 0\n")
+
+	m.observeHealth(true)
+	m.desiredImageID = m.installedImageID
+	out = string(m.metricsText(finished))
+	assert.Contains(t, out, "px_oci_mon_image_up_to_date 1\n")
+	assert.Contains(t, out, "px_oci_mon_node_health_failing_seconds 0\n")
+}
+
+func TestHandleMetrics(t *testing.T) {
+	s := NewRESTServlet(nil, nil)
+
+	w := httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest(http.MethodGet, metricsURI, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metricsContentType, w.Header().Get(httpHeaderContentType))
+	assert.Contains(t, w.Body.String(), `px_oci_mon_install_state{state="unknown"} 1`)
+
+	w = httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest(http.MethodPost, metricsURI, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// moveTmpSuffix is appended to the destination while copying across devices
+	moveTmpSuffix = ".px-move-tmp"
+	// moveOldSuffix is appended to the source before removing it, so the interrupted removal is not mistaken for the source
+	moveOldSuffix = ".px-move-old"
+	// movePrevSuffix is appended to the replaced destination, until the copy is moved into its place
+	movePrevSuffix = ".px-move-prev"
+	// moveProgressInterval is how often the progress of the cross-device copy gets logged
+	moveProgressInterval = 10 * time.Second
+	copyBufferSize       = 1 << 20
+)
+
+// MoveResult reports the outcome of MoveFileOrDir()
+type MoveResult struct {
+	// Copied is TRUE if the move was done via copy (i.e. across devices), rather than the rename
+	Copied bool
+	// Bytes and Files are the number of bytes and entries copied (zero for renames)
+	Bytes int64
+	Files int
+}
+
+// MoveFileOrDir moves a file or a directory from src to dest.  An existing destination gets replaced.
+// The move is done via atomic rename where possible, otherwise via recursive copy, which preserves the
+// permissions, ownership, times, xattrs, symlinks, hardlinks and device nodes.  The copy is fsync-ed and verified
+// against the source (content, mode, ownership and xattrs), and moved into place at dest before the source gets
+// removed.  NOTE: the xattrs not supported by the destination filesystem are dropped (w/ warning).
+func MoveFileOrDir(src, dest string) (*MoveResult, error) {
+	err := os.Rename(src, dest)
+	if err == nil {
+		return &MoveResult{}, nil
+	} else if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return nil, fmt.Errorf("Could not move %s to %s: %s", src, dest, err)
+	}
+	logrus.Infof("Moving %s to %s across devices (copying)", src, dest)
+	return copyMove(src, dest)
+}
+
+// copyMove moves src to dest via copy to temporary location next to dest
+func copyMove(src, dest string) (*MoveResult, error) {
+	tmp, old := dest+moveTmpSuffix, src+moveOldSuffix
+	if err := recoverReplace(dest); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{tmp, old} {
+		if err := os.RemoveAll(d); err != nil {
+			return nil, fmt.Errorf("Could not remove %s: %s", d, err)
+		}
+	}
+
+	total, err := diskUsage(src)
+	if err != nil {
+		return nil, fmt.Errorf("Could not stat %s: %s", src, err)
+	}
+	c := &treeCopier{
+		links:    make(map[[2]uint64]string),
+		hashes:   make(map[string][]byte),
+		total:    total,
+		lastLog:  time.Now(),
+		progress: src,
+	}
+	if err = c.copyEntry(src, tmp); err == nil {
+		err = fsyncDir(path.Dir(tmp))
+	}
+	if err == nil {
+		err = c.verify(src, tmp)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("Could not copy %s to %s: %s", src, dest, err)
+	}
+
+	if err = replaceWith(tmp, dest); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	} else if err = os.Rename(src, old); err != nil {
+		return nil, fmt.Errorf("Could not remove %s after copy: %s", src, err)
+	} else if err = os.RemoveAll(old); err != nil {
+		logrus.WithError(err).Warnf("Could not remove %s after copy", old)
+	}
+	return &MoveResult{Copied: true, Bytes: c.bytes, Files: c.files}, nil
+}
+
+// replaceWith moves tmp into place at dest.  The existing dest is renamed aside first, and removed only once tmp is
+// in place, so the interrupted replace always leaves either the old or the new dest behind (see recoverReplace()).
+func replaceWith(tmp, dest string) error {
+	prev := dest + movePrevSuffix
+	if err := os.Rename(dest, prev); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not move %s aside: %s", dest, err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		if err2 := os.Rename(prev, dest); err2 != nil && !os.IsNotExist(err2) {
+			logrus.WithError(err2).Errorf("Could not restore %s from %s", dest, prev)
+		}
+		return fmt.Errorf("Could not move %s to %s: %s", tmp, dest, err)
+	} else if err = fsyncDir(path.Dir(dest)); err != nil {
+		return err
+	} else if err = os.RemoveAll(prev); err != nil {
+		logrus.WithError(err).Warnf("Could not remove %s", prev)
+	}
+	return nil
+}
+
+// recoverReplace recovers the replace of dest interrupted by crash: restores the previous dest if the copy was not
+// moved into place yet, or removes it otherwise
+func recoverReplace(dest string) error {
+	prev := dest + movePrevSuffix
+	if _, err := os.Lstat(prev); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(dest); os.IsNotExist(err) {
+		logrus.Warnf("Restoring %s from interrupted move", dest)
+		if err = os.Rename(prev, dest); err != nil {
+			return fmt.Errorf("Could not restore %s from %s: %s", dest, prev, err)
+		}
+		return fsyncDir(path.Dir(dest))
+	}
+	if err := os.RemoveAll(prev); err != nil {
+		return fmt.Errorf("Could not remove %s: %s", prev, err)
+	}
+	return nil
+}
+
+// diskUsage returns the total size of the regular files at a given path
+func diskUsage(fname string) (int64, error) {
+	fi, err := os.Lstat(fname)
+	if err != nil {
+		return 0, err
+	} else if !fi.IsDir() {
+		if fi.Mode().IsRegular() {
+			return fi.Size(), nil
+		}
+		return 0, nil
+	}
+	list, err := ioutil.ReadDir(fname)
+	if err != nil {
+		return 0, err
+	}
+	var ret int64
+	for _, e := range list {
+		sz, err := diskUsage(path.Join(fname, e.Name()))
+		if err != nil {
+			return 0, err
+		}
+		ret += sz
+	}
+	return ret, nil
+}
+
+// fsyncDir flushes the directory entries to disk
+func fsyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("Could not sync %s: %s", dir, err)
+	}
+	return nil
+}
+
+// treeCopier copies the directory trees, tracking the hardlinks, checksums and progress
+type treeCopier struct {
+	links        map[[2]uint64]string
+	hashes       map[string][]byte
+	bytes, total int64
+	files        int
+	lastLog      time.Time
+	progress     string
+	// skipped are the xattrs ("<dest>\x00<xattr>") not supported by the destination filesystem
+	skipped map[string]bool
+}
+
+// copyEntry recursively copies a file, directory, symlink or special file from src to dest
+func (c *treeCopier) copyEntry(src, dest string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("Could not stat %s: unsupported filesystem", src)
+	}
+
+	if !fi.IsDir() && st.Nlink > 1 {
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if first, has := c.links[key]; has {
+			c.files++
+			return os.Link(first, dest)
+		}
+		c.links[key] = dest
+	}
+
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		if err = os.Mkdir(dest, 0700); err != nil {
+			return err
+		}
+		list, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range list {
+			if err = c.copyEntry(path.Join(src, e.Name()), path.Join(dest, e.Name())); err != nil {
+				return err
+			}
+		}
+		if err = fsyncDir(dest); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(target, dest); err != nil {
+			return err
+		}
+		c.files++
+		// note: symlinks have no permissions, times or (user) xattrs worth preserving
+		return os.Lchown(dest, int(st.Uid), int(st.Gid))
+	case mode.IsRegular():
+		if err = c.copyFile(src, dest); err != nil {
+			return err
+		}
+	default:
+		// device nodes, FIFOs and sockets
+		if err = syscall.Mknod(dest, st.Mode, int(st.Rdev)); err != nil {
+			return fmt.Errorf("Could not create %s: %s", dest, err)
+		}
+	}
+	c.files++
+
+	if err = os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	} else if err = syscall.Chmod(dest, st.Mode&07777); err != nil {
+		return fmt.Errorf("Could not chmod %s: %s", dest, err)
+	} else if err = c.copyXattrs(src, dest); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix()))
+}
+
+// copyFile copies the content of a regular file, fsyncs it, and records the checksum for verify()
+func (c *treeCopier) copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if _, err = out.Write(buf[:n]); err != nil {
+				return fmt.Errorf("Could not write %s: %s", dest, err)
+			}
+			c.addProgress(int64(n))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Could not read %s: %s", src, err)
+		}
+	}
+	if err = out.Sync(); err != nil {
+		return fmt.Errorf("Could not sync %s: %s", dest, err)
+	}
+	c.hashes[dest] = h.Sum(nil)
+	return nil
+}
+
+// addProgress adds to the copied bytes, and periodically logs the progress
+func (c *treeCopier) addProgress(n int64) {
+	c.bytes += n
+	if time.Since(c.lastLog) < moveProgressInterval {
+		return
+	}
+	c.lastLog = time.Now()
+	pct := 100.0
+	if c.total > 0 {
+		pct = 100.0 * float64(c.bytes) / float64(c.total)
+	}
+	logrus.Infof("> Copying %s: %d of %d MB (%.0f%%)", c.progress, c.bytes>>20, c.total>>20, pct)
+}
+
+// listXattrs returns the extended attributes of a given file (empty if not supported)
+func listXattrs(fname string) (map[string][]byte, error) {
+	sz, err := syscall.Listxattr(fname, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not list xattrs of %s: %s", fname, err)
+	} else if sz <= 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(fname, buf); err != nil {
+		return nil, fmt.Errorf("Could not list xattrs of %s: %s", fname, err)
+	}
+	ret := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+		vsz, err := syscall.Getxattr(fname, attr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get xattr %s of %s: %s", attr, fname, err)
+		}
+		val := make([]byte, vsz)
+		if vsz, err = syscall.Getxattr(fname, attr, val); err != nil {
+			return nil, fmt.Errorf("Could not get xattr %s of %s: %s", attr, fname, err)
+		}
+		ret[attr] = val[:vsz]
+	}
+	return ret, nil
+}
+
+// copyXattrs copies the extended attributes from src to dest
+func (c *treeCopier) copyXattrs(src, dest string) error {
+	attrs, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for attr, val := range attrs {
+		if err = syscall.Setxattr(dest, attr, val, 0); err == syscall.ENOTSUP {
+			logrus.Warnf("Xattr %s not supported at %s (skipping)", attr, dest)
+			if c.skipped == nil {
+				c.skipped = make(map[string]bool)
+			}
+			c.skipped[dest+"\x00"+attr] = true
+		} else if err != nil {
+			return fmt.Errorf("Could not set xattr %s of %s: %s", attr, dest, err)
+		}
+	}
+	return nil
+}
+
+// verifyXattrs checks the source's extended attributes were copied to dest (dest may have more, e.g. SELinux labels)
+func (c *treeCopier) verifyXattrs(src, dest string) error {
+	xs, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	xd, err := listXattrs(dest)
+	if err != nil {
+		return err
+	}
+	for attr, val := range xs {
+		if c.skipped[dest+"\x00"+attr] {
+			continue
+		} else if vd, has := xd[attr]; !has || !bytes.Equal(val, vd) {
+			return fmt.Errorf("Xattr %s mismatch on %s", attr, dest)
+		}
+	}
+	return nil
+}
+
+// verify compares the copied tree at dest against the source at src
+func (c *treeCopier) verify(src, dest string) error {
+	fs, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	fd, err := os.Lstat(dest)
+	if err != nil {
+		return err
+	}
+	if fs.Mode() != fd.Mode() {
+		return fmt.Errorf("Mode mismatch on %s (%s vs %s)", dest, fd.Mode(), fs.Mode())
+	}
+	ss, ok1 := fs.Sys().(*syscall.Stat_t)
+	sd, ok2 := fd.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("Could not stat %s: unsupported filesystem", dest)
+	} else if ss.Uid != sd.Uid || ss.Gid != sd.Gid {
+		return fmt.Errorf("Ownership mismatch on %s (%d:%d vs %d:%d)", dest, sd.Uid, sd.Gid, ss.Uid, ss.Gid)
+	}
+
+	mode := fs.Mode()
+	if mode&os.ModeSymlink == 0 {
+		if err = c.verifyXattrs(src, dest); err != nil {
+			return err
+		}
+	}
+	switch {
+	case mode.IsDir():
+		ls, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		ld, err := ioutil.ReadDir(dest)
+		if err != nil {
+			return err
+		} else if len(ls) != len(ld) {
+			return fmt.Errorf("Entries mismatch on %s (%d vs %d)", dest, len(ld), len(ls))
+		}
+		for _, e := range ls {
+			if err = c.verify(path.Join(src, e.Name()), path.Join(dest, e.Name())); err != nil {
+				return err
+			}
+		}
+	case mode&os.ModeSymlink != 0:
+		ts, _ := os.Readlink(src)
+		if td, _ := os.Readlink(dest); ts != td {
+			return fmt.Errorf("Symlink mismatch on %s (%s vs %s)", dest, td, ts)
+		}
+	case mode.IsRegular():
+		if fs.Size() != fd.Size() {
+			return fmt.Errorf("Size mismatch on %s (%d vs %d)", dest, fd.Size(), fs.Size())
+		}
+		expected, has := c.hashes[dest]
+		if !has {
+			// hardlinked copy, verified via the first link
+			return nil
+		}
+		f, err := os.Open(dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err != nil {
+			return fmt.Errorf("Could not read %s: %s", dest, err)
+		} else if !bytes.Equal(h.Sum(nil), expected) {
+			return fmt.Errorf("Checksum mismatch on %s", dest)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestCopyMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-mover")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src, dest := path.Join(dir, "src"), path.Join(dir, "dest")
+	assert.NoError(t, os.MkdirAll(path.Join(src, "bin"), 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(src, "bin/px-runc"), []byte("px-runc"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(src, "config.json"), []byte("{}"), 0600))
+	assert.NoError(t, os.Symlink("bin/px-runc", path.Join(src, "px-runc")))
+	assert.NoError(t, os.Link(path.Join(src, "config.json"), path.Join(src, "config.lnk")))
+	assert.NoError(t, syscall.Mkfifo(path.Join(src, "fifo"), 0640))
+	assert.NoError(t, os.MkdirAll(dest, 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dest, "stale"), []byte("stale"), 0600))
+
+	res, err := copyMove(src, dest)
+	assert.NoError(t, err)
+	assert.True(t, res.Copied)
+	assert.Equal(t, int64(len("px-runc")+len("{}")), res.Bytes)
+	assert.Equal(t, 7, res.Files)
+
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dest, "stale"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dest + moveTmpSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	buf, err := ioutil.ReadFile(path.Join(dest, "px-runc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "px-runc", string(buf))
+	target, err := os.Readlink(path.Join(dest, "px-runc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bin/px-runc", target)
+
+	fi, err := os.Stat(path.Join(dest, "bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0750, fi.Mode())
+	fi, err = os.Stat(path.Join(dest, "bin/px-runc"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode())
+	fi, err = os.Lstat(path.Join(dest, "fifo"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe|0640, fi.Mode())
+
+	fi1, err := os.Stat(path.Join(dest, "config.json"))
+	assert.NoError(t, err)
+	fi2, err := os.Stat(path.Join(dest, "config.lnk"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fi1, fi2))
+}
+
+func TestCopyMoveVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-mover")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src, dest := path.Join(dir, "src"), path.Join(dir, "dest")
+	assert.NoError(t, os.MkdirAll(src, 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(src, "file"), []byte("data"), 0600))
+
+	c := &treeCopier{links: make(map[[2]uint64]string), hashes: make(map[string][]byte)}
+	assert.NoError(t, c.copyEntry(src, dest))
+	assert.NoError(t, c.verify(src, dest))
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dest, "file"), []byte("DATA"), 0600))
+	assert.Error(t, c.verify(src, dest))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dest, "extra"), []byte{}, 0600))
+	assert.Error(t, c.verify(src, dest))
+	assert.NoError(t, os.Remove(path.Join(dest, "extra")))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dest, "file"), []byte("data"), 0600))
+	assert.NoError(t, c.verify(src, dest))
+
+	// ownership
+	if os.Getuid() == 0 {
+		assert.NoError(t, os.Lchown(path.Join(dest, "file"), 1, 1))
+		err = c.verify(src, dest)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Ownership mismatch")
+		assert.NoError(t, os.Lchown(path.Join(dest, "file"), os.Getuid(), os.Getgid()))
+	}
+
+	// xattrs (if supported by the filesystem)
+	if syscall.Setxattr(path.Join(src, "file"), "user.px", []byte("1"), 0) == nil {
+		err = c.verify(src, dest)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Xattr user.px mismatch")
+		assert.NoError(t, c.copyXattrs(path.Join(src, "file"), path.Join(dest, "file")))
+		assert.NoError(t, c.verify(src, dest))
+	}
+}
+
+func TestCopyMoveRecoverReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-mover")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src, dest := path.Join(dir, "src"), path.Join(dir, "dest")
+	assert.NoError(t, os.MkdirAll(src, 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(src, "file"), []byte("new"), 0600))
+
+	// crashed after moving dest aside -- previous dest restored
+	assert.NoError(t, os.MkdirAll(dest+movePrevSuffix, 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dest+movePrevSuffix, "file"), []byte("old"), 0600))
+	assert.NoError(t, recoverReplace(dest))
+	buf, err := ioutil.ReadFile(path.Join(dest, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(buf))
+
+	// crashed before removing previous dest -- removed
+	assert.NoError(t, os.MkdirAll(dest+movePrevSuffix, 0700))
+	_, err = copyMove(src, dest)
+	assert.NoError(t, err)
+	buf, err = ioutil.ReadFile(path.Join(dest, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(buf))
+	_, err = os.Stat(dest + movePrevSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,378 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dfltPullRetries    = 5
+	dfltPullBackoffMin = 5 * time.Second
+	dfltPullBackoffMax = 2 * time.Minute
+	dfltPullInactivity = 5 * time.Minute
+	pullLogInterval    = 30 * time.Second
+)
+
+// Docker pull-progress statuses of the image layers
+const (
+	layerPullingFsLayer = "Pulling fs layer"
+	layerWaiting        = "Waiting"
+	layerDownloading    = "Downloading"
+	layerVerifying      = "Verifying Checksum"
+	layerDownloaded     = "Download complete"
+	layerExtracting     = "Extracting"
+	layerPullComplete   = "Pull complete"
+	layerAlreadyExists  = "Already exists"
+	layerRetrying       = "Retrying"
+)
+
+// PullConfig configures the retries, timeout and mirrors of the image pulls (Docker runtime)
+type PullConfig struct {
+	// Retries is the number of retries of the transient pull errors (0 disables)
+	Retries int
+	// BackoffMin and BackoffMax bound the exponential backoff between the retries
+	BackoffMin, BackoffMax time.Duration
+	// InactivityTimeout aborts (and retries) the pull if no progress was reported within given time (0 disables)
+	InactivityTimeout time.Duration
+	// Mirrors are the registry mirrors (e.g. "mirror.local:5000") tried if the image's registry fails
+	Mirrors []string
+}
+
+// DefaultPullConfig returns the default pull configuration
+func DefaultPullConfig() *PullConfig {
+	return &PullConfig{
+		Retries:           dfltPullRetries,
+		BackoffMin:        dfltPullBackoffMin,
+		BackoffMax:        dfltPullBackoffMax,
+		InactivityTimeout: dfltPullInactivity,
+	}
+}
+
+// LayerProgress is the download progress of the image layer
+type LayerProgress struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Current int64  `json:"current"`
+	Total   int64  `json:"total"`
+}
+
+// PullProgress is the progress of the last image pull, reported via the status API and metrics
+type PullProgress struct {
+	Image string `json:"image"`
+	// Source is the pulled reference (e.g. the image on the registry mirror)
+	Source   string           `json:"source"`
+	Attempt  int              `json:"attempt"`
+	Started  time.Time        `json:"started"`
+	Updated  time.Time        `json:"updated"`
+	Finished time.Time        `json:"finished"`
+	Current  int64            `json:"current"`
+	Total    int64            `json:"total"`
+	Layers   []*LayerProgress `json:"layers,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// layer returns the progress of a given layer, adding the new layers
+func (p *PullProgress) layer(id string) *LayerProgress {
+	for _, l := range p.Layers {
+		if l.ID == id {
+			return l
+		}
+	}
+	l := &LayerProgress{ID: id}
+	p.Layers = append(p.Layers, l)
+	return l
+}
+
+// sum updates the pull totals from the layers
+func (p *PullProgress) sum() {
+	p.Current, p.Total = 0, 0
+	for _, l := range p.Layers {
+		p.Current += l.Current
+		p.Total += l.Total
+	}
+}
+
+// Summary returns the human-readable progress (e.g. "120.5/300.0 MiB, 3/7 layers done")
+func (p *PullProgress) Summary() string {
+	done := 0
+	for _, l := range p.Layers {
+		if l.Status == layerPullComplete || l.Status == layerAlreadyExists {
+			done++
+		}
+	}
+	return fmt.Sprintf("%.1f/%.1f MiB, %d/%d layers done", float64(p.Current)/(1<<20), float64(p.Total)/(1<<20),
+		done, len(p.Layers))
+}
+
+// dockerPullMessage is the message of the Docker pull-progress JSON stream
+type dockerPullMessage struct {
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// update applies the pull message to the layer progress, and returns TRUE if the layer is being downloaded
+func (p *PullProgress) update(m *dockerPullMessage) bool {
+	if m.ID == "" {
+		return false
+	}
+	switch {
+	case m.Status == layerPullingFsLayer, m.Status == layerWaiting:
+		p.layer(m.ID).Status = m.Status
+		return true
+	case m.Status == layerDownloading:
+		l := p.layer(m.ID)
+		l.Status, l.Current = m.Status, m.ProgressDetail.Current
+		if m.ProgressDetail.Total > 0 {
+			l.Total = m.ProgressDetail.Total
+		}
+	case m.Status == layerVerifying, m.Status == layerDownloaded, m.Status == layerExtracting,
+		m.Status == layerPullComplete:
+		// note: the extraction progress counts the extracted bytes, so the download is reported as completed
+		l := p.layer(m.ID)
+		l.Status = m.Status
+		if l.Total > 0 {
+			l.Current = l.Total
+		}
+	case m.Status == layerAlreadyExists:
+		p.layer(m.ID).Status = m.Status
+	case strings.HasPrefix(m.Status, layerRetrying):
+		p.layer(m.ID).Status = m.Status
+	default:
+		return false
+	}
+	p.sum()
+	return false
+}
+
+// errPullInactive is returned when the pull did not progress within the inactivity timeout
+type errPullInactive struct {
+	timeout time.Duration
+}
+
+func (e *errPullInactive) Error() string {
+	return fmt.Sprintf("No pull progress within %s", e.timeout)
+}
+
+// nonTransientPullErrors are the registry errors not worth retrying
+var nonTransientPullErrors = []string{"unauthorized", "denied", "not found", "manifest unknown", "invalid reference",
+	"no basic auth credentials"}
+
+// transientPullErrors are the (lower-case) network and registry errors worth retrying
+var transientPullErrors = []string{"timeout", "timed out", "connection reset", "connection refused", "eof",
+	"tls handshake", "too many requests", "toomanyrequests", "service unavailable", "bad gateway",
+	"internal server error", "temporary failure", "broken pipe", "no route to host", "unexpected status code 5"}
+
+// isTransientPullError returns TRUE if the pull error is worth retrying
+func isTransientPullError(err error) bool {
+	if err == nil {
+		return false
+	} else if _, ok := err.(*errPullInactive); ok {
+		return true
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range nonTransientPullErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+	for _, s := range transientPullErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorImage returns the image reference on a given registry mirror
+// (e.g. "portworx/px-enterprise:2.0" on "mirror.local:5000" is "mirror.local:5000/portworx/px-enterprise:2.0")
+func mirrorImage(name, mirror string) string {
+	repo := imageRepository(name)
+	mirror = strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://")
+	return strings.TrimSuffix(mirror, "/") + repo[strings.Index(repo, "/"):] + ":" + imageTag(name)
+}
+
+// pullSources returns the references to pull the image from (image first, followed by the mirrors)
+func (c *PullConfig) pullSources(name string) []string {
+	ret := []string{name}
+	if ImageDigest(name) != "" {
+		// note: digest-pinned images can't be tagged, so they would not be found under the requested name
+		return ret
+	}
+	for _, m := range c.Mirrors {
+		if m = strings.TrimSpace(m); m != "" {
+			ret = append(ret, mirrorImage(name, m))
+		}
+	}
+	return ret
+}
+
+// backoff returns the delay before the retry of a given round (1..N)
+func (c *PullConfig) backoff(round int) time.Duration {
+	d := c.BackoffMin
+	for i := 1; i < round && d < c.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > c.BackoffMax {
+		d = c.BackoffMax
+	}
+	return d
+}
+
+// pullFunc pulls the image of a given reference, and returns the Docker pull-progress JSON stream
+type pullFunc func(ctx context.Context, ref string) (io.ReadCloser, error)
+
+// followPull reads the pull-progress stream, updating the progress, and calling the callback once the layers start
+// downloading.  Returns an error if the stream reports one, or if the pull did not progress within the timeout.
+func followPull(ctx context.Context, cancel context.CancelFunc, out io.Reader, p *PullProgress,
+	inactivity time.Duration, cb DownloadNotifyCbFunc) error {
+	var timer *time.Timer
+	var once sync.Once
+	inactive := make(chan struct{})
+	if inactivity > 0 {
+		timer = time.AfterFunc(inactivity, func() {
+			once.Do(func() { close(inactive) })
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	lastLog := time.Now()
+	notified := false
+	dec := json.NewDecoder(out)
+	for {
+		m := dockerPullMessage{}
+		err := dec.Decode(&m)
+		select {
+		case <-inactive:
+			return &errPullInactive{timeout: inactivity}
+		default:
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("Could not read pull progress: %s", err)
+		} else if timer != nil {
+			timer.Reset(inactivity)
+		}
+
+		if m.Error != "" || m.ErrorDetail.Message != "" {
+			if m.Error == "" {
+				m.Error = m.ErrorDetail.Message
+			}
+			return fmt.Errorf("%s", m.Error)
+		}
+		downloading := p.update(&m)
+		p.Updated = time.Now().UTC()
+		setPullProgress(p)
+		if downloading && !notified {
+			notified = true
+			if err = cb(); err != nil {
+				return err
+			}
+		}
+		if m.ID == "" && m.Status != "" {
+			logrus.Info(m.Status)
+		} else if m.Status == layerPullComplete || m.Status == layerAlreadyExists {
+			logrus.Debugf("Layer %s: %s", m.ID, m.Status)
+		}
+		if time.Since(lastLog) >= pullLogInterval {
+			logrus.Infof("Pulling %s: %s", p.Source, p.Summary())
+			lastLog = time.Now()
+		}
+	}
+}
+
+// pullWithRetries pulls the image from the image's registry or mirrors, retrying the transient errors w/
+// exponential backoff.  Returns the reference which was pulled.
+func (c *PullConfig) pullWithRetries(ctx context.Context, name string, pull pullFunc, cb DownloadNotifyCbFunc) (
+	string, error) {
+	p := &PullProgress{Image: name, Started: time.Now().UTC()}
+	defer func() {
+		p.Finished = time.Now().UTC()
+		setPullProgress(p)
+	}()
+
+	// note: the callback is called only once, even if the download is retried
+	notified := false
+	notify := func() error {
+		if notified || cb == nil {
+			return nil
+		}
+		notified = true
+		return cb()
+	}
+
+	var lastErr error
+	sources := c.pullSources(name)
+	for round := 0; round <= c.Retries; round++ {
+		if round > 0 {
+			d := c.backoff(round)
+			logrus.WithError(lastErr).Warnf("Could not pull %s - retrying in %s (retry %d of %d)", name, d, round,
+				c.Retries)
+			observePullRetry()
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(d):
+			}
+		}
+
+		transient := false
+		for _, src := range sources {
+			p.Attempt++
+			p.Source, p.Error, p.Layers, p.Current, p.Total = src, "", nil, 0, 0
+			if src != name {
+				logrus.Infof("Pulling %s from mirror %s", name, src)
+			}
+			err := c.pullOnce(ctx, src, p, pull, notify)
+			if err == nil {
+				logrus.Infof("Pulled %s: %s", src, p.Summary())
+				return src, nil
+			} else if ctx.Err() != nil {
+				p.Error = ctx.Err().Error()
+				return "", ctx.Err()
+			}
+			p.Error = err.Error()
+			logrus.WithError(err).Errorf("Could not pull %s", src)
+			lastErr, transient = err, transient || isTransientPullError(err)
+		}
+		if !transient {
+			break
+		}
+	}
+	return "", lastErr
+}
+
+// pullOnce runs the single pull attempt
+func (c *PullConfig) pullOnce(ctx context.Context, src string, p *PullProgress, pull pullFunc,
+	cb DownloadNotifyCbFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	out, err := pull(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return followPull(ctx, cancel, out, p, c.InactivityTimeout, cb)
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPullStream = `{"status":"Pulling from portworx/px-enterprise","id":"2.0"}
+{"status":"Already exists","progressDetail":{},"id":"aaa"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"bbb"}
+{"status":"Downloading","progressDetail":{"current":512,"total":2048},"id":"bbb"}
+{"status":"Downloading","progressDetail":{"current":1024,"total":2048},"id":"bbb"}
+`
+
+// testPuller fakes the Docker image pulls, replying w/ the streams (or errors) in order
+type testPuller struct {
+	refs    []string
+	replies []interface{}
+}
+
+func (tp *testPuller) pull(ctx context.Context, ref string) (io.ReadCloser, error) {
+	tp.refs = append(tp.refs, ref)
+	r := tp.replies[0]
+	if len(tp.replies) > 1 {
+		tp.replies = tp.replies[1:]
+	}
+	if err, ok := r.(error); ok {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(r.(string))), nil
+}
+
+// stalledReader reports the progress once, and blocks until the pull is cancelled
+type stalledReader struct {
+	ctx  context.Context
+	sent bool
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, `{"status":"Pulling fs layer","progressDetail":{},"id":"bbb"}`+"\n"), nil
+	}
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func (r *stalledReader) Close() error { return nil }
+
+func testPullConfig(retries int, mirrors ...string) *PullConfig {
+	return &PullConfig{Retries: retries, BackoffMin: time.Millisecond, BackoffMax: 2 * time.Millisecond,
+		InactivityTimeout: time.Second, Mirrors: mirrors}
+}
+
+func TestPullProgress(t *testing.T) {
+	tp := &testPuller{replies: []interface{}{testPullStream +
+		`{"status":"Download complete","progressDetail":{},"id":"bbb"}
+{"status":"Extracting","progressDetail":{"current":4096,"total":8192},"id":"bbb"}
+{"status":"Pull complete","progressDetail":{},"id":"bbb"}
+{"status":"Digest: sha256:abc"}
+`}}
+	calls := 0
+	src, err := testPullConfig(0).pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", tp.pull,
+		func() error {
+			calls++
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "portworx/px-enterprise:2.0", src)
+	assert.Equal(t, 1, calls)
+
+	metrics.lock.Lock()
+	p := metrics.pull
+	metrics.lock.Unlock()
+	if assert.NotNil(t, p) {
+		assert.Equal(t, 1, p.Attempt)
+		assert.Equal(t, []*LayerProgress{
+			{ID: "aaa", Status: layerAlreadyExists},
+			{ID: "bbb", Status: layerPullComplete, Current: 2048, Total: 2048},
+		}, p.Layers)
+		assert.Equal(t, int64(2048), p.Current)
+		assert.Equal(t, "0.0/0.0 MiB, 2/2 layers done", p.Summary())
+		assert.False(t, p.Finished.IsZero())
+		assert.Empty(t, p.Error)
+	}
+
+	out := string(metrics.metricsText(installing))
+	assert.Contains(t, out, `px_oci_mon_pull_layer_bytes{image="portworx/px-enterprise:2.0",layer="bbb"} 2048`)
+	assert.Contains(t, out, `px_oci_mon_pull_layer_size_bytes{image="portworx/px-enterprise:2.0",layer="aaa"} 0`)
+
+	// up-to-date image does not call back
+	tp = &testPuller{replies: []interface{}{`{"status":"Status: Image is up to date for portworx/px-enterprise:2.0"}`}}
+	_, err = testPullConfig(0).pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", tp.pull,
+		func() error {
+			calls++
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestPullRetries(t *testing.T) {
+	metrics.lock.Lock()
+	retries := metrics.pullRetries
+	metrics.lock.Unlock()
+
+	// transient errors are retried, and the callback is called once
+	tp := &testPuller{replies: []interface{}{
+		fmt.Errorf("Get https://registry-1.docker.io/v2/: net/http: TLS handshake timeout"),
+		testPullStream + `{"errorDetail":{"message":"read tcp: connection reset by peer"},` +
+			`"error":"read tcp: connection reset by peer"}`,
+		testPullStream,
+	}}
+	calls := 0
+	_, err := testPullConfig(3).pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", tp.pull,
+		func() error {
+			calls++
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Len(t, tp.refs, 3)
+	assert.Equal(t, 1, calls)
+	metrics.lock.Lock()
+	assert.Equal(t, retries+2, metrics.pullRetries)
+	assert.Equal(t, 3, metrics.pull.Attempt)
+	metrics.lock.Unlock()
+
+	// retries exhausted
+	tp = &testPuller{replies: []interface{}{fmt.Errorf("received unexpected HTTP status: 503 Service Unavailable")}}
+	_, err = testPullConfig(2).pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", tp.pull, nil)
+	assert.EqualError(t, err, "received unexpected HTTP status: 503 Service Unavailable")
+	assert.Len(t, tp.refs, 3)
+
+	// non-transient errors are not retried
+	tp = &testPuller{replies: []interface{}{
+		`{"error":"pull access denied for portworx/px-enterprise, repository does not exist"}`}}
+	_, err = testPullConfig(2).pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", tp.pull, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "pull access denied")
+	assert.Len(t, tp.refs, 1)
+	metrics.lock.Lock()
+	assert.Contains(t, metrics.pull.Error, "pull access denied")
+	metrics.lock.Unlock()
+
+	// cancelled pull is not retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tp = &testPuller{replies: []interface{}{fmt.Errorf("connection refused")}}
+	_, err = testPullConfig(2).pullWithRetries(ctx, "portworx/px-enterprise:2.0", tp.pull, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, tp.refs, 1)
+}
+
+func TestPullInactivityTimeout(t *testing.T) {
+	calls := 0
+	pull := func(ctx context.Context, ref string) (io.ReadCloser, error) {
+		if calls++; calls == 1 {
+			return &stalledReader{ctx: ctx}, nil
+		}
+		return ioutil.NopCloser(strings.NewReader(testPullStream)), nil
+	}
+	c := testPullConfig(1)
+	c.InactivityTimeout = 50 * time.Millisecond
+	_, err := c.pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", pull, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls, c.Retries = 0, 0
+	_, err = c.pullWithRetries(context.Background(), "portworx/px-enterprise:2.0", pull, nil)
+	assert.EqualError(t, err, "No pull progress within 50ms")
+}
+
+func TestPullMirrors(t *testing.T) {
+	tp := &testPuller{replies: []interface{}{
+		fmt.Errorf("dial tcp: lookup registry-1.docker.io: no such host: timeout"),
+		testPullStream,
+	}}
+	src, err := testPullConfig(1, "https://mirror.local:5000/").pullWithRetries(context.Background(),
+		"portworx/px-enterprise:2.0", tp.pull, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "mirror.local:5000/portworx/px-enterprise:2.0", src)
+	assert.Equal(t, []string{"portworx/px-enterprise:2.0", "mirror.local:5000/portworx/px-enterprise:2.0"}, tp.refs)
+
+	c := testPullConfig(0, "mirror.local", " ")
+	assert.Equal(t, []string{"busybox", "mirror.local/library/busybox:latest"}, c.pullSources("busybox"))
+	assert.Equal(t, []string{"portworx/px-enterprise@" + testDigest1},
+		c.pullSources("portworx/px-enterprise@"+testDigest1))
+}
+
+func TestIsTransientPullError(t *testing.T) {
+	for _, v := range []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{&errPullInactive{timeout: time.Minute}, true},
+		{fmt.Errorf("net/http: TLS handshake timeout"), true},
+		{fmt.Errorf("toomanyrequests: You have reached your pull rate limit"), true},
+		{fmt.Errorf("unexpected EOF"), true},
+		{fmt.Errorf("unauthorized: authentication required"), false},
+		{fmt.Errorf("manifest for portworx/px-enterprise:9.9 not found: manifest unknown"), false},
+		{fmt.Errorf("invalid reference format"), false},
+	} {
+		assert.Equal(t, v.expected, isTransientPullError(v.err), fmt.Sprint(v.err))
+	}
+
+	c := &PullConfig{BackoffMin: time.Second, BackoffMax: 5 * time.Second}
+	assert.Equal(t, time.Second, c.backoff(1))
+	assert.Equal(t, 4*time.Second, c.backoff(3))
+	assert.Equal(t, 5*time.Second, c.backoff(10))
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const clusterEnumeratePath = "/v1/cluster/enumerate"
+
+// PX node statuses (see openstorage api.Status)
+const (
+	pxStatusOK               = 2
+	pxStatusDecommission     = 6
+	pxStatusStorageDegraded  = 9
+	pxStatusStorageRebalance = 11
+)
+
+// pxNode is the PX node, as reported via the cluster-enumerate API
+type pxNode struct {
+	ID       string `json:"Id"`
+	Hostname string `json:"Hostname"`
+	MgmtIP   string `json:"MgmtIp"`
+	Status   int    `json:"Status"`
+}
+
+// pxCluster is the PX cluster, as reported via the cluster-enumerate API
+type pxCluster struct {
+	ID     string   `json:"Id"`
+	NodeID string   `json:"NodeId"`
+	Status int      `json:"Status"`
+	Nodes  []pxNode `json:"Nodes"`
+}
+
+func (n *pxNode) isOnline() bool {
+	return n.Status == pxStatusOK || n.Status == pxStatusStorageDegraded || n.Status == pxStatusStorageRebalance
+}
+
+func (n *pxNode) name() string {
+	if n.Hostname != "" {
+		return n.Hostname
+	}
+	return n.ID
+}
+
+// enumerateCluster retrieves the PX cluster membership and status via local PX REST API
+func (s *OciRESTServlet) enumerateCluster() (*pxCluster, error) {
+	pxResp, err := s.cli.Get(s.pxEndpoint + clusterEnumeratePath)
+	if err != nil {
+		return nil, err
+	}
+	defer pxResp.Body.Close()
+	if pxResp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, pxResp.Body)
+		return nil, fmt.Errorf("PX cluster-enumerate returned %s", pxResp.Status)
+	}
+	c := &pxCluster{}
+	if err = json.NewDecoder(pxResp.Body).Decode(c); err != nil {
+		return nil, fmt.Errorf("Could not decode PX cluster-enumerate: %s", err)
+	}
+	return c, nil
+}
+
+// IsPxNotRunning returns TRUE if the PX REST API call failed because PX is not running on this node (i.e. the
+// connection was refused), as opposed to PX being unresponsive or unhealthy
+func IsPxNotRunning(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// CheckQuorum checks if the local PX node can be taken down without breaking the PX cluster quorum.
+// Returns the reason if the node should not be taken down, or an error if the cluster status is not available
+// (e.g. PX is not running on this node).
+func (s *OciRESTServlet) CheckQuorum() (string, error) {
+	c, err := s.enumerateCluster()
+	if err != nil {
+		return "", err
+	}
+
+	members, online, meOnline := 0, 0, false
+	offline := make([]string, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		if n.Status == pxStatusDecommission {
+			continue
+		}
+		members++
+		if n.isOnline() {
+			online++
+			meOnline = meOnline || n.ID == c.NodeID
+		} else if n.ID != c.NodeID {
+			offline = append(offline, n.name())
+		}
+	}
+	if members <= 1 || !meOnline {
+		// single-node cluster, or this node is not contributing to the quorum
+		return "", nil
+	} else if len(offline) > 0 {
+		sort.Strings(offline)
+		return fmt.Sprintf("other PX nodes offline: %s", strings.Join(offline, ", ")), nil
+	} else if quorum := members/2 + 1; online-1 < quorum {
+		return fmt.Sprintf("taking this node down would break PX quorum (%d of %d nodes online, quorum %d)",
+			online, members, quorum), nil
+	}
+	return "", nil
+}
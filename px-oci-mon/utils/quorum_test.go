@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func quorumStub(t *testing.T, c *pxCluster, code int) (*OciRESTServlet, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, clusterEnumeratePath, r.URL.Path)
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+	}))
+	s := NewRESTServlet(nil, nil)
+	s.pxEndpoint = srv.URL
+	return s, srv.Close
+}
+
+func TestCheckQuorum(t *testing.T) {
+	data := []struct {
+		name     string
+		statuses []int
+		expected string
+	}{
+		{"single node", []int{pxStatusOK}, ""},
+		{"all online", []int{pxStatusOK, pxStatusOK, pxStatusOK}, ""},
+		{"degraded counts as online", []int{pxStatusOK, pxStatusStorageDegraded, pxStatusStorageRebalance}, ""},
+		{"other offline", []int{pxStatusOK, 3, pxStatusOK}, "other PX nodes offline: node-1"},
+		{"two nodes", []int{pxStatusOK, pxStatusOK},
+			"taking this node down would break PX quorum (2 of 2 nodes online, quorum 2)"},
+		{"decommissioned ignored", []int{pxStatusOK, pxStatusDecommission, pxStatusOK, pxStatusOK}, ""},
+		{"this node offline", []int{3, 3, pxStatusOK}, ""},
+	}
+	for _, d := range data {
+		c := &pxCluster{ID: "px-cluster", NodeID: "id-0"}
+		for i, st := range d.statuses {
+			c.Nodes = append(c.Nodes, pxNode{
+				ID: "id-" + string('0'+rune(i)), Hostname: "node-" + string('0'+rune(i)), Status: st,
+			})
+		}
+		s, done := quorumStub(t, c, http.StatusOK)
+		reason, err := s.CheckQuorum()
+		done()
+		assert.NoError(t, err, d.name)
+		assert.Equal(t, d.expected, reason, d.name)
+	}
+}
+
+func TestCheckQuorumUnavailable(t *testing.T) {
+	s, done := quorumStub(t, nil, http.StatusServiceUnavailable)
+	defer done()
+	_, err := s.CheckQuorum()
+	assert.Error(t, err)
+	assert.False(t, IsPxNotRunning(err))
+
+	s.pxEndpoint = "http://127.0.0.1:1"
+	_, err = s.CheckQuorum()
+	assert.Error(t, err)
+	assert.True(t, IsPxNotRunning(err))
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRegistryConfig is the default location of the mounted registry credentials (e.g. Kubernetes secret of
+// `kubernetes.io/dockerconfigjson` type)
+const DefaultRegistryConfig = "/var/run/secrets/px-registry/.dockerconfigjson"
+
+// dockerConfig is the `.dockerconfigjson` (or Docker's `config.json`) content
+type dockerConfig struct {
+	Auths map[string]types.AuthConfig `json:"auths"`
+}
+
+// registryKey is the normalized registry entry of the docker config (e.g. "https://index.docker.io/v1/" is
+// normalized to host "docker.io", "registry.local:5000/team" to host "registry.local:5000" and path "team/")
+type registryKey struct {
+	host, path string
+	auth       types.AuthConfig
+}
+
+// RegistryCredentials selects the registry credentials for the image, from the docker config file (reloaded when
+// the file changes), or the static user/password if the config file does not exist
+type RegistryCredentials struct {
+	configFile string
+	user, pass string
+	lock       sync.Mutex
+	modTime    time.Time
+	size       int64
+	keys       []registryKey
+}
+
+// NewRegistryCredentials creates the registry credentials, using a given docker config file (if exists), or the
+// static user/password
+func NewRegistryCredentials(configFile, user, pass string) *RegistryCredentials {
+	return &RegistryCredentials{configFile: configFile, user: user, pass: pass}
+}
+
+// parseDockerConfig parses the `.dockerconfigjson`, `config.json` or legacy `.dockercfg` docker config
+func parseDockerConfig(buf []byte) ([]registryKey, error) {
+	cfg := dockerConfig{}
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, err
+	} else if cfg.Auths == nil {
+		// legacy .dockercfg format (no "auths" wrapper)
+		if err = json.Unmarshal(buf, &cfg.Auths); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]registryKey, 0, len(cfg.Auths))
+	for reg, auth := range cfg.Auths {
+		if auth.Auth != "" && auth.Username == "" {
+			dec, err := base64.StdEncoding.DecodeString(auth.Auth)
+			parts := strings.SplitN(string(dec), ":", 2)
+			if err != nil || len(parts) != 2 {
+				return nil, fmt.Errorf("Invalid auth entry for registry %s", reg)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		auth.Auth, auth.ServerAddress = "", reg
+		k := registryKey{auth: auth}
+		reg = strings.TrimPrefix(strings.TrimPrefix(reg, "https://"), "http://")
+		parts := strings.SplitN(reg, "/", 2)
+		k.host = imageRepository(parts[0] + "/x")
+		k.host = k.host[:strings.Index(k.host, "/")]
+		if len(parts) > 1 {
+			// strip the API version (e.g. "https://index.docker.io/v1/")
+			if p := strings.Trim(parts[1], "/"); p != "" && p != "v1" && p != "v2" {
+				k.path = p + "/"
+			}
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+// matches returns TRUE if the registry key matches the image host and path.  The host may start with "*."
+// wildcard, matching a single domain component.
+func (k *registryKey) matches(host, path string) bool {
+	if strings.HasPrefix(k.host, "*.") {
+		i := strings.Index(host, ".")
+		if i < 0 || host[i:] != k.host[1:] {
+			return false
+		}
+	} else if k.host != host {
+		return false
+	}
+	return strings.HasPrefix(path+"/", k.path)
+}
+
+// reload reloads the docker config if the file has changed, and returns FALSE if the file does not exist
+func (c *RegistryCredentials) reload() bool {
+	if c.configFile == "" {
+		return false
+	}
+	st, err := os.Stat(c.configFile)
+	if os.IsNotExist(err) {
+		if c.keys != nil {
+			logrus.Warnf("Registry credentials %s removed", c.configFile)
+			c.keys, c.modTime, c.size = nil, time.Time{}, 0
+		}
+		return false
+	} else if err != nil {
+		logrus.WithError(err).Errorf("Could not check registry credentials %s", c.configFile)
+		return c.keys != nil
+	} else if st.ModTime().Equal(c.modTime) && st.Size() == c.size && c.keys != nil {
+		return true
+	}
+
+	buf, err := ioutil.ReadFile(c.configFile)
+	if err == nil {
+		var keys []registryKey
+		if keys, err = parseDockerConfig(buf); err == nil {
+			c.keys, c.modTime, c.size = keys, st.ModTime(), st.Size()
+			logrus.Infof("Loaded registry credentials for %d registries from %s", len(keys), c.configFile)
+			return true
+		}
+	}
+	// keep the previous credentials, but retry on next lookup
+	logrus.WithError(err).Errorf("Could not load registry credentials %s", c.configFile)
+	return c.keys != nil
+}
+
+// Lookup returns the credentials for a given image (nil if none), where the most specific registry entry wins
+func (c *RegistryCredentials) Lookup(image string) *types.AuthConfig {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.reload() {
+		if c.user == "" {
+			return nil
+		}
+		return &types.AuthConfig{Username: c.user, Password: c.pass}
+	}
+
+	repo := imageRepository(image)
+	i := strings.Index(repo, "/")
+	host, path := repo[:i], repo[i+1:]
+	var best *registryKey
+	for j := range c.keys {
+		k := &c.keys[j]
+		if !k.matches(host, path) {
+			continue
+		} else if best == nil || len(k.path) > len(best.path) ||
+			(len(k.path) == len(best.path) && strings.HasPrefix(best.host, "*.") && !strings.HasPrefix(k.host, "*.")) {
+			best = k
+		}
+	}
+	if best == nil {
+		logrus.Debugf("No registry credentials found for %s", image)
+		return nil
+	}
+	auth := best.auth
+	return &auth
+}
+
+// encodeDockerAuth encodes the credentials for the Docker API's X-Registry-Auth header (empty if none)
+func encodeDockerAuth(auth *types.AuthConfig) string {
+	if auth == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(auth)
+	return base64.URLEncoding.EncodeToString(buf)
+}
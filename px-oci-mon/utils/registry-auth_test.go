@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRegistryCredentialsLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-registry")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfgFile := path.Join(dir, ".dockerconfigjson")
+
+	// no file -- falls back to static credentials
+	c := NewRegistryCredentials(cfgFile, "envuser", "envpass")
+	assert.Equal(t, &types.AuthConfig{Username: "envuser", Password: "envpass"}, c.Lookup("portworx/px-enterprise:2.0"))
+	assert.Nil(t, NewRegistryCredentials(cfgFile, "", "").Lookup("portworx/px-enterprise:2.0"))
+	assert.Nil(t, (*RegistryCredentials)(nil).Lookup("portworx/px-enterprise:2.0"))
+
+	err = ioutil.WriteFile(cfgFile, []byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("hub:hubpass"))+`"},
+		"mirror.local:5000": {"username": "mirror", "password": "mirrorpass"},
+		"mirror.local:5000/team": {"username": "team", "password": "teampass"},
+		"*.corp.example.com": {"username": "corp", "password": "corppass"},
+		"eu.corp.example.com": {"identitytoken": "eutoken"}
+	}}`), 0600)
+	assert.NoError(t, err)
+
+	for _, v := range []struct{ image, user, pass string }{
+		{"portworx/px-enterprise:2.0", "hub", "hubpass"},
+		{"docker.io/portworx/px-enterprise:2.0", "hub", "hubpass"},
+		{"mirror.local:5000/portworx/px-enterprise:2.0", "mirror", "mirrorpass"},
+		{"mirror.local:5000/team/px-enterprise:2.0", "team", "teampass"},
+		{"mirror.local:5000/teams/px-enterprise:2.0", "mirror", "mirrorpass"},
+		{"us.corp.example.com/px-enterprise:2.0", "corp", "corppass"},
+		{"eu.corp.example.com/px-enterprise:2.0", "", ""},
+	} {
+		auth := c.Lookup(v.image)
+		if assert.NotNil(t, auth, v.image) {
+			assert.Equal(t, v.user, auth.Username, v.image)
+			assert.Equal(t, v.pass, auth.Password, v.image)
+		}
+	}
+	assert.Equal(t, "eutoken", c.Lookup("eu.corp.example.com/px-enterprise:2.0").IdentityToken)
+	assert.Nil(t, c.Lookup("quay.io/portworx/px-enterprise:2.0"))
+	assert.Nil(t, c.Lookup("a.b.corp.example.com/px-enterprise:2.0"))
+
+	// refreshed credentials (legacy .dockercfg format)
+	err = ioutil.WriteFile(cfgFile, []byte(`{"quay.io": {"username": "quay", "password": "quaypass"}}`), 0600)
+	assert.NoError(t, err)
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(cfgFile, later, later))
+	assert.Nil(t, c.Lookup("portworx/px-enterprise:2.0"))
+	assert.Equal(t, "quay", c.Lookup("quay.io/portworx/px-enterprise:2.0").Username)
+
+	// broken file keeps the previous credentials
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(`{"auths": `), 0600))
+	assert.Equal(t, "quay", c.Lookup("quay.io/portworx/px-enterprise:2.0").Username)
+
+	// removed file falls back to static credentials
+	assert.NoError(t, os.Remove(cfgFile))
+	assert.Equal(t, "envuser", c.Lookup("quay.io/portworx/px-enterprise:2.0").Username)
+}
+
+func TestEncodeDockerAuth(t *testing.T) {
+	assert.Empty(t, encodeDockerAuth(nil))
+	buf, err := base64.URLEncoding.DecodeString(encodeDockerAuth(&types.AuthConfig{Username: "u", Password: "p?>"}))
+	assert.NoError(t, err)
+	auth := types.AuthConfig{}
+	assert.NoError(t, json.Unmarshal(buf, &auth))
+	assert.Equal(t, "p?>", auth.Password)
+}
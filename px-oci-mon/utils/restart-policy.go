@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Actions of the restart-classification rules
+const (
+	// RestartActionIgnore ignores the change
+	RestartActionIgnore = "ignore"
+	// RestartActionNextRestart applies the change on the next restart of the PX service
+	RestartActionNextRestart = "next-restart"
+	// RestartActionRestart restarts the PX service to apply the change
+	RestartActionRestart = "restart"
+)
+
+// Kinds of the px-runc configuration changes
+const (
+	ChangeMount = "mount"
+	ChangeEnv   = "env"
+	ChangeArg   = "arg"
+)
+
+const (
+	// RestartPolicyKey is the ConfigMap key holding the restart policy
+	RestartPolicyKey = "policy.json"
+	// KubeletDirVar is expanded in the mount prefixes to the kubelet's root directory
+	KubeletDirVar   = "KUBELET_DIR"
+	defaultRuleName = "default"
+)
+
+// RestartRule classifies the px-runc configuration changes.  The rule matches the mounts by prefix, environment by
+// key and arguments by name, where the keys and names may end with "*" wildcard (e.g. "KUBERNETES_*").
+type RestartRule struct {
+	Name          string   `json:"name"`
+	MountPrefixes []string `json:"mountPrefixes,omitempty"`
+	EnvKeys       []string `json:"envKeys,omitempty"`
+	Args          []string `json:"args,omitempty"`
+	Action        string   `json:"action"`
+}
+
+// RestartPolicy is the ordered list of the restart-classification rules (first matching rule wins)
+type RestartPolicy struct {
+	Rules []RestartRule `json:"rules"`
+	// DefaultAction applies to the changes not matched by any rule (dfl. RestartActionRestart)
+	DefaultAction string `json:"defaultAction,omitempty"`
+}
+
+// DefaultRestartPolicy returns the default policy, which ignores the POD-specific mounts
+func DefaultRestartPolicy() *RestartPolicy {
+	return &RestartPolicy{
+		Rules: []RestartRule{{
+			Name:          "pod-mounts",
+			MountPrefixes: []string{"${" + KubeletDirVar + "}/pods/"},
+			Action:        RestartActionIgnore,
+		}},
+		DefaultAction: RestartActionRestart,
+	}
+}
+
+func isValidRestartAction(a string) bool {
+	return a == RestartActionIgnore || a == RestartActionNextRestart || a == RestartActionRestart
+}
+
+// ParseRestartPolicy parses and validates the JSON-encoded restart policy
+func ParseRestartPolicy(buf []byte) (*RestartPolicy, error) {
+	p := &RestartPolicy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("Could not parse restart policy: %s", err)
+	}
+	if p.DefaultAction == "" {
+		p.DefaultAction = RestartActionRestart
+	} else if !isValidRestartAction(p.DefaultAction) {
+		return nil, fmt.Errorf("Invalid default action %q in restart policy", p.DefaultAction)
+	}
+	for i, r := range p.Rules {
+		if !isValidRestartAction(r.Action) {
+			return nil, fmt.Errorf("Invalid action %q in restart policy rule #%d", r.Action, i+1)
+		} else if len(r.MountPrefixes) == 0 && len(r.EnvKeys) == 0 && len(r.Args) == 0 {
+			return nil, fmt.Errorf("Restart policy rule #%d does not match anything", i+1)
+		}
+		if r.Name == "" {
+			p.Rules[i].Name = fmt.Sprintf("rule#%d", i+1)
+		}
+	}
+	return p, nil
+}
+
+// LoadRestartPolicy loads the restart policy from a given file, or ConfigMap (see ReadConfigSource())
+func LoadRestartPolicy(location string) (*RestartPolicy, error) {
+	buf, err := ReadConfigSource(location, RestartPolicyKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read restart policy: %s", err)
+	}
+	return ParseRestartPolicy(buf)
+}
+
+// WithKubeletDir returns the copy of the policy with the kubelet's root directory expanded in the mount prefixes.
+// If the kubelet directory is empty (i.e. unknown), the prefixes referencing it are dropped.
+func (p *RestartPolicy) WithKubeletDir(kubeletDir string) *RestartPolicy {
+	ret := &RestartPolicy{Rules: make([]RestartRule, len(p.Rules)), DefaultAction: p.DefaultAction}
+	for i, r := range p.Rules {
+		ret.Rules[i] = r
+		ret.Rules[i].MountPrefixes = make([]string, 0, len(r.MountPrefixes))
+		for _, pfx := range r.MountPrefixes {
+			missing := false
+			pfx = os.Expand(pfx, func(v string) string {
+				if v == KubeletDirVar && kubeletDir != "" {
+					return kubeletDir
+				}
+				missing = true
+				return ""
+			})
+			if !missing {
+				ret.Rules[i].MountPrefixes = append(ret.Rules[i].MountPrefixes, pfx)
+			}
+		}
+	}
+	return ret
+}
+
+// matchName matches the name against a given pattern, which may end with "*" wildcard
+func matchName(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, pattern[:len(pattern)-1])
+	}
+	return pattern == name
+}
+
+func (r *RestartRule) matches(kind, value string) bool {
+	switch kind {
+	case ChangeMount:
+		for _, pfx := range r.MountPrefixes {
+			if strings.HasPrefix(value, pfx) {
+				return true
+			}
+		}
+	case ChangeEnv:
+		key := strings.SplitN(value, "=", 2)[0]
+		for _, k := range r.EnvKeys {
+			if matchName(k, key) {
+				return true
+			}
+		}
+	case ChangeArg:
+		for _, a := range r.Args {
+			if matchName(a, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Classify returns the action and the name of the matching rule for a given change (i.e. mount, "KEY=VALUE"
+// environment, or argument name)
+func (p *RestartPolicy) Classify(kind, value string) (string, string) {
+	for _, r := range p.Rules {
+		if r.matches(kind, value) {
+			return r.Action, r.Name
+		}
+	}
+	return p.DefaultAction, defaultRuleName
+}
+
+// GroupArgs groups the px-runc arguments by name (e.g. "-a -d eth1" -> [[-a] [-d eth1]])
+func GroupArgs(args []string) [][]string {
+	ret := make([][]string, 0, len(args))
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") || len(ret) == 0 {
+			ret = append(ret, []string{a})
+		} else {
+			ret[len(ret)-1] = append(ret[len(ret)-1], a)
+		}
+	}
+	return ret
+}
+
+// Filter returns the arguments, mounts and environment, which require the restart according to the policy
+func (p *RestartPolicy) Filter(args, mounts, env []string) ([]string, []string, []string) {
+	argsFilt := make([]string, 0, len(args))
+	for _, g := range GroupArgs(args) {
+		if a, _ := p.Classify(ChangeArg, g[0]); a == RestartActionRestart {
+			argsFilt = append(argsFilt, g...)
+		}
+	}
+	mountsFilt := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		if a, _ := p.Classify(ChangeMount, m); a == RestartActionRestart {
+			mountsFilt = append(mountsFilt, m)
+		}
+	}
+	envFilt := make([]string, 0, len(env))
+	for _, e := range env {
+		if a, _ := p.Classify(ChangeEnv, e); a == RestartActionRestart {
+			envFilt = append(envFilt, e)
+		}
+	}
+	return argsFilt, mountsFilt, envFilt
+}
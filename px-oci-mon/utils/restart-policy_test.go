@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	pol, err := ParseRestartPolicy([]byte(`{
+	"rules": [
+		{"mountPrefixes": ["${KUBELET_DIR}/pods/"], "action": "ignore"},
+		{"name": "k8s-env", "envKeys": ["KUBERNETES_*", "PX_TRACE"], "action": "ignore"},
+		{"name": "debug", "args": ["--debug"], "envKeys": ["PX_DEBUG"], "action": "next-restart"}
+	],
+	"defaultAction": "restart"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "rule#1", pol.Rules[0].Name)
+
+	resolved := pol.WithKubeletDir("/var/lib/kubelet")
+	for _, v := range []struct {
+		kind, value, action, rule string
+	}{
+		{ChangeMount, "/var/lib/kubelet/pods/123/etc-hosts:/etc/hosts", RestartActionIgnore, "rule#1"},
+		{ChangeMount, "/var/cores/:/var/cores/", RestartActionRestart, "default"},
+		{ChangeEnv, "KUBERNETES_PORT=tcp://10.96.0.1:443", RestartActionIgnore, "k8s-env"},
+		{ChangeEnv, "PX_TRACE=1", RestartActionIgnore, "k8s-env"},
+		{ChangeEnv, "PX_TRACE_ALL=1", RestartActionRestart, "default"},
+		{ChangeEnv, "PX_DEBUG=1", RestartActionNextRestart, "debug"},
+		{ChangeArg, "--debug", RestartActionNextRestart, "debug"},
+		{ChangeArg, "-d", RestartActionRestart, "default"},
+	} {
+		action, rule := resolved.Classify(v.kind, v.value)
+		assert.Equal(t, v.action, action, "Unexpected action for %s %s", v.kind, v.value)
+		assert.Equal(t, v.rule, rule, "Unexpected rule for %s %s", v.kind, v.value)
+	}
+
+	// unknown kubelet directory drops the prefixes
+	action, _ := pol.WithKubeletDir("").Classify(ChangeMount, "/var/lib/kubelet/pods/123/etc-hosts:/etc/hosts")
+	assert.Equal(t, RestartActionRestart, action)
+
+	args, mounts, env := resolved.Filter(
+		[]string{"-c", "cluster", "--debug", "-d", "eth1"},
+		[]string{"/var/lib/kubelet/pods/123/etc-hosts:/etc/hosts", "/var/cores/:/var/cores/"},
+		[]string{"KUBERNETES_PORT=tcp://10.96.0.1:443", "PATH=/bin"})
+	assert.Equal(t, []string{"-c", "cluster", "-d", "eth1"}, args)
+	assert.Equal(t, []string{"/var/cores/:/var/cores/"}, mounts)
+	assert.Equal(t, []string{"PATH=/bin"}, env)
+
+	for _, bad := range []string{
+		`{"rules": [{"envKeys": ["FOO"], "action": "reboot"}]}`,
+		`{"rules": [{"action": "ignore"}]}`,
+		`{"defaultAction": "never"}`,
+		`{"rules": `,
+	} {
+		_, err = ParseRestartPolicy([]byte(bad))
+		assert.Error(t, err, "Expected error for %s", bad)
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetainedRecordFile is the install-state record kept with each retained OCI install
+const RetainedRecordFile = "install.json"
+
+// RetainedInstall is the previous OCI install, retained for on-demand rollback
+type RetainedInstall struct {
+	Dir   string
+	State *InstallState
+}
+
+// RetainedInstallDir returns the directory for the retained install of a given image ID
+func RetainedInstallDir(baseDir, imageID string) string {
+	return path.Join(baseDir, ShortID(imageID))
+}
+
+// ListRetainedInstalls returns the retained OCI installs in a given directory, newest first.
+// Directories without a (valid) install-state record are skipped.
+func ListRetainedInstalls(baseDir string) ([]*RetainedInstall, error) {
+	dirs, err := ioutil.ReadDir(baseDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ret := make([]*RetainedInstall, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := path.Join(baseDir, d.Name())
+		st, err := LoadInstallState(path.Join(dir, RetainedRecordFile))
+		if err != nil {
+			logrus.WithError(err).Warn("Skipping retained install at ", dir)
+			continue
+		}
+		ret = append(ret, &RetainedInstall{Dir: dir, State: st})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].State.UpdatedAt.After(ret[j].State.UpdatedAt)
+	})
+	return ret, nil
+}
+
+// FindRetainedInstall returns the retained OCI install matching a given image ID (full, short or prefix), or the
+// newest retained install if the image ID is empty.
+func FindRetainedInstall(baseDir, imageID string) (*RetainedInstall, error) {
+	list, err := ListRetainedInstalls(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list retained installs: %s", err)
+	} else if len(list) == 0 {
+		return nil, fmt.Errorf("No retained installs found at %s", baseDir)
+	} else if imageID == "" {
+		return list[0], nil
+	}
+	short := ShortID(imageID)
+	for _, ri := range list {
+		if ri.State.ImageID == imageID || strings.HasPrefix(ShortID(ri.State.ImageID), short) {
+			return ri, nil
+		}
+	}
+	return nil, fmt.Errorf("No retained install found for image %s", imageID)
+}
+
+// PruneRetainedInstalls removes all but the newest `keep` retained OCI installs.
+func PruneRetainedInstalls(baseDir string, keep int) error {
+	list, err := ListRetainedInstalls(baseDir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(list); i++ {
+		logrus.Infof("Removing retained install %s at %s", ShortID(list[i].State.ImageID), list[i].Dir)
+		if err = os.RemoveAll(list[i].Dir); err != nil {
+			return fmt.Errorf("Could not remove %s: %s", list[i].Dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Spec statuses reported by `px-runc install`
+const (
+	SpecCreated   = "CREATED"
+	SpecUpdated   = "UPDATED"
+	SpecUnchanged = "UNCHANGED"
+)
+
+var (
+	// reLogrusText matches the logrus text-formatter lines (e.g. `time="..." level=info msg="..."`)
+	reLogrusText = regexp.MustCompile(`^time="[^"]*" level=\w+ msg=(".*")$`)
+	// reLogrusTTY matches the logrus TTY-formatter lines (e.g. `INFO[0000] ...`)
+	reLogrusTTY = regexp.MustCompile(`^[A-Z]+\[\d+\] (.*)$`)
+	reSpec      = regexp.MustCompile(`^SPEC (\w+) \[(\S+)\s+(\S+)\]$`)
+	reUpdated   = regexp.MustCompile(`^> Updated (\w+):(.*)$`)
+	reUpdateSet = regexp.MustCompile(`^\s*(add|rm)\{([^}]*)\}`)
+)
+
+// RuncChanges lists the entries added and removed from the px-runc configuration
+type RuncChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Empty returns TRUE if there are no changes
+func (c *RuncChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// RuncInstallResult is the parsed output of the `px-runc install` command
+type RuncInstallResult struct {
+	// SpecStatus is one of SpecCreated, SpecUpdated or SpecUnchanged (empty if not reported)
+	SpecStatus string `json:"specStatus"`
+	// Checksum and SpecFile identify the OCI spec (config.json)
+	Checksum string `json:"checksum,omitempty"`
+	SpecFile string `json:"specFile,omitempty"`
+	// Mounts, Args and Env are the configuration updates reported by px-runc
+	Mounts RuncChanges `json:"mounts"`
+	Args   RuncChanges `json:"args"`
+	Env    RuncChanges `json:"env"`
+	// UnitFile is the systemd unit file written by px-runc
+	UnitFile string `json:"unitFile,omitempty"`
+}
+
+// HasUpdates returns TRUE if any configuration updates were reported
+func (r *RuncInstallResult) HasUpdates() bool {
+	return !r.Mounts.Empty() || !r.Args.Empty() || !r.Env.Empty()
+}
+
+// String returns the summary of the result, suitable for logs
+func (r *RuncInstallResult) String() string {
+	return fmt.Sprintf("spec %s [%s], mounts +%d/-%d, args +%d/-%d, env +%d/-%d, unit-file %q",
+		r.SpecStatus, r.Checksum, len(r.Mounts.Added), len(r.Mounts.Removed), len(r.Args.Added),
+		len(r.Args.Removed), len(r.Env.Added), len(r.Env.Removed), r.UnitFile)
+}
+
+// logMessage extracts the message from the logrus-formatted line
+func logMessage(line string) string {
+	if m := reLogrusText.FindStringSubmatch(line); m != nil {
+		if msg, err := strconv.Unquote(m[1]); err == nil {
+			return msg
+		}
+		return strings.Trim(m[1], `"`)
+	} else if m := reLogrusTTY.FindStringSubmatch(line); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseUpdates parses the `add{...} rm{...}` list of updates
+func parseUpdates(in string, c *RuncChanges) error {
+	for in = strings.TrimSpace(in); in != ""; in = strings.TrimSpace(in) {
+		m := reUpdateSet.FindStringSubmatch(in)
+		if m == nil {
+			return fmt.Errorf("unrecognized updates %q", in)
+		}
+		if m[1] == "add" {
+			c.Added = append(c.Added, strings.Fields(m[2])...)
+		} else {
+			c.Removed = append(c.Removed, strings.Fields(m[2])...)
+		}
+		in = in[len(m[0]):]
+	}
+	return nil
+}
+
+// ParseRuncInstallOutput parses the output of the `px-runc install` command.
+// Returns an error if the output is not recognized (e.g. malformed updates, or no spec status nor updates reported).
+func ParseRuncInstallOutput(out string) (*RuncInstallResult, error) {
+	ret := &RuncInstallResult{}
+	for _, line := range strings.Split(out, "\n") {
+		msg := logMessage(line)
+		if m := reSpec.FindStringSubmatch(msg); m != nil {
+			switch m[1] {
+			case SpecCreated, SpecUpdated, SpecUnchanged:
+			default:
+				return nil, fmt.Errorf("Unrecognized spec status %q", m[1])
+			}
+			ret.SpecStatus, ret.Checksum, ret.SpecFile = m[1], m[2], m[3]
+		} else if m := reUpdated.FindStringSubmatch(msg); m != nil {
+			var c *RuncChanges
+			switch m[1] {
+			case "mounts":
+				c = &ret.Mounts
+			case "args":
+				c = &ret.Args
+			case "env":
+				c = &ret.Env
+			default:
+				return nil, fmt.Errorf("Unrecognized update of %q", m[1])
+			}
+			if err := parseUpdates(m[2], c); err != nil {
+				return nil, fmt.Errorf("Could not parse updated %s: %s", m[1], err)
+			}
+		} else if strings.HasPrefix(msg, "Successfully written ") {
+			ret.UnitFile = strings.TrimSpace(msg[len("Successfully written "):])
+		}
+	}
+	if ret.SpecStatus == "" {
+		if !ret.HasUpdates() {
+			return nil, fmt.Errorf("No spec status found in px-runc output")
+		}
+		// older px-runc only reports the updates
+		ret.SpecStatus = SpecUpdated
+	}
+	return ret, nil
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRuncInstallOutput(t *testing.T) {
+	res, err := ParseRuncInstallOutput(`time="2017-09-30T05:48:06Z" level=info msg="Rootfs found at /opt/pwx/oci/rootfs"
+time="2017-09-30T05:48:06Z" level=info msg="SPEC UPDATED [0892499e680147b53335759aa487886e  /opt/pwx/oci/config.json]"
+time="2017-09-30T05:48:06Z" level=info msg="> Updated mounts: add{/a:/a /b:/b:ro} rm{/c:/c}"
+time="2017-09-30T05:48:06Z" level=info msg="> Updated args: rm{-d eth1}"
+time="2017-09-30T05:48:06Z" level=info msg="> Updated env: add{FOO=\"bar\"}"
+time="2017-09-30T05:48:06Z" level=info msg="Successfully written /etc/systemd/system/portworx.service"
+Warning: portworx.service changed on disk. Run 'systemctl daemon-reload' to reload units.`)
+	assert.NoError(t, err)
+	assert.Equal(t, SpecUpdated, res.SpecStatus)
+	assert.Equal(t, "0892499e680147b53335759aa487886e", res.Checksum)
+	assert.Equal(t, "/opt/pwx/oci/config.json", res.SpecFile)
+	assert.Equal(t, []string{"/a:/a", "/b:/b:ro"}, res.Mounts.Added)
+	assert.Equal(t, []string{"/c:/c"}, res.Mounts.Removed)
+	assert.Empty(t, res.Args.Added)
+	assert.Equal(t, []string{"-d", "eth1"}, res.Args.Removed)
+	assert.Equal(t, []string{`FOO="bar"`}, res.Env.Added)
+	assert.Equal(t, "/etc/systemd/system/portworx.service", res.UnitFile)
+	assert.True(t, res.HasUpdates())
+
+	res, err = ParseRuncInstallOutput("INFO[0000] SPEC UNCHANGED [cc824f50 /opt/pwx/oci/config.json]\n")
+	assert.NoError(t, err)
+	assert.Equal(t, SpecUnchanged, res.SpecStatus)
+	assert.False(t, res.HasUpdates())
+
+	for _, out := range []string{
+		"",
+		"INFO[0000] Rootfs found at /opt/pwx/oci/rootfs",
+		"INFO[0000] SPEC REPLACED [cc824f50 /opt/pwx/oci/config.json]",
+		"INFO[0000] > Updated mounts: add{/a:/a",
+		"INFO[0000] > Updated labels: add{foo=bar}",
+	} {
+		_, err = ParseRuncInstallOutput(out)
+		assert.Error(t, err, "Expected error for %q", out)
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DockerSocket is the default location of the Docker socket
+	DockerSocket = "/var/run/docker.sock"
+	// ContainerdSocket is the default location of the containerd socket
+	ContainerdSocket = "/run/containerd/containerd.sock"
+	// CrioSocket is the default location of the CRI-O socket
+	CrioSocket = "/var/run/crio/crio.sock"
+	unixPrefix = "unix://"
+)
+
+// InstallerRuntime is a container runtime used to download and install the PX-OCI image
+type InstallerRuntime interface {
+	// PullImageCb pulls the image of a given name. The CallBack function is called if image is being downloaded.
+	PullImageCb(name string, cb DownloadNotifyCbFunc) error
+	// GetImageID inspects the image of a given name, and returns the image ID
+	GetImageID(name string) (string, error)
+	// GetRepoDigests inspects the image of a given name, and returns its repository digests (e.g. "repo@sha256:...")
+	GetRepoDigests(name string) ([]string, error)
+	// RunOnce will create container, run it, wait until it's finished, and finally remove it.
+	RunOnce(name, cntr string, binds, entrypoint, args []string, lproc LogProcessCb) error
+	// InspectSelf extracts the configuration of the container we're running in
+	InspectSelf() (*SimpleContainerConfig, error)
+	// ImportImage imports the images from the tarball or OCI-layout directory, and returns the imported image names
+	ImportImage(archive string) ([]string, error)
+	// ExportImage exports the image of a given name as tarball
+	ExportImage(name string, w io.Writer) error
+	// ExecInPod runs the command in the container of a given pod (running on this node), aborting it after timeout
+	ExecInPod(namespace, pod, container string, cmd []string, timeout time.Duration) (*ExecResult, error)
+}
+
+// ExecResult is the outcome of the command executed in the container
+type ExecResult struct {
+	// Output is the command's output, where stdout lines are prefixed w/ "> " and stderr lines w/ "E "
+	Output   string
+	ExitCode int
+}
+
+// RuntimeSockets lists the supported container runtime sockets
+var RuntimeSockets = []string{DockerSocket, ContainerdSocket, CrioSocket}
+
+// NewInstallerRuntime creates the container runtime for a given spec, which can be one of "docker", "containerd",
+// "crio" or "unix:///path/to/runtime.sock".  If the spec is empty, the runtime is auto-detected by probing the sockets.
+// The images are pulled w/ given registry credentials (nil if none) and pull configuration (nil for defaults, Docker
+// only), and the context will abort the runtime calls when cancelled.
+func NewInstallerRuntime(ctx context.Context, spec string, creds *RegistryCredentials, pull *PullConfig) (
+	InstallerRuntime, error) {
+	socket := ""
+	switch strings.ToLower(spec) {
+	case "":
+		for _, s := range RuntimeSockets {
+			if _, err := os.Stat(s); err == nil {
+				socket = s
+				break
+			}
+		}
+		if socket == "" {
+			return nil, fmt.Errorf("Could not find container runtime socket (tried %s)",
+				strings.Join(RuntimeSockets, ", "))
+		}
+		logrus.Info("Detected container runtime socket ", socket)
+	case "docker":
+		socket = DockerSocket
+	case "containerd":
+		socket = ContainerdSocket
+	case "crio", "cri-o":
+		socket = CrioSocket
+	default:
+		if !strings.HasPrefix(spec, unixPrefix) {
+			return nil, fmt.Errorf("Unsupported container runtime %q", spec)
+		}
+		socket = spec[len(unixPrefix):]
+	}
+
+	if strings.Contains(socket, "docker") {
+		return NewDockerInstaller(ctx, unixPrefix+socket, creds, pull)
+	}
+	return NewContainerdInstaller(ctx, socket, creds)
+}
@@ -18,6 +18,9 @@ const (
 	opEnable  = "enable"
 	opDisable = "disable"
 	ociDir    = "/opt/pwx/oci"
+	// opRollback and opUpgradeNow are handled via main()
+	opRollback   = "rollback"
+	opUpgradeNow = "upgrade-now"
 )
 
 // OciServiceControl provides "systemctl"-like controls over the external OCI service
@@ -134,7 +137,7 @@ func (o *OciServiceControl) HandleRequest(op string) error {
 	switch op {
 	case opStart, opStop, opRestart, opEnable, opDisable:
 		return o.do(op)
-	// NOTE: INSTALL and UNINSTALL (REMOVE) is being handling via main()
+	// NOTE: INSTALL, UNINSTALL (REMOVE), ROLLBACK and UPGRADE-NOW is being handling via main()
 	default:
 		return fmt.Errorf("Unsupported service request: %s", op)
 	}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
@@ -19,9 +21,12 @@ const (
 	httpHeaderContentLen  = "Content-Length"
 	httpHeaderConnection  = "Connection"
 	defaultOciEndpoint    = "127.0.0.1:9015"
-	nodeHealthURL         = "http://127.0.0.1:9001/v1/cluster/nodehealth"
+	pxAPIEndpoint         = "http://127.0.0.1:9001"
+	nodeHealthPath        = "/v1/cluster/nodehealth"
+	nodeHealthPollDelay   = 5 * time.Second
 	svcUriPrefix          = "/service/"
 	svcUriPrefixLen       = len(svcUriPrefix)
+	metricsURI            = "/metrics"
 )
 
 type installState int
@@ -30,17 +35,41 @@ const (
 	unknown installState = iota
 	installing
 	finished
+	rolledBack
 )
 
+// String returns the install state name, as used in metrics and status
+func (st installState) String() string {
+	switch st {
+	case installing:
+		return "installing"
+	case finished:
+		return "finished"
+	case rolledBack:
+		return "rolledback"
+	}
+	return "unknown"
+}
+
 // OciRESTServlet provides REST controls for OCI Monitor
 type OciRESTServlet struct {
 	ociCtl      *OciServiceControl
 	lock        *sync.Mutex
+	opLock      sync.Mutex
 	cli         *http.Client
 	srv         *http.Server
 	state       installState
 	node        *v1.Node
 	errorsGrace *time.Time
+	rollbackMsg string
+	rollbackFn  func(imageID string) error
+	statusLock  sync.Mutex
+	status      OciStatus
+	security    *RESTSecurityConfig
+	tlsCfg      *tls.Config
+	reviewToken func(token string) (string, error)
+	pxEndpoint  string
+	drainPolFn  func() *DrainPolicy
 }
 
 // NewRESTServlet returns new instance of the OciRESTServlet
@@ -58,9 +87,27 @@ func NewRESTServlet(ctl *OciServiceControl, node *v1.Node) *OciRESTServlet {
 		state:       unknown,
 		node:        node,
 		errorsGrace: &grace,
+		reviewToken: reviewToken,
+		pxEndpoint:  pxAPIEndpoint,
+		drainPolFn:  DefaultDrainPolicy,
 	}
 }
 
+// SetDrainPolicyLoader sets the function loading the drain policy for the drains via REST API
+func (s *OciRESTServlet) SetDrainPolicyLoader(fn func() *DrainPolicy) {
+	s.drainPolFn = fn
+}
+
+// SetSecurity configures the TLS and authentication of the REST server (must be called before Start)
+func (s *OciRESTServlet) SetSecurity(cfg *RESTSecurityConfig) error {
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return err
+	}
+	s.security, s.tlsCfg = cfg, tlsCfg
+	return nil
+}
+
 // handleOciRest is a Servlet implementation passed to http.HandleFunc()
 func (s *OciRESTServlet) handleOciRest(resp http.ResponseWriter, req *http.Request) {
 	header := resp.Header()
@@ -87,10 +134,23 @@ func (s *OciRESTServlet) handleOciRest(resp http.ResponseWriter, req *http.Reque
 		}
 		op := req.RequestURI[svcUriPrefixLen:]
 
-		s.lock.Lock()
-		defer s.lock.Unlock()
+		user, err := s.authenticate(req)
+		if err != nil {
+			logrus.WithError(err).Warnf("Unauthorized REST call %s %s from %s", req.Method, req.RequestURI,
+				req.RemoteAddr)
+			header.Add(httpHeaderAuthenticate, "Bearer")
+			http.Error(resp, "UNAUTHORIZED", http.StatusUnauthorized)
+			break
+		} else if user != "" {
+			logrus.Infof("REST call %s %s by %s", req.Method, req.RequestURI, user)
+		}
 
-		var err error
+		// note: the actions are serialized via opLock, as they run long (drain, restarts), and should not block the
+		// probes and the state updates (s.lock)
+		s.opLock.Lock()
+		defer s.opLock.Unlock()
+
+		start := time.Now()
 
 		switch op {
 		case opStart:
@@ -103,14 +163,27 @@ func (s *OciRESTServlet) handleOciRest(resp http.ResponseWriter, req *http.Reque
 			err = s.ociCtl.Enable()
 		case opDisable:
 			err = s.ociCtl.Disable()
-		case "drain":
-			err = DrainPxVolumeConsumerPods(s.node, true)
-		case "drain-managed":
-			err = DrainPxVolumeConsumerPods(s.node, false)
+		case "drain", "drain-managed":
+			var rep *DrainReport
+			rep, err = DrainPxVolumeConsumerPods(req.Context(), s.node, op == "drain", s.drainPolFn())
+			if rep != nil {
+				s.SetDrainReport(rep)
+			}
+		case opRollback:
+			err = s.rollback("")
 		default:
-			sendInvalidReq()
-			break
+			if !strings.HasPrefix(op, opRollback+"/") {
+				sendInvalidReq()
+				s.flush(resp)
+				return
+			}
+			err = s.rollback(op[len(opRollback)+1:])
 		}
+		action := op
+		if strings.HasPrefix(op, opRollback+"/") {
+			action = opRollback
+		}
+		metrics.observe(metrics.restActions, action, start, err)
 
 		if err == nil {
 			msg := fmt.Sprintf("REST action %s completed successfully\n", strings.ToUpper(op))
@@ -132,6 +205,25 @@ func (s *OciRESTServlet) handleOciRest(resp http.ResponseWriter, req *http.Reque
 	s.flush(resp)
 }
 
+// handleMetrics serves the OCI-Monitor metrics in Prometheus text format
+func (s *OciRESTServlet) handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	header := resp.Header()
+	header.Add(httpHeaderServer, "Portworx/OCI-monitor v1.0")
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		logrus.Warnf("Ignoring REST call %s %s", req.Method, req.RequestURI)
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	content := metrics.metricsText(s.getState())
+	header.Add(httpHeaderContentType, metricsContentType)
+	header.Add(httpHeaderContentLen, strconv.Itoa(len(content)))
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		resp.Write(content)
+	}
+}
+
 // handleGetHead method is shared between the GET/HEAD calls.
 func (s *OciRESTServlet) handleGetHead(resp http.ResponseWriter, sendData bool) {
 
@@ -149,21 +241,23 @@ func (s *OciRESTServlet) handleGetHead(resp http.ResponseWriter, sendData bool)
 	unknownStatusMsg := []byte("Node status UNKNOWN\n")
 
 	// If we're not finished installing (or, unknown), send status and return immediately
+	// note: the rolled back install is reported via status and metrics, the probes report the PX health
 	if st := s.getState(); st == unknown {
 		sendResp(http.StatusServiceUnavailable, unknownStatusMsg)
 		return
-	} else if s.getState() != finished {
+	} else if st != finished && st != rolledBack {
 		sendResp(http.StatusServiceUnavailable, []byte("Node status INSTALLING\n"))
 		return
 	}
 
 	// Else, proxy PX status
-	pxResp, err := s.cli.Get(nodeHealthURL)
+	pxResp, err := s.cli.Get(s.pxEndpoint + nodeHealthPath)
 	defer func() {
 		if pxResp != nil && pxResp.Body != nil {
 			pxResp.Body.Close()
 		}
 	}()
+	metrics.observeHealth(err == nil && pxResp.StatusCode == http.StatusOK)
 
 	if err != nil {
 		if s.errorsGrace != nil && time.Now().Before(*s.errorsGrace) {
@@ -200,6 +294,34 @@ func (s *OciRESTServlet) SetStateInstallFinished() {
 	s.state = finished
 }
 
+// SetStateRolledBack sets the OCI state to rolled back (ie. failed upgrade), with a given reason
+func (s *OciRESTServlet) SetStateRolledBack(msg string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = rolledBack
+	s.rollbackMsg = msg
+}
+
+// SetRollbackHandler sets the function which rolls back the OCI install to the retained install of a given image ID
+func (s *OciRESTServlet) SetRollbackHandler(fn func(imageID string) error) {
+	s.rollbackFn = fn
+}
+
+// rollback rolls back the OCI install to the retained install of a given image ID (or, the newest, if empty)
+func (s *OciRESTServlet) rollback(imageID string) error {
+	if s.rollbackFn == nil {
+		return fmt.Errorf("Rollback not supported")
+	}
+	return s.rollbackFn(imageID)
+}
+
+// getRollbackMsg returns the reason for the rollback
+func (s *OciRESTServlet) getRollbackMsg() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rollbackMsg
+}
+
 // getState returns the OCI installing status
 func (s *OciRESTServlet) getState() installState {
 	s.lock.Lock()
@@ -207,6 +329,41 @@ func (s *OciRESTServlet) getState() installState {
 	return s.state
 }
 
+// checkPxHealth queries PX node-health, and returns error if PX is not healthy
+func (s *OciRESTServlet) checkPxHealth() error {
+	pxResp, err := s.cli.Get(s.pxEndpoint + nodeHealthPath)
+	if err != nil {
+		metrics.observeHealth(false)
+		return err
+	}
+	defer pxResp.Body.Close()
+	io.Copy(ioutil.Discard, pxResp.Body)
+	metrics.observeHealth(pxResp.StatusCode == http.StatusOK)
+	if pxResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PX node-health returned %s", pxResp.Status)
+	}
+	return nil
+}
+
+// WaitPxHealthy polls PX node-health, until PX becomes healthy, the timeout expires or the context is cancelled
+func (s *OciRESTServlet) WaitPxHealthy(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := s.checkPxHealth()
+		if err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("PX not healthy after %s: %s", timeout, err)
+		}
+		logrus.WithError(err).Debug("PX not healthy yet")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(nodeHealthPollDelay):
+		}
+	}
+}
+
 // flush http-response implementation as suggested at
 // http://stackoverflow.com/questions/19292113/not-buffered-http-responsewritter-in-golang
 func (s *OciRESTServlet) flush(resp http.ResponseWriter) {
@@ -222,12 +379,30 @@ func (s *OciRESTServlet) Start(addr string) {
 	}
 	if s.srv == nil {
 		http.HandleFunc("/", s.handleOciRest)
-		s.srv = &http.Server{Addr: addr}
+		http.HandleFunc(metricsURI, s.handleMetrics)
+		http.HandleFunc(statusURI, s.handleStatus)
+		s.srv = &http.Server{Addr: addr, TLSConfig: s.tlsCfg}
+		if !s.security.AuthEnabled() {
+			logrus.Warn("REST server authentication not configured - service calls are NOT authenticated")
+		}
 		go func() {
-			if err := s.srv.ListenAndServe(); err != nil {
+			var err error
+			if s.security.TLSEnabled() {
+				err = s.srv.ListenAndServeTLS(s.security.CertFile, s.security.KeyFile)
+			} else {
+				err = s.srv.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
 				logrus.WithError(err).Error("Could not start new HTTP server")
 			}
 		}()
 	}
-	// CHECKME is s.srv.Shutdown(nil) required?
+}
+
+// Stop gracefully stops the OCI REST server
+func (s *OciRESTServlet) Stop(ctx context.Context) error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
 }
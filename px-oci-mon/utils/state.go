@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// InstallStateVersion is the current version of the install-state file format
+	InstallStateVersion = 1
+	// InstallResultOK marks successful install
+	InstallResultOK = "ok"
+	// InstallResultFailed marks failed install
+	InstallResultFailed = "failed"
+	// InstallResultRolledBack marks install that was rolled back to the previous version
+	InstallResultRolledBack = "rolledback"
+	// shortIDLen is the length of the "short" image IDs used in logs
+	shortIDLen = 12
+)
+
+// InstallState is the persistent record of the PX-OCI install, maintained by the OCI-Monitor.
+type InstallState struct {
+	Version          int       `json:"version"`
+	ImageName        string    `json:"imageName,omitempty"`
+	ImageID          string    `json:"imageID,omitempty"`
+	ConfigHash       string    `json:"configHash,omitempty"`
+	UnitFileChecksum string    `json:"unitFileChecksum,omitempty"`
+	InstalledAt      time.Time `json:"installedAt,omitempty"`
+	RestartedAt      time.Time `json:"restartedAt,omitempty"`
+	UpdatedAt        time.Time `json:"updatedAt,omitempty"`
+	LastResult       string    `json:"lastResult,omitempty"`
+	LastError        string    `json:"lastError,omitempty"`
+	// RolledBackImageID is the image that was rolled back (will not be re-installed)
+	RolledBackImageID string `json:"rolledBackImageID,omitempty"`
+	// InProgress is the install step modifying the live OCI install (set if the install got interrupted)
+	InProgress string `json:"inProgress,omitempty"`
+	// Cordoned is set while the node is cordoned by the OCI-Monitor
+	Cordoned bool `json:"cordoned,omitempty"`
+}
+
+// LoadInstallState reads the install-state from a given file.
+// Returns os.IsNotExist() -compatible error if the file does not exist.
+func LoadInstallState(fname string) (*InstallState, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var st InstallState
+	if err = json.Unmarshal(buf, &st); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", fname, err)
+	}
+	if st.Version > InstallStateVersion {
+		logrus.Warnf("Install-state %s has newer version %d (expected %d) - some fields may be ignored",
+			fname, st.Version, InstallStateVersion)
+	}
+	return &st, nil
+}
+
+// Save atomically writes the install-state into a given file.
+func (s *InstallState) Save(fname string) error {
+	s.Version = InstallStateVersion
+	s.UpdatedAt = time.Now().UTC()
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, append(buf, '\n'))
+}
+
+// writeFileAtomic writes the file via temporary file, which is then renamed to the final name
+func writeFileAtomic(fname string, buf []byte) error {
+	tmpf := path.Join(path.Dir(fname), "."+path.Base(fname)+".tmp")
+	if err := ioutil.WriteFile(tmpf, buf, 0644); err != nil {
+		return fmt.Errorf("Could not write %s: %s", tmpf, err)
+	}
+	if err := os.Rename(tmpf, fname); err != nil {
+		os.Remove(tmpf)
+		return fmt.Errorf("Could not rename %s to %s: %s", tmpf, fname, err)
+	}
+	return nil
+}
+
+// InstallPlan is the list of actions required to bring the installed state to the desired state
+type InstallPlan struct {
+	NeedInstall bool
+	NeedRestart bool
+	NeedCordon  bool
+	Reasons     []string
+}
+
+// AddInstallReason marks the install as required, and records the reason.
+func (p *InstallPlan) AddInstallReason(format string, args ...interface{}) {
+	p.NeedInstall = true
+	p.Reasons = append(p.Reasons, "install: "+fmt.Sprintf(format, args...))
+}
+
+// AddRestartReason marks the service-restart as required, and records the reason.
+func (p *InstallPlan) AddRestartReason(format string, args ...interface{}) {
+	p.NeedRestart = true
+	p.Reasons = append(p.Reasons, "restart: "+fmt.Sprintf(format, args...))
+}
+
+// AddDeferredReason records the change deferred to the next restart (does not require any actions).
+func (p *InstallPlan) AddDeferredReason(format string, args ...interface{}) {
+	p.Reasons = append(p.Reasons, "next-restart: "+fmt.Sprintf(format, args...))
+}
+
+// AddCordonReason marks the node-cordon as required, and records the reason.
+func (p *InstallPlan) AddCordonReason(format string, args ...interface{}) {
+	p.NeedCordon = true
+	p.Reasons = append(p.Reasons, "cordon: "+fmt.Sprintf(format, args...))
+}
+
+// IsNoop returns TRUE if the plan does not require any actions.
+func (p *InstallPlan) IsNoop() bool {
+	return !p.NeedInstall && !p.NeedRestart && !p.NeedCordon
+}
+
+// String returns human-readable representation of the plan.
+func (p *InstallPlan) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "install=%v restart=%v cordon=%v", p.NeedInstall, p.NeedRestart, p.NeedCordon)
+	for _, r := range p.Reasons {
+		b.WriteString("\n  - ")
+		b.WriteString(r)
+	}
+	return b.String()
+}
+
+// ShortID returns shortened image ID, suitable for logs (e.g. "sha256:0123456789ab" -> "0123456789ab").
+func ShortID(id string) string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > shortIDLen {
+		id = id[:shortIDLen]
+	}
+	return id
+}
+
+// DiffImage compares the installed image against the desired image, and returns the install-plan.
+func (s *InstallState) DiffImage(desired *InstallState) *InstallPlan {
+	p := &InstallPlan{}
+	if desired.ImageID == "" {
+		p.AddInstallReason("could not determine desired image ID")
+	} else if s.ImageID == "" {
+		p.AddInstallReason("no installed image recorded (initial install?)")
+	} else if s.ImageID == desired.ImageID {
+		// no install required
+	} else if s.RolledBackImageID == desired.ImageID {
+		logrus.Warnf("Image %s was rolled back previously - skipping the install (to retry, remove %q from the"+
+			" install record)", ShortID(desired.ImageID), "rolledBackImageID")
+	} else {
+		p.AddInstallReason("image changed from %s to %s", ShortID(s.ImageID), ShortID(desired.ImageID))
+	}
+	return p
+}
+
+// DiffConfig compares the installed configuration against the desired configuration, and adds the
+// restart-reasons to the install-plan.
+// Note that empty fields in the installed state (e.g. older installs) are not considered as changes.
+func (s *InstallState) DiffConfig(desired *InstallState, p *InstallPlan) {
+	if p.NeedInstall {
+		p.AddRestartReason("OCI upgrade/install")
+	}
+	if s.LastResult == InstallResultFailed {
+		p.AddRestartReason("last install did not complete (%s)", s.LastError)
+	}
+	if s.InProgress != "" {
+		p.AddRestartReason("last install was interrupted during %s", s.InProgress)
+	}
+	if s.ConfigHash != "" && s.ConfigHash != desired.ConfigHash {
+		p.AddRestartReason("px-runc arguments/mounts/environment changed")
+	}
+	if s.UnitFileChecksum != "" && desired.UnitFileChecksum != "" &&
+		s.UnitFileChecksum != desired.UnitFileChecksum {
+		p.AddRestartReason("service unit-file changed")
+	}
+}
+
+// SetFailed records the install error.  The install is marked as failed only if the error happened while the live
+// OCI install was being modified (see InProgress), so e.g. the failed image pulls do not force the PX restart.
+func (s *InstallState) SetFailed(err error) {
+	if s.InProgress != "" {
+		s.LastResult = InstallResultFailed
+	}
+	s.LastError = err.Error()
+}
+
+// Diff compares the installed state against the desired state, and returns the install-plan.
+func (s *InstallState) Diff(desired *InstallState) *InstallPlan {
+	p := s.DiffImage(desired)
+	s.DiffConfig(desired, p)
+	return p
+}
+
+// HashConfig computes the hash of the px-runc arguments, mounts and environment.
+// The arguments are order-sensitive, while mounts and environment are not.
+func HashConfig(args, mounts, env []string) string {
+	h := sha256.New()
+	for _, l := range [][]string{args, sortedCopy(mounts), sortedCopy(env)} {
+		for _, v := range l {
+			h.Write([]byte(v))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FileChecksum returns the SHA256 checksum of a given file.
+func FileChecksum(fname string) (string, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func sortedCopy(in []string) []string {
+	out := make([]string, len(in))
+	copy(out, in)
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statusURI            = "/status"
+	statusContentType    = "application/json"
+	maxStatusErrors      = 10
+	maxStatusOutputLines = 10
+)
+
+// StatusError is the error reported via the status API
+type StatusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// OciStatus is the machine-readable status of the OCI-Monitor, served via `GET /status`
+type OciStatus struct {
+	Node             string             `json:"node,omitempty"`
+	InstallState     string             `json:"installState"`
+	RollbackMessage  string             `json:"rollbackMessage,omitempty"`
+	InstalledImageID string             `json:"installedImageID,omitempty"`
+	DesiredImageID   string             `json:"desiredImageID,omitempty"`
+	ImageVerified    *ImageVerification `json:"imageVerification,omitempty"`
+	Pull             *PullProgress      `json:"pull,omitempty"`
+	InstallOutput    []string           `json:"installOutput,omitempty"`
+	NeedInstall      bool               `json:"needInstall"`
+	NeedRestart      bool               `json:"needRestart"`
+	NeedCordon       bool               `json:"needCordon"`
+	Reasons          []string           `json:"reasons,omitempty"`
+	ServiceCommand   string             `json:"serviceCommand,omitempty"`
+	PendingAction    *PendingAction     `json:"pendingAction,omitempty"`
+	WaitingFor       string             `json:"waitingFor,omitempty"`
+	LastDrain        *DrainReport       `json:"lastDrain,omitempty"`
+	Hooks            []*HookResult      `json:"hooks,omitempty"`
+	Errors           []StatusError      `json:"errors,omitempty"`
+}
+
+// SetInstallPlan records the last install-plan, reported via the status API
+func (s *OciRESTServlet) SetInstallPlan(plan *InstallPlan) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.NeedInstall, s.status.NeedRestart, s.status.NeedCordon = plan.NeedInstall, plan.NeedRestart, plan.NeedCordon
+	s.status.Reasons = append([]string{}, plan.Reasons...)
+}
+
+// SetInstallOutput records the summary (last few lines) of the `px-runc install` output
+func (s *OciRESTServlet) SetInstallOutput(out string) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) > maxStatusOutputLines {
+		lines = lines[len(lines)-maxStatusOutputLines:]
+	}
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.InstallOutput = lines
+}
+
+// SetImageVerification records the outcome of the last PX image verification
+func (s *OciRESTServlet) SetImageVerification(v *ImageVerification) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.ImageVerified = v
+}
+
+// SetServiceCommand records the last service-command requested via `px/service` label
+func (s *OciRESTServlet) SetServiceCommand(cmd string) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.ServiceCommand = cmd
+}
+
+// SetPendingAction records the action deferred until the maintenance window (nil if none)
+func (s *OciRESTServlet) SetPendingAction(p *PendingAction) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.PendingAction = p
+}
+
+// SetDrainReport records the per-pod report of the last drain
+func (s *OciRESTServlet) SetDrainReport(rep *DrainReport) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.LastDrain = rep
+}
+
+// SetHookResults records the results of the last hooks of a given kind (e.g. HookPreRestart)
+func (s *OciRESTServlet) SetHookResults(hook string, results []*HookResult) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	hooks := make([]*HookResult, 0, len(s.status.Hooks)+len(results))
+	for _, r := range s.status.Hooks {
+		if r.Hook != hook {
+			hooks = append(hooks, r)
+		}
+	}
+	s.status.Hooks = append(hooks, results...)
+}
+
+// SetWaitingFor records what the install is waiting for (e.g. upgrade lock, PX quorum), or empty if not waiting
+func (s *OciRESTServlet) SetWaitingFor(msg string) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.WaitingFor = msg
+}
+
+// RecordError records the error, reported via the status API (only the most recent errors are kept)
+func (s *OciRESTServlet) RecordError(err error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status.Errors = append(s.status.Errors, StatusError{Time: time.Now().UTC(), Message: err.Error()})
+	if len(s.status.Errors) > maxStatusErrors {
+		s.status.Errors = s.status.Errors[len(s.status.Errors)-maxStatusErrors:]
+	}
+}
+
+// GetStatus returns the current status of the OCI-Monitor
+func (s *OciRESTServlet) GetStatus() OciStatus {
+	st := s.getState()
+	rbMsg := ""
+	if st == rolledBack {
+		rbMsg = s.getRollbackMsg()
+	}
+
+	s.statusLock.Lock()
+	ret := s.status
+	ret.InstallOutput = append([]string{}, s.status.InstallOutput...)
+	ret.Reasons = append([]string{}, s.status.Reasons...)
+	ret.Errors = append([]StatusError{}, s.status.Errors...)
+	s.statusLock.Unlock()
+
+	metrics.lock.Lock()
+	ret.InstalledImageID, ret.DesiredImageID = metrics.installedImageID, metrics.desiredImageID
+	ret.Pull = metrics.pull
+	metrics.lock.Unlock()
+
+	if s.node != nil {
+		ret.Node = s.node.GetName()
+	}
+	ret.InstallState, ret.RollbackMessage = st.String(), rbMsg
+	return ret
+}
+
+// handleStatus serves the OCI-Monitor status in JSON format
+func (s *OciRESTServlet) handleStatus(resp http.ResponseWriter, req *http.Request) {
+	header := resp.Header()
+	header.Add(httpHeaderServer, "Portworx/OCI-monitor v1.0")
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		logrus.Warnf("Ignoring REST call %s %s", req.Method, req.RequestURI)
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	content, err := json.MarshalIndent(s.GetStatus(), "", "  ")
+	if err != nil {
+		logrus.WithError(err).Error("Could not encode status")
+		http.Error(resp, "INTERNAL ERROR - please check servers logs", http.StatusInternalServerError)
+		return
+	}
+	content = append(content, '\n')
+	header.Add(httpHeaderContentType, statusContentType)
+	header.Add(httpHeaderContentLen, strconv.Itoa(len(content)))
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		resp.Write(content)
+	}
+}
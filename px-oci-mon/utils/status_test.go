@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleStatus(t *testing.T) {
+	s := NewRESTServlet(nil, nil)
+	s.SetStateInstalling()
+	plan := &InstallPlan{}
+	plan.AddInstallReason("image changed")
+	plan.AddRestartReason("OCI upgrade/install")
+	s.SetInstallPlan(plan)
+	s.SetInstallOutput(strings.Repeat("line\n", 20) + "Reinstalled px-runc\n")
+	s.SetServiceCommand("restart")
+	for i := 0; i < maxStatusErrors+2; i++ {
+		s.RecordError(fmt.Errorf("error %d", i))
+	}
+
+	w := httptest.NewRecorder()
+	s.handleStatus(w, httptest.NewRequest(http.MethodGet, statusURI, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, statusContentType, w.Header().Get(httpHeaderContentType))
+
+	var st OciStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.Equal(t, "installing", st.InstallState)
+	assert.True(t, st.NeedInstall)
+	assert.True(t, st.NeedRestart)
+	assert.False(t, st.NeedCordon)
+	assert.Equal(t, plan.Reasons, st.Reasons)
+	assert.Equal(t, maxStatusOutputLines, len(st.InstallOutput))
+	assert.Equal(t, "Reinstalled px-runc", st.InstallOutput[maxStatusOutputLines-1])
+	assert.Equal(t, "restart", st.ServiceCommand)
+	assert.Equal(t, maxStatusErrors, len(st.Errors))
+	assert.Equal(t, "error 2", st.Errors[0].Message)
+
+	s.SetStateRolledBack("PX not healthy")
+	st = s.GetStatus()
+	assert.Equal(t, "rolledback", st.InstallState)
+	assert.Equal(t, "PX not healthy", st.RollbackMessage)
+
+	// rolled back PX is healthy -- probes succeed
+	s.cli.Transport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("OK\n"))}, nil
+	})
+	w = httptest.NewRecorder()
+	s.handleOciRest(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK\n", w.Body.String())
+	assert.Contains(t, string(metrics.metricsText(s.getState())), `px_oci_mon_install_state{state="rolledback"} 1`)
+}
+
+func TestWaitPxHealthyCancel(t *testing.T) {
+	s := NewRESTServlet(nil, nil)
+	s.cli.Transport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("connection refused")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.WaitPxHealthy(ctx, time.Hour)
+	assert.Equal(t, context.Canceled, err)
+
+	err = s.WaitPxHealthy(context.Background(), 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "PX not healthy")
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRESTRollbackDoesNotBlockState(t *testing.T) {
+	s := NewRESTServlet(nil, nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	s.SetRollbackHandler(func(string) error {
+		close(started)
+		<-release
+		// the rollback updates the state, like the install does
+		s.SetStateInstalling()
+		s.SetStateInstallFinished()
+		return nil
+	})
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		s.handleOciRest(w, httptest.NewRequest(http.MethodPost, svcUriPrefix+opRollback, nil))
+		done <- w.Code
+	}()
+	<-started
+
+	// probes and state updates are served while the rollback runs
+	s.SetStateInstalling()
+	w := httptest.NewRecorder()
+	s.handleOciRest(w, httptest.NewRequest(http.MethodHead, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest(http.MethodGet, metricsURI, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	close(release)
+	select {
+	case code := <-done:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("REST rollback deadlocked")
+	}
+	assert.Equal(t, finished, s.getState())
+}
@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// configMapClient is the subset of the Kubernetes ConfigMap API used by the UpgradeLock
+type configMapClient interface {
+	Get(name string, options meta_v1.GetOptions) (*v1.ConfigMap, error)
+	Create(*v1.ConfigMap) (*v1.ConfigMap, error)
+	Update(*v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// upgradeLease is the lock-holder entry in the ConfigMap
+type upgradeLease struct {
+	AcquiredAt time.Time `json:"acquiredAt"`
+	RenewedAt  time.Time `json:"renewedAt"`
+	Expires    time.Time `json:"expires"`
+}
+
+// UpgradeLock is the cluster-wide semaphore, which limits the number of nodes in the disruptive upgrade phase
+// (drain, OCI switchover, PX restart).  The lock holders are kept in the ConfigMap, and the ConfigMap updates are
+// protected via resource-version (optimistic locking).  The lock holders renew their lease periodically, so the
+// lease of the crashed holders expires after the TTL.
+// NOTE: the Lease API is not available in our Kubernetes client, nor the ConfigMaps API in sched-ops.
+type UpgradeLock struct {
+	Namespace, Name string
+	Holder          string
+	MaxHolders      int
+	TTL             time.Duration
+	cli             configMapClient
+	lock            sync.Mutex
+	stopRenew       chan struct{}
+}
+
+// NewUpgradeLock creates the upgrade lock stored in a given ConfigMap, held by a given holder (e.g. node name)
+func NewUpgradeLock(namespace, name, holder string, maxHolders int, ttl time.Duration) (*UpgradeLock, error) {
+	cli, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	return &UpgradeLock{
+		Namespace:  namespace,
+		Name:       name,
+		Holder:     holder,
+		MaxHolders: maxHolders,
+		TTL:        ttl,
+		cli:        cli.CoreV1().ConfigMaps(namespace),
+	}, nil
+}
+
+// getLeases returns the lock ConfigMap (creates it if missing), and the leases of the lock holders
+func (l *UpgradeLock) getLeases() (*v1.ConfigMap, map[string]*upgradeLease, error) {
+	cm, err := l.cli.Get(l.Name, meta_v1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		cm, err = l.cli.Create(&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: l.Name, Namespace: l.Namespace},
+		})
+		if k8s_errors.IsAlreadyExists(err) {
+			cm, err = l.cli.Get(l.Name, meta_v1.GetOptions{})
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get ConfigMap %s/%s: %s", l.Namespace, l.Name, err)
+	}
+	leases := make(map[string]*upgradeLease, len(cm.Data))
+	for k, v := range cm.Data {
+		lease := &upgradeLease{}
+		if err = json.Unmarshal([]byte(v), lease); err != nil {
+			logrus.WithError(err).Warnf("Dropping invalid upgrade-lock lease of %s", k)
+			continue
+		}
+		leases[k] = lease
+	}
+	return cm, leases, nil
+}
+
+// updateLeases stores the leases into the ConfigMap (fails w/ conflict if the ConfigMap got updated meanwhile)
+func (l *UpgradeLock) updateLeases(cm *v1.ConfigMap, leases map[string]*upgradeLease) error {
+	cm.Data = make(map[string]string, len(leases))
+	for k, v := range leases {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		cm.Data[k] = string(buf)
+	}
+	_, err := l.cli.Update(cm)
+	return err
+}
+
+// modify applies a given modification of the leases, retrying on conflicts
+func (l *UpgradeLock) modify(fn func(now time.Time, leases map[string]*upgradeLease) bool) error {
+	for retry := 0; ; retry++ {
+		cm, leases, err := l.getLeases()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for k, v := range leases {
+			if now.After(v.Expires) {
+				logrus.Warnf("Upgrade-lock lease of %s expired at %s - dropping", k, v.Expires)
+				delete(leases, k)
+			}
+		}
+		if !fn(now, leases) {
+			return nil
+		}
+		err = l.updateLeases(cm, leases)
+		if err == nil || !k8s_errors.IsConflict(err) {
+			return err
+		} else if retry >= 10 {
+			return fmt.Errorf("Could not update ConfigMap %s/%s: %s", l.Namespace, l.Name, err)
+		}
+		logrus.Debugf("Conflict updating ConfigMap %s/%s - retrying", l.Namespace, l.Name)
+	}
+}
+
+// TryAcquire attempts to acquire the lock.  Returns the current lock holders if the lock is not available.
+func (l *UpgradeLock) TryAcquire() (bool, []string, error) {
+	var holders []string
+	acquired := false
+	err := l.modify(func(now time.Time, leases map[string]*upgradeLease) bool {
+		if lease, has := leases[l.Holder]; has {
+			// already holding (e.g. restarted while holding the lock)
+			lease.RenewedAt, lease.Expires, acquired = now, now.Add(l.TTL), true
+			return true
+		} else if len(leases) >= l.MaxHolders {
+			for k := range leases {
+				holders = append(holders, k)
+			}
+			sort.Strings(holders)
+			return false
+		}
+		leases[l.Holder] = &upgradeLease{AcquiredAt: now, RenewedAt: now, Expires: now.Add(l.TTL)}
+		acquired = true
+		return true
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return acquired, holders, nil
+}
+
+// Acquire waits until the lock is acquired (or the context cancelled), and starts renewing the lease.
+// The waitFn is called while waiting for the lock, with the list of the current lock holders.
+func (l *UpgradeLock) Acquire(ctx context.Context, pollInterval time.Duration, waitFn func(holders []string)) error {
+	for {
+		ok, holders, err := l.TryAcquire()
+		if err != nil {
+			logrus.WithError(err).Warn("Could not acquire upgrade lock (will retry)")
+		} else if ok {
+			break
+		} else if waitFn != nil {
+			waitFn(holders)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Aborted waiting for upgrade lock: %s", ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+
+	logrus.Infof("Acquired upgrade lock %s/%s", l.Namespace, l.Name)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopRenew == nil {
+		l.stopRenew = make(chan struct{})
+		go l.renew(l.stopRenew)
+	}
+	return nil
+}
+
+// renew periodically renews the lease, until stopped
+func (l *UpgradeLock) renew(stop chan struct{}) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if ok, _, err := l.TryAcquire(); err != nil {
+			logrus.WithError(err).Warn("Could not renew upgrade lock")
+		} else if !ok {
+			logrus.Error("Lost upgrade lock (lease expired)")
+		}
+	}
+}
+
+// Release stops renewing, and releases the lock
+func (l *UpgradeLock) Release() error {
+	l.lock.Lock()
+	if l.stopRenew != nil {
+		close(l.stopRenew)
+		l.stopRenew = nil
+	}
+	l.lock.Unlock()
+
+	err := l.modify(func(now time.Time, leases map[string]*upgradeLease) bool {
+		if _, has := leases[l.Holder]; !has {
+			return false
+		}
+		delete(leases, l.Holder)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Could not release upgrade lock: %s", err)
+	}
+	logrus.Infof("Released upgrade lock %s/%s", l.Namespace, l.Name)
+	return nil
+}
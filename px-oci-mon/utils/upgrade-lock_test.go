@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConfigMaps is the in-memory ConfigMap store, which enforces the resource versions on updates
+type fakeConfigMaps struct {
+	sync.Mutex
+	cms       map[string]*v1.ConfigMap
+	conflicts int
+}
+
+var cmResource = schema.GroupResource{Resource: "configmaps"}
+
+func (f *fakeConfigMaps) Get(name string, options meta_v1.GetOptions) (*v1.ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+	cm, has := f.cms[name]
+	if !has {
+		return nil, k8s_errors.NewNotFound(cmResource, name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, has := f.cms[cm.Name]; has {
+		return nil, k8s_errors.NewAlreadyExists(cmResource, cm.Name)
+	}
+	cm = cm.DeepCopy()
+	cm.ResourceVersion = "1"
+	f.cms[cm.Name] = cm
+	return cm.DeepCopy(), nil
+}
+
+func (f *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+	cur, has := f.cms[cm.Name]
+	if !has {
+		return nil, k8s_errors.NewNotFound(cmResource, cm.Name)
+	} else if f.conflicts > 0 || cur.ResourceVersion != cm.ResourceVersion {
+		f.conflicts--
+		return nil, k8s_errors.NewConflict(cmResource, cm.Name, nil)
+	}
+	cm = cm.DeepCopy()
+	ver, _ := strconv.Atoi(cur.ResourceVersion)
+	cm.ResourceVersion = strconv.Itoa(ver + 1)
+	f.cms[cm.Name] = cm
+	return cm.DeepCopy(), nil
+}
+
+func newTestLock(cli configMapClient, holder string) *UpgradeLock {
+	return &UpgradeLock{Namespace: "kube-system", Name: "lock", Holder: holder, MaxHolders: 2, TTL: time.Minute,
+		cli: cli}
+}
+
+func TestUpgradeLock(t *testing.T) {
+	cli := &fakeConfigMaps{cms: make(map[string]*v1.ConfigMap)}
+	l1, l2, l3 := newTestLock(cli, "node1"), newTestLock(cli, "node2"), newTestLock(cli, "node3")
+
+	ok, _, err := l1.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	cli.conflicts = 2 // retried on conflicts
+	ok, _, err = l2.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, holders, err := l3.TryAcquire()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []string{"node1", "node2"}, holders)
+
+	// re-entrant
+	ok, _, err = l1.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// released lock can be acquired
+	assert.NoError(t, l1.Release())
+	ok, _, err = l3.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// expired lease gets dropped
+	cm, _ := cli.Get("lock", meta_v1.GetOptions{})
+	cm.Data["node2"] = `{"expires": "2018-01-01T00:00:00Z"}`
+	cli.cms["lock"] = cm
+	ok, _, err = l1.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestUpgradeLockAcquire(t *testing.T) {
+	cli := &fakeConfigMaps{cms: make(map[string]*v1.ConfigMap)}
+	l1, l2 := newTestLock(cli, "node1"), newTestLock(cli, "node2")
+	l1.MaxHolders, l2.MaxHolders = 1, 1
+
+	assert.NoError(t, l1.Acquire(context.Background(), time.Millisecond, nil))
+
+	// waits for the lock until cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var waitHolders []string
+	err := l2.Acquire(ctx, 10*time.Millisecond, func(holders []string) { waitHolders = holders })
+	assert.Error(t, err)
+	assert.Equal(t, []string{"node1"}, waitHolders)
+
+	// acquires once released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l1.Release()
+	}()
+	assert.NoError(t, l2.Acquire(context.Background(), 5*time.Millisecond, nil))
+	assert.NoError(t, l2.Release())
+}
@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestGetMyContainerID(t *testing.T) {
@@ -40,3 +45,156 @@ func TestGetMyContainerID(t *testing.T) {
 	assert.Equal(t, "d1b8179dbb75053ffcdc2a066f46f73d16dd5cce75a41c22f6363ba8102aa667", tripl[0][1])
 
 }
+
+func TestInstallStateDiff(t *testing.T) {
+	installed := &InstallState{
+		ImageID:          "sha256:0123456789abcdef0123456789abcdef",
+		ConfigHash:       HashConfig([]string{"-c", "cl1"}, []string{"/a:/a", "/b:/b"}, []string{"A=1", "B=2"}),
+		UnitFileChecksum: "cafe",
+		LastResult:       InstallResultOK,
+	}
+
+	// same config (mounts/env order irrelevant) -- no-op
+	desired := &InstallState{
+		ImageID:          installed.ImageID,
+		ConfigHash:       HashConfig([]string{"-c", "cl1"}, []string{"/b:/b", "/a:/a"}, []string{"B=2", "A=1"}),
+		UnitFileChecksum: "cafe",
+	}
+	p := installed.Diff(desired)
+	assert.True(t, p.IsNoop(), "Unexpected plan %s", p)
+
+	// args changed -- restart
+	desired.ConfigHash = HashConfig([]string{"-c", "cl2"}, []string{"/a:/a", "/b:/b"}, []string{"A=1", "B=2"})
+	p = installed.Diff(desired)
+	assert.False(t, p.NeedInstall)
+	assert.True(t, p.NeedRestart)
+	assert.Equal(t, 1, len(p.Reasons))
+
+	// image changed -- install + restart
+	desired.ConfigHash = installed.ConfigHash
+	desired.ImageID = "sha256:fedcba9876543210fedcba9876543210"
+	p = installed.Diff(desired)
+	assert.True(t, p.NeedInstall)
+	assert.True(t, p.NeedRestart)
+	assert.Contains(t, p.String(), "image changed from 0123456789ab to fedcba987654")
+
+	// older records w/o config -- only image matters
+	p = (&InstallState{ImageID: installed.ImageID}).Diff(&InstallState{ImageID: installed.ImageID, ConfigHash: "x"})
+	assert.True(t, p.IsNoop(), "Unexpected plan %s", p)
+
+	// failed last install -- restart
+	installed.LastResult, installed.LastError = InstallResultFailed, "boom"
+	p = installed.Diff(&InstallState{ImageID: installed.ImageID, ConfigHash: installed.ConfigHash})
+	assert.False(t, p.NeedInstall)
+	assert.True(t, p.NeedRestart)
+
+	// interrupted install -- restart
+	installed.LastResult, installed.InProgress = InstallResultOK, "finalize"
+	p = installed.Diff(&InstallState{ImageID: installed.ImageID, ConfigHash: installed.ConfigHash})
+	assert.False(t, p.NeedInstall)
+	assert.True(t, p.NeedRestart)
+	assert.Contains(t, p.String(), "interrupted during finalize")
+	installed.InProgress = ""
+
+	// rolled back image -- not re-installed
+	installed.LastResult, installed.RolledBackImageID = InstallResultRolledBack, desired.ImageID
+	p = installed.DiffImage(desired)
+	assert.True(t, p.IsNoop(), "Unexpected plan %s", p)
+}
+
+func TestInstallStateSetFailed(t *testing.T) {
+	installed := &InstallState{
+		ImageID:    "sha256:0123456789abcdef0123456789abcdef",
+		ConfigHash: HashConfig([]string{"-c", "cl1"}, nil, nil),
+		LastResult: InstallResultOK,
+	}
+	desired := &InstallState{ImageID: installed.ImageID, ConfigHash: installed.ConfigHash}
+
+	// failed pull, followed by no-op install -- no restart
+	installed.SetFailed(fmt.Errorf("Could not pull portworx/px-enterprise:2.0: TLS handshake timeout"))
+	assert.Equal(t, InstallResultOK, installed.LastResult)
+	assert.Contains(t, installed.LastError, "TLS handshake timeout")
+	p := installed.Diff(desired)
+	assert.True(t, p.IsNoop(), "Unexpected plan %s", p)
+
+	// failed while modifying the live OCI install -- restart
+	installed.InProgress = "configure"
+	installed.SetFailed(fmt.Errorf("px-runc install failed"))
+	installed.InProgress = ""
+	assert.Equal(t, InstallResultFailed, installed.LastResult)
+	p = installed.Diff(desired)
+	assert.False(t, p.NeedInstall)
+	assert.True(t, p.NeedRestart)
+	assert.Contains(t, p.String(), "px-runc install failed")
+}
+
+func TestInstallStateSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fname := path.Join(dir, "state.json")
+	_, err = LoadInstallState(fname)
+	assert.True(t, os.IsNotExist(err))
+
+	st := &InstallState{ImageID: "sha256:1234", LastResult: InstallResultOK}
+	assert.NoError(t, st.Save(fname))
+
+	st2, err := LoadInstallState(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, InstallStateVersion, st2.Version)
+	assert.Equal(t, "sha256:1234", st2.ImageID)
+	assert.Equal(t, InstallResultOK, st2.LastResult)
+	assert.False(t, st2.UpdatedAt.IsZero())
+}
+
+func TestRetainedInstalls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-retained")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = FindRetainedInstall(dir, "")
+	assert.Error(t, err)
+
+	ids := []string{"sha256:111111111111aaaa", "sha256:222222222222bbbb", "sha256:333333333333cccc"}
+	for _, id := range ids {
+		rdir := RetainedInstallDir(dir, id)
+		assert.NoError(t, os.MkdirAll(rdir, 0700))
+		assert.NoError(t, (&InstallState{ImageID: id}).Save(path.Join(rdir, RetainedRecordFile)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "junk"), 0700))
+
+	list, err := ListRetainedInstalls(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, ids[2], list[0].State.ImageID)
+
+	ri, err := FindRetainedInstall(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, ids[2], ri.State.ImageID)
+
+	ri, err = FindRetainedInstall(dir, "1111111")
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(dir, "111111111111"), ri.Dir)
+
+	_, err = FindRetainedInstall(dir, "sha256:4444")
+	assert.Error(t, err)
+
+	assert.NoError(t, PruneRetainedInstalls(dir, 2))
+	list, err = ListRetainedInstalls(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(list))
+	_, err = FindRetainedInstall(dir, ids[0])
+	assert.Error(t, err)
+}
+
+func TestIsDuplicateEvent(t *testing.T) {
+	assert.False(t, isDuplicateEvent("Normal/PxTest/msg1"))
+	assert.True(t, isDuplicateEvent("Normal/PxTest/msg1"))
+	assert.False(t, isDuplicateEvent("Normal/PxTest/msg2"))
+
+	// expired entry
+	lastEvents["Normal/PxTest/msg1"] = time.Now().Add(-eventDedupInterval)
+	assert.False(t, isDuplicateEvent("Normal/PxTest/msg1"))
+}